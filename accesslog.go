@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader carries the ID the load balancer gave to a request
+const RequestIDHeader = "X-LB-Request-ID"
+
+// requestLog collects what happened to a request while it was served
+type requestLog struct {
+	// ID is sent to backends in RequestIDHeader
+	ID string
+	// Backend is the last backend the request was sent to
+	Backend string
+	// Failures counts the tries that failed before the response
+	Failures int
+	// Tries lists every time the request was sent to a backend
+	Tries []requestTry
+	// Status is the status code of the response sent to the client
+	Status int
+	// BodyHash is the hex SHA-256 of the request body, see bodyHashMiddleware
+	BodyHash string
+
+	start time.Time
+}
+
+// requestTry is one sending of a request to a backend
+type requestTry struct {
+	Backend string
+	Took    time.Duration
+	Status  int
+	Err     string
+	start   time.Time
+	done    bool
+}
+
+// begin records that the request is being sent to backend
+func (l *requestLog) begin(backend string) {
+	l.Backend = backend
+	l.Tries = append(l.Tries, requestTry{Backend: backend, start: time.Now()})
+}
+
+// end records the outcome of the current try
+func (l *requestLog) end(err error) {
+	if len(l.Tries) == 0 {
+		return
+	}
+	try := &l.Tries[len(l.Tries)-1]
+	if try.done {
+		return
+	}
+	try.done = true
+	try.Took = time.Since(try.start)
+	if err != nil {
+		try.Err = err.Error()
+		l.Failures++
+	}
+}
+
+// respond records the status code of a response, from the current try
+// if it was answered by a backend
+func (l *requestLog) respond(status int, fromBackend bool) {
+	l.Status = status
+	if fromBackend && len(l.Tries) > 0 {
+		l.Tries[len(l.Tries)-1].Status = status
+	}
+}
+
+// String lists the tries with their timings
+func (l *requestLog) String() string {
+	tries := make([]string, 0, len(l.Tries))
+	for _, try := range l.Tries {
+		s := fmt.Sprintf("%s %s", try.Backend, try.Took)
+		if try.Status != 0 {
+			s += fmt.Sprintf(" %d", try.Status)
+		}
+		if try.Err != "" {
+			s += fmt.Sprintf(" %q", try.Err)
+		}
+		tries = append(tries, s)
+	}
+	return "[" + strings.Join(tries, ", ") + "]"
+}
+
+// logTrace logs in a single line the tries of a request that needed more
+// than one, once it is answered
+func logTrace(r *http.Request) {
+	entry := GetRequestLogFromContext(r)
+	if entry == nil || entry.Failures == 0 {
+		return
+	}
+	entry.end(nil)
+	log.Printf("%s(%s) %s answered %d after %s, failures=%d id=%s tries=%s\n",
+		r.RemoteAddr, r.URL.Path, r.Method, entry.Status, time.Since(entry.start),
+		entry.Failures, entry.ID, entry)
+}
+
+// GetRequestLogFromContext returns the log entry of the request, or nil
+// outside of accessLogMiddleware
+func GetRequestLogFromContext(r *http.Request) *requestLog {
+	if entry, ok := r.Context().Value(RequestLog).(*requestLog); ok {
+		return entry
+	}
+	return nil
+}
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses through
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, used by CONNECT tunnels and upgrades
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		// the server timeouts are meant for requests, not for tunnels
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLogMiddleware gives each request an ID, follows it in a requestLog
+// and, with config.AccessLog, logs a line per request once the response is
+// sent. Only a share of config.AccessLogSampleRate of the requests is logged, or
+// with config.SlowRequestThreshold only the slow ones. Requests that failed
+// or needed a retry are always logged.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		entry := &requestLog{ID: id, start: start}
+		timing := &RequestTiming{}
+		rec := &statusRecorder{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), RequestLog, entry)
+		ctx = context.WithValue(ctx, Timing, timing)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		entry.end(nil)
+		if !config.AccessLog {
+			return
+		}
+		took := time.Since(start)
+
+		failed := rec.status >= http.StatusInternalServerError || entry.Failures > 0
+		slow := config.SlowRequestThreshold > 0 && took >= time.Duration(config.SlowRequestThreshold)
+		switch {
+		case failed, slow:
+		case config.SlowRequestThreshold > 0:
+			return
+		case !sampled(config.AccessLogSampleRate):
+			return
+		}
+
+		line := fmt.Sprintf("%s %s %s %d %dB %s backend=%s failures=%d id=%s %s",
+			r.RemoteAddr, r.Method, r.URL.RequestURI(), rec.status, rec.bytes,
+			took, entry.Backend, entry.Failures, entry.ID, timing)
+		if entry.BodyHash != "" {
+			line += " body_hash=" + entry.BodyHash
+		}
+		if failed || slow {
+			line += " tries=" + entry.String()
+		}
+		log.Println(line)
+	})
+}
+
+// newRequestID returns a random UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		log.Println("Generating request ID failed, err: ", err)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sampled reports whether a request falls in the sampled share rate
+func sampled(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"loadbalancer/backend"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendStatus is the admin API representation of a backend
+type backendStatus struct {
+	URL     string            `json:"url"`
+	Alive   bool              `json:"alive"`
+	Zone    string            `json:"zone,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Weight  int               `json:"weight"`
+	Dynamic float64           `json:"dynamic_weight"`
+	Drain   string            `json:"drain_state"`
+	Forced  bool              `json:"forced,omitempty"`
+	Circuit string            `json:"circuit"`
+	Active  int64             `json:"active_connections"`
+	Total   uint64            `json:"requests"`
+	ErrRate float64           `json:"error_rate"`
+	P99     Duration          `json:"p99_latency"`
+}
+
+// newBackendStatus returns the admin API representation of b
+func newBackendStatus(b *backend.Backend) backendStatus {
+	counts := b.ResponseCounts()
+	var errRate float64
+	if total := counts.Total(); total > 0 {
+		errRate = float64(counts.Responses5xx) / float64(total)
+	}
+	return backendStatus{
+		URL:     b.URL.String(),
+		Alive:   b.IsAlive(),
+		Zone:    b.Zone,
+		Tags:    b.Tags,
+		Weight:  b.Weight(),
+		Dynamic: b.CurrentDynamicWeight(),
+		Drain:   b.DrainState(),
+		Forced:  b.Forced(),
+		Circuit: b.CircuitState(),
+		Active:  b.ActiveConnections(),
+		Total:   counts.Total(),
+		ErrRate: errRate,
+		P99:     Duration(b.Latency(0.99)),
+	}
+}
+
+// adminRateLimit is the number of admin API requests allowed per client IP
+// and per minute
+const adminRateLimit = 100
+
+// adminAuthMiddleware logs every admin API call, limits the calls of each
+// client IP and, with config.AdminAPIKey, rejects calls without the key
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	limiter := newTokenBucketLimiter(adminRateLimit, time.Minute)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		log.Printf("Admin API %s %s from %s\n", r.Method, r.URL.RequestURI(), ip)
+		if !limiter.Allow(ip) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		// the dashboard page holds no data, it asks for the key to call the API
+		if config.AdminAPIKey != "" && !isAdminUI(r) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(config.AdminAPIKey)) != 1 {
+				log.Printf("Admin API %s %s from %s: unauthorized\n", r.Method, r.URL.RequestURI(), ip)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler returns the handler of the admin API
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backends", adminBackends)
+	mux.HandleFunc("/admin/healthcheck", adminHealthCheck)
+	mux.HandleFunc("/admin/config", adminConfig)
+	mux.HandleFunc("/admin/config/validate", adminValidateConfig)
+	mux.HandleFunc("/admin/response-code-map", adminResponseCodeMap)
+	mux.HandleFunc("/admin/pools/clone", adminClonePool)
+	mux.HandleFunc("/status", adminStatus)
+	mux.Handle("/admin/ui/", adminUI())
+	mux.Handle("/admin/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// backend URLs contain escaped slashes, which ServeMux would clean
+		if strings.HasPrefix(r.URL.EscapedPath(), "/admin/backends/") {
+			adminBackend(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminBackend serves /admin/backends/{url} and /admin/backends/{url}/{action}
+// where {url} is the path escaped URL of a backend, e.g. http%3A%2F%2Flocalhost%3A3031
+func adminBackend(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/admin/backends/")
+	parts := strings.Split(rest, "/")
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	rawURL, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, "malformed backend url", http.StatusBadRequest)
+		return
+	}
+	b := serverPool.GetBackend(rawURL)
+	if b == nil {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		adminRemoveBackend(w, r, b)
+		return
+	}
+	switch parts[1] {
+	case "weight":
+		adminSetWeight(w, r, b)
+	case "healthcheck":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		writeJSON(w, checkBackend(b))
+	case "force-alive", "force-dead":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		alive := parts[1] == "force-alive"
+		serverPool.ForceStatus(b, alive)
+		log.Printf("%s forced %s from admin API\n", b.URL, strings.TrimPrefix(parts[1], "force-"))
+		writeJSON(w, newBackendStatus(b))
+	case "auto-health":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		serverPool.AutoHealth(b)
+		log.Printf("%s back to health checks from admin API\n", b.URL)
+		writeJSON(w, newBackendStatus(b))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// defaultPageSize is the page size of /admin/backends when only ?page is given
+const defaultPageSize = 20
+
+// backendPage is a page of the backend list of /admin/backends
+type backendPage struct {
+	Backends []backendStatus `json:"backends"`
+	Total    int             `json:"total"`
+	Page     int             `json:"page"`
+	PageSize int             `json:"page_size"`
+	Next     string          `json:"next,omitempty"`
+}
+
+// adminBackends serves GET /admin/backends, the list of all backends or
+// with ?tag=key=value of the backends carrying a tag. With ?page=P and
+// ?page_size=N the reply is a backendPage instead of the whole list.
+func adminBackends(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	backends := serverPool.Backends()
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			http.Error(w, "tag must be of the form key=value", http.StatusBadRequest)
+			return
+		}
+		backends = serverPool.FilterByTag(kv[0], kv[1])
+	}
+	query := r.URL.Query()
+	if query.Get("page") == "" && query.Get("page_size") == "" {
+		writeJSON(w, newBackendStatuses(backends))
+		return
+	}
+
+	page, pageSize := 1, defaultPageSize
+	for name, v := range map[string]*int{"page": &page, "page_size": &pageSize} {
+		if s := query.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				http.Error(w, name+" must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			*v = n
+		}
+	}
+	p := backendPage{Total: len(backends), Page: page, PageSize: pageSize}
+	start := len(backends)
+	if page-1 < len(backends)/pageSize+1 {
+		start = (page - 1) * pageSize
+	}
+	if start > len(backends) {
+		start = len(backends)
+	}
+	end := len(backends)
+	if pageSize < end-start {
+		end = start + pageSize
+	}
+	p.Backends = newBackendStatuses(backends[start:end])
+	if end < len(backends) {
+		query.Set("page", strconv.Itoa(page+1))
+		query.Set("page_size", strconv.Itoa(pageSize))
+		p.Next = r.URL.Path + "?" + query.Encode()
+	}
+	writeJSON(w, p)
+}
+
+// newBackendStatuses returns the admin API representation of backends
+func newBackendStatuses(backends []*backend.Backend) []backendStatus {
+	statuses := make([]backendStatus, 0, len(backends))
+	for _, b := range backends {
+		statuses = append(statuses, newBackendStatus(b))
+	}
+	return statuses
+}
+
+// adminConfig serves GET /admin/config, the configuration resolved at
+// startup as printed by -dry-run. Sensitive fields are left out of the JSON
+// encoding of Config.
+func adminConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, config)
+}
+
+// adminResponseCodeMap serves GET and PUT /admin/response-code-map, the
+// body of a PUT replaces the map, e.g. {"404": 200, "500": 503}
+func adminResponseCodeMap(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var codes map[int]int
+		if err := json.NewDecoder(r.Body).Decode(&codes); err != nil {
+			http.Error(w, "malformed body", http.StatusBadRequest)
+			return
+		}
+		if err := validateCodeMap(codes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serverPool.SetResponseCodeMap(codes)
+		log.Printf("Response code map set to %s\n", codeMapFlag{&codes})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, serverPool.ResponseCodes())
+}
+
+// adminClonePool serves POST /admin/pools/clone, it replies with the
+// backends of a clone of the pool changed by the body, such as
+// {"remove": ["http://10.0.1.1:3031"], "add": ["http://10.0.1.9:3031;weight=2"]}.
+// The clone only previews the pool, it serves no traffic.
+func adminClonePool(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var body struct {
+		Remove []string `json:"remove"`
+		Add    []string `json:"add"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "malformed body", http.StatusBadRequest)
+		return
+	}
+	clone := serverPool.Clone()
+	for _, rawURL := range body.Remove {
+		b := clone.GetBackend(rawURL)
+		if b == nil {
+			http.Error(w, fmt.Sprintf("backend %s not in the pool", rawURL), http.StatusNotFound)
+			return
+		}
+		clone.RemoveBackend(b)
+	}
+	for _, spec := range body.Add {
+		u, bc, err := parseBackendSpec(spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := clone.AddBackend(newBackend(u, bc)); err != nil {
+			http.Error(w, fmt.Sprintf("backend %s: %s", u, err), http.StatusConflict)
+			return
+		}
+	}
+	writeJSON(w, newBackendStatuses(clone.Backends()))
+}
+
+// adminValidateConfig serves POST /admin/config/validate, the body holds
+// the fields of Config to change and the reply lists what is wrong with the
+// resulting configuration
+func adminValidateConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	// decode over a deep copy, decoding into config itself would reuse the
+	// backing arrays of its slices
+	var c Config
+	current, err := json.Marshal(config)
+	if err == nil {
+		err = json.Unmarshal(current, &c)
+	}
+	if err != nil {
+		http.Error(w, "copying configuration failed", http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "malformed body", http.StatusBadRequest)
+		return
+	}
+	var result struct {
+		Errors []string `json:"errors"`
+	}
+	result.Errors = []string{}
+	for _, err := range c.Validate() {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	code := http.StatusOK
+	if len(result.Errors) > 0 {
+		code = http.StatusUnprocessableEntity
+	}
+	writeJSONStatus(w, code, result)
+}
+
+// status is the summary served on /status
+type status struct {
+	Backends            int     `json:"backends"`
+	AliveBackends       int     `json:"alive_backends"`
+	AccessLogSampleRate float64 `json:"access_log_sample_rate"`
+	// Queue is the number of queued requests by priority
+	Queue map[string]int `json:"queue,omitempty"`
+
+	Responses map[string]backend.ResponseCounts `json:"responses"`
+}
+
+// adminStatus serves GET /status
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	backends := serverPool.Backends()
+	st := status{
+		Backends:      len(backends),
+		AliveBackends: serverPool.AliveCount(),
+		Responses:     make(map[string]backend.ResponseCounts, len(backends)),
+	}
+	for _, b := range backends {
+		st.Responses[b.URL.String()] = b.ResponseCounts()
+	}
+	if config.AccessLog {
+		st.AccessLogSampleRate = config.AccessLogSampleRate
+	}
+	if queue != nil {
+		st.Queue = queue.depths()
+	}
+	writeJSON(w, st)
+}
+
+// healthCheckResult is the outcome of a health check run from the admin API
+type healthCheckResult struct {
+	backendStatus
+	Took Duration `json:"took"`
+}
+
+// checkBackend runs a health check of b right away
+func checkBackend(b *backend.Backend) healthCheckResult {
+	_, took := serverPool.CheckBackend(b)
+	return healthCheckResult{newBackendStatus(b), Duration(took)}
+}
+
+// adminHealthCheck serves POST /admin/healthcheck, it checks all backends
+// at once and returns their new status
+func adminHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	log.Println("Starting health check from admin API...")
+	backends := serverPool.Backends()
+	results := make([]healthCheckResult, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b *backend.Backend) {
+			defer wg.Done()
+			results[i] = checkBackend(b)
+		}(i, b)
+	}
+	wg.Wait()
+	writeJSON(w, results)
+}
+
+// adminSetWeight serves PUT /admin/backends/{url}/weight with a body such
+// as {"weight": 5}
+func adminSetWeight(w http.ResponseWriter, r *http.Request, b *backend.Backend) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+	var body struct {
+		Weight int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "malformed body", http.StatusBadRequest)
+		return
+	}
+	if body.Weight < 1 {
+		http.Error(w, "weight must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	b.SetWeight(body.Weight)
+	log.Printf("Weight of %s set to %d\n", b.URL, body.Weight)
+	writeJSON(w, newBackendStatus(b))
+}
+
+// adminRemoveBackend serves DELETE /admin/backends/{url}, it drains the
+// backend and removes it from the pool once drained
+func adminRemoveBackend(w http.ResponseWriter, r *http.Request, b *backend.Backend) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if b.Draining() {
+		http.Error(w, "backend already draining", http.StatusConflict)
+		return
+	}
+	log.Printf("Draining %s from admin API...\n", b.URL)
+	go func() {
+		b.Drain()
+		if serverPool.RemoveBackend(b) {
+			log.Printf("Removed server: %s\n", b.URL)
+		}
+	}()
+	st := newBackendStatus(b)
+	st.Drain = backend.DrainDraining
+	writeJSONStatus(w, http.StatusAccepted, st)
+}
+
+// allowMethod replies 405 and returns false unless r uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// writeJSON replies with v encoded as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus replies with the status code and v encoded as JSON
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Writing admin response failed, err: ", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// getPage fetches a page of /admin/backends
+func getPage(t *testing.T, query string) (int, backendPage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	adminBackends(w, httptest.NewRequest(http.MethodGet, "/admin/backends?"+query, nil))
+	var p backendPage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+	}
+	return w.Code, p
+}
+
+// setupBackends points the load balancer at n backends that are never
+// contacted
+func setupBackends(t *testing.T, n int) {
+	t.Helper()
+	var urls []string
+	for i := 0; i < n; i++ {
+		urls = append(urls, fmt.Sprintf("http://10.0.%d.%d:8080", i/250, i%250+1))
+	}
+	setupPool(t, urls...)
+}
+
+func TestAdminBackendsPages(t *testing.T) {
+	setupBackends(t, 45)
+	for _, tt := range []struct {
+		query    string
+		page     int
+		size     int
+		first    string
+		count    int
+		nextPage string
+	}{
+		{"page=1", 1, 20, "http://10.0.0.1:8080", 20, "/admin/backends?page=2&page_size=20"},
+		{"page=2&page_size=20", 2, 20, "http://10.0.0.21:8080", 20, "/admin/backends?page=3&page_size=20"},
+		// the last page is partial and has no next page
+		{"page=3&page_size=20", 3, 20, "http://10.0.0.41:8080", 5, ""},
+		{"page_size=45", 1, 45, "http://10.0.0.1:8080", 45, ""},
+		{"page=9&page_size=5", 9, 5, "http://10.0.0.41:8080", 5, ""},
+	} {
+		code, p := getPage(t, tt.query)
+		if code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.query, code)
+			continue
+		}
+		if p.Total != 45 || p.Page != tt.page || p.PageSize != tt.size || len(p.Backends) != tt.count || p.Next != tt.nextPage {
+			t.Errorf("%s: total %d, page %d, page_size %d, %d backends, next %q", tt.query, p.Total, p.Page, p.PageSize, len(p.Backends), p.Next)
+			continue
+		}
+		if p.Backends[0].URL != tt.first {
+			t.Errorf("%s: first backend %s, want %s", tt.query, p.Backends[0].URL, tt.first)
+		}
+	}
+}
+
+func TestAdminBackendsPageBeyondTotal(t *testing.T) {
+	setupBackends(t, 5)
+	for _, query := range []string{"page=2", "page=2&page_size=5", "page=4&page_size=2", "page=100&page_size=1"} {
+		code, p := getPage(t, query)
+		if code != http.StatusOK {
+			t.Errorf("%s: status %d", query, code)
+			continue
+		}
+		if p.Total != 5 || len(p.Backends) != 0 || p.Backends == nil || p.Next != "" {
+			t.Errorf("%s: total %d, backends %v, next %q", query, p.Total, p.Backends, p.Next)
+		}
+	}
+}
+
+func TestAdminBackendsLastPartialPage(t *testing.T) {
+	setupBackends(t, 5)
+	code, p := getPage(t, "page=3&page_size=2")
+	if code != http.StatusOK || len(p.Backends) != 1 || p.Backends[0].URL != "http://10.0.0.5:8080" || p.Next != "" {
+		t.Errorf("status %d, backends %v, next %q", code, p.Backends, p.Next)
+	}
+}
+
+func TestAdminBackendsPageLargerThanTotal(t *testing.T) {
+	setupBackends(t, 5)
+	code, p := getPage(t, "page=1&page_size=100")
+	if code != http.StatusOK || p.Total != 5 || len(p.Backends) != 5 || p.Next != "" {
+		t.Errorf("status %d, total %d, %d backends, next %q", code, p.Total, len(p.Backends), p.Next)
+	}
+}
+
+func TestAdminBackendsEmptyPool(t *testing.T) {
+	setupBackends(t, 0)
+	code, p := getPage(t, "page=1&page_size=20")
+	if code != http.StatusOK || p.Total != 0 || len(p.Backends) != 0 || p.Backends == nil || p.Next != "" {
+		t.Errorf("status %d, total %d, backends %v, next %q", code, p.Total, p.Backends, p.Next)
+	}
+}
+
+func TestAdminBackendsInvalidPage(t *testing.T) {
+	setupBackends(t, 5)
+	for _, query := range []string{"page=0", "page=-1", "page_size=0", "page=x"} {
+		if code, _ := getPage(t, query); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, code)
+		}
+	}
+}
+
+func TestAdminAPIKey(t *testing.T) {
+	setupBackends(t, 1)
+	config.AdminAPIKey = "secret"
+	handler := adminAuthMiddleware(adminHandler())
+	for _, tt := range []struct {
+		authorization string
+		code          int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"", http.StatusUnauthorized},
+		// the key alone, which TrimPrefix would have let through
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret ", http.StatusUnauthorized},
+		{"Bearer  secret", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/backends", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("Authorization %q: status %d, want %d", tt.authorization, w.Code, tt.code)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("Authorization %q: WWW-Authenticate %q", tt.authorization, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAdminUIWithoutKey(t *testing.T) {
+	setupBackends(t, 1)
+	config.AdminAPIKey = "secret"
+	w := httptest.NewRecorder()
+	adminAuthMiddleware(adminHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/ui/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("dashboard page: status %d", w.Code)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// uiFiles holds the admin dashboard, plain HTML and JavaScript calling the
+// admin API
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// adminUI serves GET /admin/ui/, the dashboard of the backends
+func adminUI() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/admin/ui/", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// isAdminUI reports whether r asks for a file of the dashboard
+func isAdminUI(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.URL.Path == "/admin/ui" || strings.HasPrefix(r.URL.Path, "/admin/ui/"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// generateAlertsCommand is the subcommand writing Prometheus alerting rules
+const generateAlertsCommand = "generate-alerts"
+
+// alertRulesTemplate is the Prometheus rules file of the load balancer,
+// expressions are block scalars so that they need no YAML escaping
+var alertRulesTemplate = template.Must(template.New("alerts").Parse(`groups:
+  - name: loadbalancer
+    rules:
+      - alert: BackendDown
+        expr: |
+          lb_backend_up{backend=~"{{.Backends}}"} == 0
+        for: 2m
+        labels:
+          severity: warning
+        annotations:
+          summary: "Backend {{"{{"}} $labels.backend {{"}}"}} is down"
+      - alert: HighErrorRate
+        expr: |
+          sum by (backend) (rate(lb_backend_responses_total{backend=~"{{.Backends}}",class="5xx"}[5m]))
+            / sum by (backend) (rate(lb_backend_responses_total{backend=~"{{.Backends}}"}[5m])) > {{.ErrorRate}}
+        for: 5m
+        labels:
+          severity: warning
+        annotations:
+          summary: "More than {{.ErrorRatePercent}}% of the responses of {{"{{"}} $labels.backend {{"}}"}} are 5xx"
+      - alert: HighRetryRate
+        expr: |
+          sum(rate(lb_retries_total{backend=~"{{.Backends}}"}[1m]))
+            / sum(rate(lb_requests_total{backend=~"{{.Backends}}"}[1m])) > 0.1
+        for: 1m
+        labels:
+          severity: warning
+        annotations:
+          summary: "More than 10% of the requests are retried"
+      - alert: AllBackendsDown
+        expr: |
+          sum(lb_backend_up{backend=~"{{.Backends}}"}) == 0
+        for: 30s
+        labels:
+          severity: critical
+        annotations:
+          summary: "All backends are down"
+`))
+
+// writeAlertRules writes the alerting rules for the backends of serverPool
+// to path, "-" for the standard output
+func writeAlertRules(path string) error {
+	var urls []string
+	for _, b := range serverPool.Backends() {
+		urls = append(urls, regexp.QuoteMeta(b.URL.String()))
+	}
+	data := struct {
+		Backends         string
+		ErrorRate        string
+		ErrorRatePercent string
+	}{
+		// a PromQL string needs its backslashes escaped
+		Backends:         strings.ReplaceAll(strings.Join(urls, "|"), `\`, `\\`),
+		ErrorRate:        strconv.FormatFloat(errorRateThreshold, 'f', -1, 64),
+		ErrorRatePercent: strconv.FormatFloat(errorRateThreshold*100, 'f', -1, 64),
+	}
+
+	if path == "-" {
+		return alertRulesTemplate.Execute(os.Stdout, data)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := alertRulesTemplate.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"loadbalancer/backend"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// errorRateThreshold is the share of 5xx responses of a backend above
+	// which operators are alerted
+	errorRateThreshold = 0.05
+	// errorRateMinResponses is the number of responses a backend must have
+	// sent before its error rate is considered
+	errorRateMinResponses = 100
+)
+
+// errorRateAlert is the payload posted to -alert-webhook
+type errorRateAlert struct {
+	Time      time.Time `json:"time"`
+	Backend   string    `json:"backend"`
+	ErrorRate float64   `json:"error_rate"`
+	Firing    bool      `json:"firing"`
+}
+
+// backendErrorAlert is posted to -alert-webhook when a backend fails in a
+// way that needs an operator, such as a TLS misconfiguration
+type backendErrorAlert struct {
+	Time    time.Time  `json:"time"`
+	Backend string     `json:"backend"`
+	Class   ErrorClass `json:"class"`
+	Error   string     `json:"error"`
+}
+
+// errorRateAlerts remembers which backends are above the error rate threshold
+var errorRateAlerts = struct {
+	sync.Mutex
+	firing map[*backend.Backend]bool
+}{firing: make(map[*backend.Backend]bool)}
+
+// checkErrorRate alerts when the share of 5xx responses of b crosses
+// errorRateThreshold, and again once it is back below
+func checkErrorRate(b *backend.Backend) {
+	counts := b.ResponseCounts()
+	total := counts.Total()
+	if total < errorRateMinResponses {
+		return
+	}
+	rate := float64(counts.Responses5xx) / float64(total)
+	firing := rate > errorRateThreshold
+
+	errorRateAlerts.Lock()
+	changed := errorRateAlerts.firing[b] != firing
+	errorRateAlerts.firing[b] = firing
+	errorRateAlerts.Unlock()
+	if !changed {
+		return
+	}
+	if firing {
+		log.Printf("%s: %.1f%% of responses are 5xx\n", b.URL, rate*100)
+	} else {
+		log.Printf("%s: 5xx responses back to %.1f%%\n", b.URL, rate*100)
+	}
+	if config.AlertWebhook != "" {
+		go sendAlert(errorRateAlert{
+			Time:      time.Now(),
+			Backend:   b.URL.String(),
+			ErrorRate: rate,
+			Firing:    firing,
+		})
+	}
+}
+
+// alertBackendError logs err of b and sends it to the webhook
+func alertBackendError(b *backend.Backend, class ErrorClass, err error) {
+	log.Printf("%s: %s error, err: %s\n", b.URL, class, err)
+	if config.AlertWebhook != "" {
+		go sendAlert(backendErrorAlert{
+			Time:    time.Now(),
+			Backend: b.URL.String(),
+			Class:   class,
+			Error:   err.Error(),
+		})
+	}
+}
+
+// alertCertPinMismatch logs the pin mismatch of b and sends it to the webhook
+func alertCertPinMismatch(b *backend.Backend, err *backend.PinMismatchError) {
+	log.Printf("event=cert_pin_mismatch backend=%s pinned=%s got=%s\n", b.URL, err.Pinned, err.Got)
+	if config.AlertWebhook != "" {
+		go sendAlert(backendErrorAlert{
+			Time:    time.Now(),
+			Backend: b.URL.String(),
+			Class:   ErrorCertPinMismatch,
+			Error:   err.Error(),
+		})
+	}
+}
+
+// alertResponseHashMismatch logs the corrupt response of b and sends it to
+// the webhook
+func alertResponseHashMismatch(b *backend.Backend, err *responseHashError) {
+	log.Printf("event=response_hash_mismatch backend=%s header=%s expected=%q got=%s\n", b.URL, err.header, err.expected, err.got)
+	if config.AlertWebhook != "" {
+		go sendAlert(backendErrorAlert{
+			Time:    time.Now(),
+			Backend: b.URL.String(),
+			Class:   ErrorResponseHash,
+			Error:   err.Error(),
+		})
+	}
+}
+
+// certRevokedAlert is posted to -alert-webhook when the OCSP responder of
+// the serving certificate revoked it
+type certRevokedAlert struct {
+	Time      time.Time `json:"time"`
+	Subject   string    `json:"subject"`
+	Serial    string    `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason"`
+}
+
+// alertCertRevoked logs the revocation of the serving certificate leaf and
+// sends it to the webhook
+func alertCertRevoked(leaf *x509.Certificate, err *certRevokedError) {
+	log.Printf("event=cert_revoked subject=%q serial=%s revoked_at=%s reason=%d\n",
+		err.subject, leaf.SerialNumber, err.revokedAt.Format(time.RFC3339), err.reason)
+	if config.AlertWebhook != "" {
+		go sendAlert(certRevokedAlert{
+			Time:      time.Now(),
+			Subject:   err.subject,
+			Serial:    leaf.SerialNumber.String(),
+			RevokedAt: err.revokedAt,
+			Reason:    err.reason,
+		})
+	}
+}
+
+// sendAlert posts an alert to the webhook
+func sendAlert(alert interface{}) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Println("Encoding alert failed, err: ", err)
+		return
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(config.AlertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Sending alert failed, err: ", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("Sending alert failed, status: %d\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// attemptsHeader carries the attempt count of a request between chained load
+// balancers, with -respect-upstream-attempts
+const attemptsHeader = "X-LB-Attempts"
+
+// upstreamAttempts returns the attempts an upstream load balancer made before
+// the one that sent r, 0 without a valid X-LB-Attempts header
+func upstreamAttempts(r *http.Request) int {
+	n, err := strconv.Atoi(r.Header.Get(attemptsHeader))
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n - 1
+}
+
+// GetUpstreamAttemptsFromContext returns the attempts made for request by
+// upstream load balancers
+func GetUpstreamAttemptsFromContext(r *http.Request) int {
+	if attempts, ok := r.Context().Value(UpstreamAttempts).(int); ok {
+		return attempts
+	}
+	return 0
+}
+
+// setAttemptsHeader tells the backend, possibly another load balancer, the
+// count of attempts including the one it receives
+func setAttemptsHeader(r *http.Request) {
+	r.Header.Set(attemptsHeader, strconv.Itoa(GetUpstreamAttemptsFromContext(r)+GetAttemptsFromContext(r)))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"loadbalancer/backend"
+	"log"
+	"os"
+	"sync"
+)
+
+// auditLog appends backend status transitions as JSON lines to a file
+type auditLog struct {
+	mux sync.Mutex
+	enc *json.Encoder
+}
+
+// openAuditLog opens path for appending, creating it if needed
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes a transition to the audit log
+func (a *auditLog) Record(t backend.Transition) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if err := a.enc.Encode(t); err != nil {
+		log.Println("Writing audit log failed, err: ", err)
+	}
+}
@@ -0,0 +1,187 @@
+package backend
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Algorithm picks the backend that should serve a request among the
+// backends of the pool accepted by usable
+type Algorithm interface {
+	Next(s *ServerPool, r *http.Request, usable Filter) *Backend
+}
+
+// Filter reports whether a backend may be picked
+type Filter func(b *Backend) bool
+
+// AlgorithmOptions tunes the algorithms returned by NewAlgorithm
+type AlgorithmOptions struct {
+	// HashHeader names the request header used as key by hashing algorithms,
+	// the client IP is used when it is empty or missing from the request
+	HashHeader string
+	// MaglevTableSize is the size of the maglev lookup table, it must be prime
+	MaglevTableSize int
+}
+
+// NewAlgorithm returns the algorithm registered under name
+func NewAlgorithm(name string, opts AlgorithmOptions) (Algorithm, error) {
+	switch name {
+	case "", "round-robin":
+		return RoundRobin{}, nil
+	case "weighted-round-robin":
+		return &WeightedRoundRobin{}, nil
+	case "rendezvous":
+		return &Rendezvous{Header: opts.HashHeader}, nil
+	case "maglev":
+		return NewMaglev(opts.MaglevTableSize, opts.HashHeader)
+	case "sticky-url-hash":
+		return StickyURLHash{}, nil
+	}
+	return nil, fmt.Errorf("unknown algorithm %q", name)
+}
+
+// RoundRobin hands requests to the alive backends in turn
+type RoundRobin struct{}
+
+// Next returns the next usable backend after the current one
+func (RoundRobin) Next(s *ServerPool, r *http.Request, usable Filter) *Backend {
+	backends := s.list()
+	if len(backends) == 0 {
+		return nil
+	}
+	// loop entire backends to find out an Alive backend
+	next := s.NextIndex()
+	l := len(backends) + next
+
+	for i := next; i < l; i++ {
+		// take an index by modding
+		idx := i % len(backends)
+		// Use and store an alive backend
+		if usable(backends[idx]) {
+			if i != next {
+				atomic.StoreUint64(&s.current, uint64(idx))
+			}
+			return backends[idx]
+		}
+	}
+	return nil
+}
+
+// WeightedRoundRobin hands requests in turn to the usable backends, each
+// one receiving a share of traffic proportional to its weight. It uses the
+// smooth weighted round robin of nginx, so heavy backends are interleaved
+// with light ones instead of receiving their requests in a burst.
+type WeightedRoundRobin struct {
+	mux     sync.Mutex
+	current map[*Backend]int
+}
+
+// Next returns the usable backend with the highest current weight. Weights
+// are read again on every call so that changes apply immediately, and
+// recovered backends get a growing share while they warm up.
+func (w *WeightedRoundRobin) Next(s *ServerPool, r *http.Request, usable Filter) *Backend {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.current == nil {
+		w.current = make(map[*Backend]int)
+	}
+
+	var best *Backend
+	total := 0
+	for _, b := range s.list() {
+		if !usable(b) {
+			continue
+		}
+		weight := b.EffectiveWeight()
+		w.current[b] += weight
+		total += weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		w.current[best] -= total
+	}
+	return best
+}
+
+// Rendezvous implements highest random weight hashing: every alive backend
+// gets a score from hash(key + URL) and the highest score wins. When a
+// backend goes down only the keys it owned move elsewhere.
+type Rendezvous struct {
+	Header string
+}
+
+// Next returns the usable backend with the highest score for the request key
+func (h *Rendezvous) Next(s *ServerPool, r *http.Request, usable Filter) *Backend {
+	return highestScore(s, hashKey(r, h.Header), usable)
+}
+
+// highestScore returns the usable backend whose URL hashed with key scores highest
+func highestScore(s *ServerPool, key string, usable Filter) *Backend {
+	var best *Backend
+	var bestScore uint64
+	for _, b := range s.list() {
+		if !usable(b) {
+			continue
+		}
+		score := hash64(key + b.URL.String())
+		if best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// StickyURLHash sends all requests for a URL to the same backend whichever
+// client asks, so that caches of the backends stay warm. Backends are
+// scored by rendezvous hashing of the normalized URL.
+type StickyURLHash struct{}
+
+// Next returns the usable backend with the highest score for the request URL
+func (StickyURLHash) Next(s *ServerPool, r *http.Request, usable Filter) *Backend {
+	return highestScore(s, normalizeURL(r), usable)
+}
+
+// normalizeURL returns the lowercased path of r followed by its query
+// parameters sorted by key
+func normalizeURL(r *http.Request) string {
+	key := strings.ToLower(r.URL.Path)
+	if query := r.URL.Query(); len(query) > 0 {
+		key += "?" + strings.ToLower(query.Encode())
+	}
+	return key
+}
+
+// hashKey returns the value of header, or the client IP when it is not set
+func hashKey(r *http.Request, header string) string {
+	if header != "" {
+		if v := r.Header.Get(header); v != "" {
+			return v
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hash64 returns the FNV-1a hash of s passed through a finalizer, so that
+// keys differing only in their last bytes still spread evenly
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
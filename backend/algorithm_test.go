@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// clientRequest is a request of the client ip
+func clientRequest(ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = ip + ":1234"
+	return r
+}
+
+func TestNewAlgorithm(t *testing.T) {
+	for _, name := range []string{"", "round-robin", "weighted-round-robin", "rendezvous", "maglev", "sticky-url-hash"} {
+		if _, err := NewAlgorithm(name, AlgorithmOptions{}); err != nil {
+			t.Errorf("%q: %s", name, err)
+		}
+	}
+	if _, err := NewAlgorithm("nope", AlgorithmOptions{}); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+	if _, err := NewAlgorithm("maglev", AlgorithmOptions{MaglevTableSize: 100}); err == nil {
+		t.Error("maglev table size that is not prime accepted")
+	}
+}
+
+func TestWeightedRoundRobinFollowsWeights(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	s.Algorithm = &WeightedRoundRobin{}
+	for i, b := range s.Backends() {
+		b.SetWeight(i + 1)
+	}
+	counts := map[*Backend]int{}
+	for i := 0; i < 60; i++ {
+		counts[mustNextPeer(t, s, testRequest())]++
+	}
+	for i, b := range s.Backends() {
+		if want := 10 * (i + 1); counts[b] != want {
+			t.Errorf("backend of weight %d got %d requests, want %d", i+1, counts[b], want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinInterleaves(t *testing.T) {
+	s := newTestPool(t, "http://heavy:1", "http://light:1")
+	s.Algorithm = &WeightedRoundRobin{}
+	heavy := s.Backends()[0]
+	heavy.SetWeight(2)
+	// smooth weighted round robin never sends 3 requests in a row to a
+	// backend of weight 2 out of 3
+	run := 0
+	for i := 0; i < 30; i++ {
+		if mustNextPeer(t, s, testRequest()) == heavy {
+			run++
+		} else {
+			run = 0
+		}
+		if run > 2 {
+			t.Fatal("heavy backend got its requests in a burst")
+		}
+	}
+}
+
+// testHashing checks that alg sends every client to the same backend, and
+// that only the clients of a backend going down move
+func testHashing(t *testing.T, alg Algorithm, request func(key string) *http.Request) {
+	t.Helper()
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1", "http://d:1")
+	s.Algorithm = alg
+	owners := map[string]*Backend{}
+	used := map[*Backend]bool{}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/250, i%250)
+		owners[key] = mustNextPeer(t, s, request(key))
+		used[owners[key]] = true
+		if again := mustNextPeer(t, s, request(key)); again != owners[key] {
+			t.Fatalf("%s moved from %s to %s", key, owners[key].URL, again.URL)
+		}
+	}
+	if len(used) != 4 {
+		t.Errorf("keys spread over %d backends out of 4", len(used))
+	}
+
+	down := s.Backends()[0]
+	down.SetAlive(false)
+	for key, owner := range owners {
+		peer := mustNextPeer(t, s, request(key))
+		switch {
+		case peer == down:
+			t.Fatalf("%s still sent to the dead backend", key)
+		case owner != down && peer != owner:
+			t.Fatalf("%s moved from %s to %s although its backend is alive", key, owner.URL, peer.URL)
+		}
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	testHashing(t, &Rendezvous{}, clientRequest)
+}
+
+func TestRendezvousHeader(t *testing.T) {
+	testHashing(t, &Rendezvous{Header: "X-User"}, func(key string) *http.Request {
+		r := clientRequest("10.0.0.1")
+		r.Header.Set("X-User", key)
+		return r
+	})
+}
+
+func TestMaglev(t *testing.T) {
+	m, err := NewMaglev(251, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHashing(t, m, clientRequest)
+}
+
+func TestMaglevRebuildsWithPool(t *testing.T) {
+	m, err := NewMaglev(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestPool(t, "http://a:1")
+	s.Algorithm = m
+	first := mustNextPeer(t, s, clientRequest("10.0.0.1"))
+	added := newTestBackend(t, "http://b:1")
+	s.AddBackend(added)
+	s.RemoveBackend(first)
+	if peer := mustNextPeer(t, s, clientRequest("10.0.0.1")); peer != added {
+		t.Errorf("request went to %s after the table was rebuilt", peer.URL)
+	}
+	s.RemoveBackend(added)
+	if _, err := s.GetNextPeer(clientRequest("10.0.0.1")); err != ErrNoPeer {
+		t.Errorf("empty pool: got %v", err)
+	}
+}
+
+func TestStickyURLHash(t *testing.T) {
+	testHashing(t, StickyURLHash{}, func(key string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/"+key, nil)
+	})
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	s.Algorithm = StickyURLHash{}
+	a := mustNextPeer(t, s, httptest.NewRequest(http.MethodGet, "/Page?b=2&a=1", nil))
+	b := mustNextPeer(t, s, httptest.NewRequest(http.MethodGet, "/page?a=1&b=2", nil))
+	if a != b {
+		t.Error("spellings of the same URL went to different backends")
+	}
+}
+
+func TestIsPrime(t *testing.T) {
+	for n, want := range map[int]bool{1: false, 2: true, 9: false, 251: true, 65537: true, 65535: false} {
+		if isPrime(n) != want {
+			t.Errorf("isPrime(%d) is %t", n, !want)
+		}
+	}
+}
+
+func TestRoundRobinSpreadsEvenly(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	counts := map[*Backend]int{}
+	for i := 0; i < 9; i++ {
+		counts[mustNextPeer(t, s, testRequest())]++
+	}
+	for _, b := range s.Backends() {
+		if counts[b] != 3 {
+			t.Errorf("%s selected %d times, want 3", b.URL, counts[b])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// AutoWeightInterval is the interval between adjustments of the dynamic
+	// weights of the backends
+	AutoWeightInterval = 10 * time.Second
+	// DefaultAutoWeightDamp is the share of its previous dynamic weight a
+	// backend keeps at each adjustment
+	DefaultAutoWeightDamp = 0.5
+
+	// latencySamples is the most response times kept per backend between
+	// adjustments, the latest ones
+	latencySamples = 1024
+
+	// minDynamicWeight and maxDynamicWeight keep the slowest backends in the
+	// rotation and the fastest from taking all of it
+	minDynamicWeight = 0.05
+	maxDynamicWeight = 20
+)
+
+// ObserveLatency records the time the backend took to answer a request for
+// the next adjustment of its dynamic weight and for Latency
+func (b *Backend) ObserveLatency(took time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.latencies == nil {
+		b.latencies = make([]time.Duration, 0, latencySamples)
+	}
+	if len(b.latencies) < latencySamples {
+		b.latencies = append(b.latencies, took)
+	} else {
+		b.latencies[b.latencySeq%latencySamples] = took
+	}
+	b.latencySeq++
+}
+
+// p95 returns the 95th percentile of the response times observed since the
+// last call and forgets them, false without any
+func (b *Backend) p95() (time.Duration, bool) {
+	b.mux.Lock()
+	latencies := b.latencies
+	b.latencies, b.latencySeq = nil, 0
+	b.mux.Unlock()
+	if len(latencies) == 0 {
+		return 0, false
+	}
+	return percentile(latencies, 0.95), true
+}
+
+// Latency returns the q quantile of the latest response times of b, those
+// observed since the last AdjustWeights when the pool adjusts them, 0
+// without any
+func (b *Backend) Latency(q float64) time.Duration {
+	b.mux.RLock()
+	latencies := append([]time.Duration(nil), b.latencies...)
+	b.mux.RUnlock()
+	if len(latencies) == 0 {
+		return 0
+	}
+	return percentile(latencies, q)
+}
+
+// percentile sorts latencies and returns their q quantile
+func percentile(latencies []time.Duration, q float64) time.Duration {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[int(float64(len(latencies)-1)*q)]
+}
+
+// CurrentDynamicWeight returns the factor applied to the weight of b, 1 until
+// its first adjustment
+func (b *Backend) CurrentDynamicWeight() float64 {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.DynamicWeight <= 0 {
+		return 1
+	}
+	return b.DynamicWeight
+}
+
+// AdjustWeights moves the dynamic weight of every backend that answered
+// requests since the last adjustment towards a share of traffic inversely
+// proportional to its P95 latency, the factors averaging 1 among them. damp
+// is the share of its previous weight a backend keeps, to prevent the
+// weights from oscillating as traffic moves.
+func (s *ServerPool) AdjustWeights(damp float64) {
+	type sample struct {
+		b     *Backend
+		speed float64
+	}
+	var samples []sample
+	total := 0.0
+	for _, b := range s.list() {
+		p95, ok := b.p95()
+		if !ok {
+			continue
+		}
+		if p95 < time.Microsecond {
+			p95 = time.Microsecond
+		}
+		speed := 1 / p95.Seconds()
+		samples = append(samples, sample{b, speed})
+		total += speed
+	}
+	for _, sample := range samples {
+		target := sample.speed * float64(len(samples)) / total
+		weight := damp*sample.b.CurrentDynamicWeight() + (1-damp)*target
+		if weight < minDynamicWeight {
+			weight = minDynamicWeight
+		} else if weight > maxDynamicWeight {
+			weight = maxDynamicWeight
+		}
+		sample.b.mux.Lock()
+		sample.b.DynamicWeight = weight
+		sample.b.mux.Unlock()
+	}
+}
+
+// RunAutoWeight adjusts the dynamic weights every AutoWeightInterval until
+// the context of the pool is done
+func (s *ServerPool) RunAutoWeight(damp float64) {
+	ticker := time.NewTicker(AutoWeightInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.AdjustWeights(damp)
+		case <-s.done():
+			return
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package backend
 
 import (
+	"net"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // Backend 保存一个server的相关数据
@@ -12,15 +17,124 @@ type Backend struct {
 	Alive        bool
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
+	Zone         string
+	Tags         map[string]string
+	weight       int
+	// DynamicWeight scales the weight by the latency of the backend
+	// relative to the others, set by AdjustWeights and guarded by mux
+	DynamicWeight float64
+	latencies     []time.Duration
+	latencySeq    int
+	active        int64
+
+	// maxRPS is the highest request rate sent to this backend, 0 is
+	// unlimited, enforced by rateLimiter. Both are guarded by mux.
+	maxRPS      int
+	rateLimiter *rate.Limiter
+	// SigningKey signs the requests to this backend with an HMAC of
+	// SigningAlgorithm when set
+	SigningKey       string
+	SigningAlgorithm string
+
+	// RequestTimeout bounds the attempts at this backend for a request,
+	// within the deadline of the request, 0 leaves only the latter
+	RequestTimeout time.Duration
+	// MaxConcurrentRequests is the most requests in flight to this backend,
+	// 0 is unlimited
+	MaxConcurrentRequests int
+
+	// HealthCheckTimeout overrides the timeout of the pool for the health
+	// checks of this backend, pools with AdaptiveHealthCheckTimeout set it
+	HealthCheckTimeout time.Duration
+
+	// HealthCheckType names the checker of the backend, one of
+	// HealthCheckTypes or registered with the pool. Without one the health
+	// check command runs if set, then the health check path of the pool is
+	// fetched if set, otherwise a TCP connection is established.
+	HealthCheckType string
+
+	// HealthCheckCmd replaces the health check of the pool when set, the
+	// backend is alive when the command exits with status 0
+	HealthCheckCmd []string
+
+	// HealthCheckSend is written to the connection of a TCP health check
+	// and HealthCheckExpect must start the reply, e.g. a greeting, when set
+	HealthCheckSend   []byte
+	HealthCheckExpect []byte
+
+	// HealthCheckRetries is the number of checks failing in a row before a
+	// health check finds the backend down, DefaultHealthCheckRetries if zero
+	HealthCheckRetries int
+	// HealthCheckRetryInterval is the delay between them,
+	// DefaultHealthCheckRetryInterval if zero
+	HealthCheckRetryInterval time.Duration
+
+	// ExpectedContentType must start the Content-Type of the responses of
+	// the backend, responses of another type are replaced by a 502. Any
+	// type is passed on when empty.
+	ExpectedContentType string
+
+	// ResponseHashHeader names the header carrying the SHA-256 of the
+	// response bodies of the backend, responses whose body does not match
+	// are replaced by a 502. Bodies are not checked when empty.
+	ResponseHashHeader string
+
+	// PinnedCertSHA256 is the hex SHA-256 of the public key the backend
+	// must present over TLS in addition to a valid certificate, no pin
+	// when empty
+	PinnedCertSHA256 string
+
+	// responses answered by the backend by status class
+	Responses2xx uint64
+	Responses3xx uint64
+	Responses4xx uint64
+	Responses5xx uint64
+
+	// acceptsGzip is set when the last HTTP health check response carried
+	// Accept-Encoding: gzip
+	acceptsGzip bool
+
+	// DrainTimeout bounds Drain, DefaultDrainTimeout if zero
+	DrainTimeout time.Duration
+	drainState   string
+	drained      chan struct{}
+
+	// removed is closed when Reset removes the backend from its pool
+	removed chan struct{}
+
+	// WarmupDuration is the time a recovered backend takes to go from
+	// WarmupStartPercent to its full weight, 0 gives it the full weight
+	WarmupDuration time.Duration
+	// RecoveredAt is when the backend last came back alive
+	RecoveredAt time.Time
+
+	// circuit counts recent errors, see ServerPool.RecordResult
+	circuit circuit
+
+	// forcedStatus keeps checks from changing Alive, see ForceStatus
+	forcedStatus bool
+
+	// consecutive results of health checks and passive checks
+	failures  int
+	successes int
 }
 
 // SetAlive for this backend
 func (b *Backend) SetAlive(alive bool) {
 	b.mux.Lock()
-	b.Alive = alive
+	b.setAlive(alive)
 	b.mux.Unlock()
 }
 
+// setAlive sets Alive and starts the warmup of a backend coming back, b.mux
+// must be held
+func (b *Backend) setAlive(alive bool) {
+	if alive && !b.Alive {
+		b.RecoveredAt = time.Now()
+	}
+	b.Alive = alive
+}
+
 // IsAlive returns true when backend is alive
 func (b *Backend) IsAlive() (alive bool) {
 	b.mux.RLock()
@@ -28,3 +142,185 @@ func (b *Backend) IsAlive() (alive bool) {
 	b.mux.RUnlock()
 	return
 }
+
+// SetWeight sets the share of traffic of this backend in weighted algorithms
+func (b *Backend) SetWeight(weight int) {
+	b.mux.Lock()
+	b.weight = weight
+	b.mux.Unlock()
+}
+
+// Weight returns the weight of this backend, a backend without weight counts as 1
+func (b *Backend) Weight() (weight int) {
+	b.mux.RLock()
+	weight = b.weight
+	b.mux.RUnlock()
+	if weight <= 0 {
+		weight = 1
+	}
+	return
+}
+
+// WarmupStartPercent is the share of its weight a backend gets right after
+// it recovered
+const WarmupStartPercent = 5
+
+// EffectiveWeight returns the weight of this backend in hundredths, scaled by
+// its dynamic weight and ramping up linearly from WarmupStartPercent during
+// WarmupDuration after it recovered
+func (b *Backend) EffectiveWeight() int {
+	b.mux.RLock()
+	since := time.Since(b.RecoveredAt)
+	recovered := !b.RecoveredAt.IsZero()
+	b.mux.RUnlock()
+	percent := 100
+	if recovered && b.WarmupDuration > 0 && since < b.WarmupDuration {
+		percent = WarmupStartPercent + int((100-WarmupStartPercent)*since/b.WarmupDuration)
+	}
+	weight := int(float64(b.Weight()*percent) * b.CurrentDynamicWeight())
+	if weight < 1 {
+		weight = 1
+	}
+	return weight
+}
+
+// SetAcceptsGzip records whether the backend takes gzip request bodies
+func (b *Backend) SetAcceptsGzip(accepts bool) {
+	b.mux.Lock()
+	b.acceptsGzip = accepts
+	b.mux.Unlock()
+}
+
+// AcceptsGzip reports whether the backend advertised gzip request bodies
+func (b *Backend) AcceptsGzip() (accepts bool) {
+	b.mux.RLock()
+	accepts = b.acceptsGzip
+	b.mux.RUnlock()
+	return
+}
+
+// AddActive changes the number of requests in flight to this backend by
+// delta and returns the new number
+func (b *Backend) AddActive(delta int64) int64 {
+	return atomic.AddInt64(&b.active, delta)
+}
+
+// AtCapacity reports whether the backend has MaxConcurrentRequests in flight
+func (b *Backend) AtCapacity() bool {
+	return b.MaxConcurrentRequests > 0 && b.ActiveConnections() >= int64(b.MaxConcurrentRequests)
+}
+
+// ActiveConnections returns the number of requests in flight to this backend
+func (b *Backend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// SetMaxRPS limits the requests sent to this backend to rps per second
+func (b *Backend) SetMaxRPS(rps int) {
+	var limiter *rate.Limiter
+	if rps > 0 {
+		limiter = rate.NewLimiter(rate.Limit(rps), rps)
+	}
+	b.mux.Lock()
+	b.maxRPS, b.rateLimiter = rps, limiter
+	b.mux.Unlock()
+}
+
+// MaxRPS returns the highest request rate sent to this backend, 0 is unlimited
+func (b *Backend) MaxRPS() (rps int) {
+	b.mux.RLock()
+	rps = b.maxRPS
+	b.mux.RUnlock()
+	return
+}
+
+// RateLimiter returns the limiter enforcing MaxRPS, nil when unlimited
+func (b *Backend) RateLimiter() (limiter *rate.Limiter) {
+	b.mux.RLock()
+	limiter = b.rateLimiter
+	b.mux.RUnlock()
+	return
+}
+
+// Addr returns the host:port of the backend, the URL of a backend may leave
+// out the default port of its scheme
+func (b *Backend) Addr() string {
+	if port := b.URL.Port(); port != "" {
+		return b.URL.Host
+	}
+	switch b.URL.Scheme {
+	case "https":
+		return net.JoinHostPort(b.URL.Hostname(), "443")
+	case "http":
+		return net.JoinHostPort(b.URL.Hostname(), "80")
+	}
+	return b.URL.Host
+}
+
+// HasTag reports whether the backend carries the tag key=value
+func (b *Backend) HasTag(key, value string) bool {
+	v, ok := b.Tags[key]
+	return ok && v == value
+}
+
+// ResponseCounts holds the number of responses of a backend by status class
+type ResponseCounts struct {
+	Responses2xx uint64 `json:"2xx"`
+	Responses3xx uint64 `json:"3xx"`
+	Responses4xx uint64 `json:"4xx"`
+	Responses5xx uint64 `json:"5xx"`
+}
+
+// Total returns the number of responses of all classes
+func (c ResponseCounts) Total() uint64 {
+	return c.Responses2xx + c.Responses3xx + c.Responses4xx + c.Responses5xx
+}
+
+// CountResponse adds a response with the status code to its class
+func (b *Backend) CountResponse(code int) {
+	switch code / 100 {
+	case 2:
+		atomic.AddUint64(&b.Responses2xx, 1)
+	case 3:
+		atomic.AddUint64(&b.Responses3xx, 1)
+	case 4:
+		atomic.AddUint64(&b.Responses4xx, 1)
+	case 5:
+		atomic.AddUint64(&b.Responses5xx, 1)
+	}
+}
+
+// ResponseCounts returns the number of responses of the backend by class
+func (b *Backend) ResponseCounts() ResponseCounts {
+	return ResponseCounts{
+		Responses2xx: atomic.LoadUint64(&b.Responses2xx),
+		Responses3xx: atomic.LoadUint64(&b.Responses3xx),
+		Responses4xx: atomic.LoadUint64(&b.Responses4xx),
+		Responses5xx: atomic.LoadUint64(&b.Responses5xx),
+	}
+}
+
+// Removed returns a channel closed once ServerPool.Reset removed the backend,
+// its health checks should stop then
+func (b *Backend) Removed() <-chan struct{} {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.removed == nil {
+		b.removed = make(chan struct{})
+	}
+	return b.removed
+}
+
+// remove closes the channel of Removed
+func (b *Backend) remove() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.removed == nil {
+		b.removed = make(chan struct{})
+	}
+	select {
+	case <-b.removed:
+	default:
+		close(b.removed)
+	}
+}
@@ -0,0 +1,310 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"testing"
+	"time"
+)
+
+func TestWeight(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	if b.Weight() != 1 {
+		t.Errorf("backend without weight weighs %d", b.Weight())
+	}
+	b.SetWeight(5)
+	if b.Weight() != 5 || b.EffectiveWeight() != 500 {
+		t.Errorf("weight %d, effective weight %d", b.Weight(), b.EffectiveWeight())
+	}
+}
+
+func TestEffectiveWeightWarmsUp(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	b.WarmupDuration = time.Hour
+	b.RecoveredAt = time.Now()
+	if w := b.EffectiveWeight(); w != WarmupStartPercent {
+		t.Errorf("recovered backend weighs %d, want %d", w, WarmupStartPercent)
+	}
+	b.RecoveredAt = time.Now().Add(-time.Hour)
+	if w := b.EffectiveWeight(); w != 100 {
+		t.Errorf("warm backend weighs %d, want 100", w)
+	}
+}
+
+func TestSetAliveRecordsRecovery(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	b.SetAlive(false)
+	b.SetAlive(true)
+	if b.RecoveredAt.IsZero() {
+		t.Error("recovery time not recorded")
+	}
+}
+
+func TestCountResponse(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	for _, code := range []int{200, 201, 302, 404, 500, 503} {
+		b.CountResponse(code)
+	}
+	counts := b.ResponseCounts()
+	want := ResponseCounts{Responses2xx: 2, Responses3xx: 1, Responses4xx: 1, Responses5xx: 2}
+	if counts != want {
+		t.Errorf("counts are %+v, want %+v", counts, want)
+	}
+	if counts.Total() != 6 {
+		t.Errorf("total is %d", counts.Total())
+	}
+}
+
+func TestHasTag(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	b.Tags = map[string]string{"pool": "internal"}
+	if !b.HasTag("pool", "internal") || b.HasTag("pool", "public") || b.HasTag("zone", "") {
+		t.Error("HasTag does not match the tags")
+	}
+}
+
+func TestAddr(t *testing.T) {
+	for rawURL, want := range map[string]string{
+		"http://a:8080":   "a:8080",
+		"http://a":        "a:80",
+		"https://a":       "a:443",
+		"tcp://a:25":      "a:25",
+		"http://[::1]":    "[::1]:80",
+		"https://[::1]:8": "[::1]:8",
+	} {
+		if got := newTestBackend(t, rawURL).Addr(); got != want {
+			t.Errorf("Addr of %s is %s, want %s", rawURL, got, want)
+		}
+	}
+}
+
+func TestSetMaxRPS(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	b.SetMaxRPS(2)
+	if b.RateLimiter() == nil || !b.RateLimiter().Allow() || !b.RateLimiter().Allow() || b.RateLimiter().Allow() {
+		t.Error("rate limiter does not allow a burst of 2")
+	}
+	b.SetMaxRPS(0)
+	if b.RateLimiter() != nil {
+		t.Error("rate limiter kept without a max rps")
+	}
+}
+
+func TestDrainWaitsForActiveRequests(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	b.AddActive(1)
+	done := make(chan struct{})
+	go func() {
+		b.Drain()
+		close(done)
+	}()
+	time.Sleep(2 * drainPoll)
+	if b.DrainState() != DrainDraining || !b.Draining() {
+		t.Fatalf("drain state is %s", b.DrainState())
+	}
+	b.AddActive(-1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return once the requests completed")
+	}
+	if b.DrainState() != DrainDrained {
+		t.Errorf("drain state is %s", b.DrainState())
+	}
+	select {
+	case <-b.Drained():
+	default:
+		t.Error("Drained is not closed")
+	}
+	// a second drain returns right away
+	b.Drain()
+}
+
+func TestDrainTimesOut(t *testing.T) {
+	b := newTestBackend(t, "http://a:1")
+	b.DrainTimeout = drainPoll
+	b.AddActive(1)
+	start := time.Now()
+	b.Drain()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Drain took %s", took)
+	}
+	if b.DrainState() != DrainDrained {
+		t.Errorf("drain state is %s", b.DrainState())
+	}
+}
+
+func TestGetNextPeerPassesOverDrainingBackend(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	draining := s.Backends()[0]
+	draining.DrainTimeout = drainPoll
+	draining.Drain()
+	for i := 0; i < 4; i++ {
+		if mustNextPeer(t, s, testRequest()) == draining {
+			t.Fatal("request went to a drained backend")
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	b := newTestBackend(t, "http://user:pass@a:1")
+	b.SetWeight(3)
+	b.Tags = map[string]string{"pool": "internal"}
+	b.HealthCheckCmd = []string{"true"}
+	b.SetMaxRPS(10)
+	b.CountResponse(200)
+	b.ReverseProxy = &httputil.ReverseProxy{Transport: &http.Transport{}}
+
+	c := b.Clone()
+	if c.URL == b.URL || c.URL.User == b.URL.User || c.URL.String() != b.URL.String() {
+		t.Error("URL not copied")
+	}
+	if c.Weight() != 3 || !c.HasTag("pool", "internal") || c.MaxRPS() != 10 || c.RateLimiter() == b.RateLimiter() {
+		t.Error("settings not copied")
+	}
+	c.Tags["pool"] = "public"
+	c.HealthCheckCmd[0] = "false"
+	if !b.HasTag("pool", "internal") || b.HealthCheckCmd[0] != "true" {
+		t.Error("clone shares its tags or command with the original")
+	}
+	if c.ResponseCounts().Total() != 0 {
+		t.Error("clone has the stats of the original")
+	}
+	if c.ReverseProxy == b.ReverseProxy || c.ReverseProxy.Transport == b.ReverseProxy.Transport {
+		t.Error("clone shares the proxy of the original")
+	}
+}
+
+func TestPoolClone(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	s.Algorithm = &WeightedRoundRobin{}
+	s.SetResponseCodeMap(map[int]int{500: 503})
+	built := 0
+	s.ProxyFactory = func(*Backend) *httputil.ReverseProxy {
+		built++
+		return &httputil.ReverseProxy{}
+	}
+	for _, b := range s.Backends() {
+		b.ReverseProxy = &httputil.ReverseProxy{}
+	}
+
+	c := s.Clone()
+	if len(c.Backends()) != 2 || c.Backends()[0] == s.Backends()[0] {
+		t.Fatal("backends not cloned")
+	}
+	if built != 2 {
+		t.Errorf("ProxyFactory built %d proxies", built)
+	}
+	if _, ok := c.Algorithm.(*WeightedRoundRobin); !ok || c.Algorithm == s.Algorithm {
+		t.Errorf("algorithm is %T", c.Algorithm)
+	}
+	c.RemoveBackend(c.Backends()[0])
+	c.SetResponseCodeMap(nil)
+	if len(s.Backends()) != 2 {
+		t.Error("removing from the clone changed the original")
+	}
+	if code, ok := s.MapResponseCode(500); !ok || code != 503 {
+		t.Error("changing the code map of the clone changed the original")
+	}
+}
+
+func TestResponseCodeMap(t *testing.T) {
+	s := newTestPool(t)
+	s.SetResponseCodeMap(map[int]int{500: 503, 404: 404})
+	if code, ok := s.MapResponseCode(500); !ok || code != 503 {
+		t.Errorf("500 maps to %d, %t", code, ok)
+	}
+	if code, ok := s.MapResponseCode(404); ok || code != 404 {
+		t.Errorf("404 maps to %d, %t", code, ok)
+	}
+	codes := s.ResponseCodes()
+	codes[200] = 204
+	if _, ok := s.MapResponseCode(200); ok {
+		t.Error("ResponseCodes does not return a copy")
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	s.Backends()[0].SetAlive(false)
+	s.Backends()[1].CountResponse(200)
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestPool(t, "http://a:1", "http://b:1")
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Backends()[0].IsAlive() || !restored.Backends()[1].IsAlive() {
+		t.Error("status not restored")
+	}
+	if restored.Backends()[1].ResponseCounts().Responses2xx != 1 {
+		t.Error("stats not restored")
+	}
+	if err := json.Unmarshal([]byte("{"), restored); err == nil {
+		t.Error("malformed state accepted")
+	}
+}
+
+func TestAdjustWeightsFavorsFastBackends(t *testing.T) {
+	s := newTestPool(t, "http://fast:1", "http://slow:1")
+	fast, slow := s.Backends()[0], s.Backends()[1]
+	for i := 0; i < 100; i++ {
+		fast.ObserveLatency(10 * time.Millisecond)
+		slow.ObserveLatency(40 * time.Millisecond)
+	}
+	if p99 := slow.Latency(0.99); p99 != 40*time.Millisecond {
+		t.Errorf("P99 of the slow backend is %s", p99)
+	}
+	s.AdjustWeights(0)
+	if fast.CurrentDynamicWeight() <= slow.CurrentDynamicWeight() {
+		t.Errorf("fast backend weighs %.2f, slow one %.2f", fast.CurrentDynamicWeight(), slow.CurrentDynamicWeight())
+	}
+	if sum := fast.CurrentDynamicWeight() + slow.CurrentDynamicWeight(); sum < 1.99 || sum > 2.01 {
+		t.Errorf("dynamic weights sum to %.2f, want 2", sum)
+	}
+	if fast.Latency(0.99) != 0 {
+		t.Error("latencies kept after the adjustment")
+	}
+}
+
+func TestRunAutoWeightStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServerPool(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.RunAutoWeight(DefaultAutoWeightDamp)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunAutoWeight did not stop with the context")
+	}
+}
+
+func TestSetMaxRPSWhileServing(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	b := s.Backends()[0]
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b.SetMaxRPS(1000 + i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := s.GetNextPeer(testRequest()); err != nil && err != ErrRateLimited {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if b.MaxRPS() != 1099 {
+		t.Errorf("max rps is %d", b.MaxRPS())
+	}
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	// benchBackends and benchClients are the size of the pool and the
+	// number of goroutines sending requests to it
+	benchBackends = 8
+	benchClients  = 16
+	// benchHotClients send half of the requests, random clients the other half
+	benchHotClients = 5
+	// benchMaxLatency bounds the simulated response time of a backend
+	benchMaxLatency = 10 * time.Millisecond
+)
+
+// benchRequests returns n requests, half of them from benchHotClients
+// clients and half from random ones, each for one of 1000 paths
+func benchRequests(n int) []*http.Request {
+	rnd := rand.New(rand.NewSource(1))
+	requests := make([]*http.Request, n)
+	for i := range requests {
+		ip := fmt.Sprintf("10.1.0.%d", rnd.Intn(benchHotClients)+1)
+		if i%2 == 1 {
+			ip = fmt.Sprintf("172.%d.%d.%d", 16+rnd.Intn(16), rnd.Intn(256), 1+rnd.Intn(254))
+		}
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/items/%d", rnd.Intn(1000)), nil)
+		r.RemoteAddr = ip + ":1234"
+		requests[i] = r
+	}
+	rnd.Shuffle(n, func(i, j int) { requests[i], requests[j] = requests[j], requests[i] })
+	return requests
+}
+
+// BenchmarkAlgorithms compares the algorithms under the same workload:
+// benchClients goroutines sending benchRequests to benchBackends backends,
+// each answering within 0 to benchMaxLatency. Besides ns/op and allocs/op
+// it reports the time spent choosing a backend and the share of the
+// requests each backend got.
+func BenchmarkAlgorithms(b *testing.B) {
+	requests := benchRequests(4096)
+	for _, name := range []string{"round-robin", "weighted-round-robin", "rendezvous", "maglev", "sticky-url-hash"} {
+		b.Run(name, func(b *testing.B) {
+			alg, err := NewAlgorithm(name, AlgorithmOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			s := NewServerPool(context.Background(), WithAlgorithm(alg))
+			index := map[*Backend]int{}
+			for i := 0; i < benchBackends; i++ {
+				backend := newTestBackend(b, fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+				if err := s.AddBackend(backend); err != nil {
+					b.Fatal(err)
+				}
+				index[backend] = i
+			}
+			// builds the maglev table outside of the timing
+			s.GetNextPeer(requests[0])
+
+			var selections [benchBackends]int64
+			var next, choosing int64
+			var wg sync.WaitGroup
+			b.ReportAllocs()
+			b.ResetTimer()
+			for c := 0; c < benchClients; c++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(seed))
+					for {
+						i := atomic.AddInt64(&next, 1)
+						if i > int64(b.N) {
+							return
+						}
+						start := time.Now()
+						peer, err := s.GetNextPeer(requests[int(i)%len(requests)])
+						atomic.AddInt64(&choosing, int64(time.Since(start)))
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						atomic.AddInt64(&selections[index[peer]], 1)
+						peer.AddActive(1)
+						took := time.Duration(rnd.Int63n(int64(benchMaxLatency) + 1))
+						time.Sleep(took)
+						peer.ObserveLatency(took)
+						peer.AddActive(-1)
+					}
+				}(int64(c))
+			}
+			wg.Wait()
+			b.StopTimer()
+			b.ReportMetric(float64(choosing)/float64(b.N), "select-ns/op")
+			for i, n := range selections {
+				b.ReportMetric(100*float64(n)/float64(b.N), fmt.Sprintf("%%backend%d", i))
+			}
+		})
+	}
+}
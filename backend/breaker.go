@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"time"
+)
+
+// States of the circuit breaker of a backend
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+const (
+	// DefaultCircuitBreakerWindow is the length of the window errors are
+	// counted in when the pool sets none
+	DefaultCircuitBreakerWindow = 10 * time.Second
+	// DefaultCircuitBreakerTimeout is how long a circuit stays open when the
+	// pool sets no timeout
+	DefaultCircuitBreakerTimeout = 30 * time.Second
+	// CircuitBreakerMinRequests is the number of requests of a window below
+	// which the circuit is not opened, a single error is not an error rate
+	CircuitBreakerMinRequests = 10
+)
+
+// CircuitTransition describes a change of state of a circuit breaker
+type CircuitTransition struct {
+	Time     time.Time `json:"time"`
+	Backend  string    `json:"backend"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Requests int       `json:"window_requests"`
+	Errors   int       `json:"window_errors"`
+}
+
+// circuit is the error counter of a backend over a fixed window
+type circuit struct {
+	state          string
+	windowStart    time.Time
+	windowRequests int
+	windowErrors   int
+	openedAt       time.Time
+	// probeStart is when the request let through a half-open circuit was
+	// sent, a probe that never reported is replaced after the timeout
+	probeStart time.Time
+}
+
+func (s *ServerPool) circuitWindow() time.Duration {
+	if s.CircuitBreakerWindow > 0 {
+		return s.CircuitBreakerWindow
+	}
+	return DefaultCircuitBreakerWindow
+}
+
+func (s *ServerPool) circuitTimeout() time.Duration {
+	if s.CircuitBreakerTimeout > 0 {
+		return s.CircuitBreakerTimeout
+	}
+	return DefaultCircuitBreakerTimeout
+}
+
+// CircuitState returns the state of the circuit breaker of b
+func (b *Backend) CircuitState() string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.circuit.state == "" {
+		return CircuitClosed
+	}
+	return b.circuit.state
+}
+
+// circuitUsable reports whether the circuit of b may let a request through,
+// without taking the probe of a half-open circuit
+func (s *ServerPool) circuitUsable(b *Backend) bool {
+	if s.CircuitBreakerThreshold <= 0 {
+		return true
+	}
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	switch b.circuit.state {
+	case CircuitOpen:
+		return time.Since(b.circuit.openedAt) >= s.circuitTimeout()
+	case CircuitHalfOpen:
+		return time.Since(b.circuit.probeStart) >= s.circuitTimeout()
+	}
+	return true
+}
+
+// claimCircuit lets a request through the circuit of b, a half-open circuit
+// lets a single one through until it reports with RecordResult
+func (s *ServerPool) claimCircuit(b *Backend) bool {
+	if s.CircuitBreakerThreshold <= 0 {
+		return true
+	}
+	b.mux.Lock()
+	c := &b.circuit
+	now := time.Now()
+	switch c.state {
+	case CircuitOpen:
+		if now.Sub(c.openedAt) < s.circuitTimeout() {
+			b.mux.Unlock()
+			return false
+		}
+		t := s.setCircuit(b, CircuitHalfOpen)
+		c.probeStart = now
+		b.mux.Unlock()
+		s.circuitChanged(t)
+		return true
+	case CircuitHalfOpen:
+		if now.Sub(c.probeStart) < s.circuitTimeout() {
+			b.mux.Unlock()
+			return false
+		}
+		c.probeStart = now
+	}
+	b.mux.Unlock()
+	return true
+}
+
+// RecordResult counts the outcome of a request to b and opens its circuit
+// when the share of errors in the window exceeds CircuitBreakerThreshold.
+// The outcome of the probe of a half-open circuit closes it or opens it
+// again.
+func (s *ServerPool) RecordResult(b *Backend, ok bool) {
+	if s.CircuitBreakerThreshold <= 0 {
+		return
+	}
+	b.mux.Lock()
+	c := &b.circuit
+	now := time.Now()
+	var t *CircuitTransition
+	switch c.state {
+	case CircuitOpen:
+		// a request sent before the circuit opened
+	case CircuitHalfOpen:
+		if ok {
+			t = s.setCircuit(b, CircuitClosed)
+			c.windowStart, c.windowRequests, c.windowErrors = now, 0, 0
+		} else {
+			t = s.setCircuit(b, CircuitOpen)
+			c.openedAt = now
+		}
+	default:
+		if now.Sub(c.windowStart) >= s.circuitWindow() {
+			c.windowStart, c.windowRequests, c.windowErrors = now, 0, 0
+		}
+		c.windowRequests++
+		if !ok {
+			c.windowErrors++
+		}
+		if c.windowRequests >= CircuitBreakerMinRequests &&
+			float64(c.windowErrors)/float64(c.windowRequests) > s.CircuitBreakerThreshold {
+			t = s.setCircuit(b, CircuitOpen)
+			c.openedAt = now
+		}
+	}
+	b.mux.Unlock()
+	if t != nil {
+		s.circuitChanged(t)
+	}
+}
+
+// setCircuit changes the state of the circuit of b and returns the
+// transition, b.mux must be held
+func (s *ServerPool) setCircuit(b *Backend, state string) *CircuitTransition {
+	from := b.circuit.state
+	if from == "" {
+		from = CircuitClosed
+	}
+	b.circuit.state = state
+	return &CircuitTransition{
+		Time:     time.Now(),
+		Backend:  b.URL.String(),
+		From:     from,
+		To:       state,
+		Requests: b.circuit.windowRequests,
+		Errors:   b.circuit.windowErrors,
+	}
+}
+
+// circuitChanged reports t to OnCircuitChange
+func (s *ServerPool) circuitChanged(t *CircuitTransition) {
+	if s.OnCircuitChange != nil {
+		s.OnCircuitChange(*t)
+	}
+}
@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitOpensOnErrorRate(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	s.CircuitBreakerThreshold = 0.5
+	s.CircuitBreakerTimeout = time.Hour
+	var transitions []CircuitTransition
+	s.OnCircuitChange = func(t CircuitTransition) { transitions = append(transitions, t) }
+	b := s.Backends()[0]
+
+	for i := 0; i < CircuitBreakerMinRequests-1; i++ {
+		s.RecordResult(b, false)
+	}
+	if b.CircuitState() != CircuitClosed {
+		t.Fatal("circuit opened below the minimum number of requests")
+	}
+	s.RecordResult(b, false)
+	if b.CircuitState() != CircuitOpen {
+		t.Fatalf("circuit is %s", b.CircuitState())
+	}
+	if len(transitions) != 1 || transitions[0].To != CircuitOpen || transitions[0].Errors != CircuitBreakerMinRequests {
+		t.Errorf("transitions are %+v", transitions)
+	}
+	for i := 0; i < 4; i++ {
+		if mustNextPeer(t, s, testRequest()) == b {
+			t.Fatal("request went through an open circuit")
+		}
+	}
+}
+
+func TestCircuitStaysClosedBelowThreshold(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	s.CircuitBreakerThreshold = 0.5
+	b := s.Backends()[0]
+	for i := 0; i < 20; i++ {
+		s.RecordResult(b, i%3 != 0)
+	}
+	if b.CircuitState() != CircuitClosed {
+		t.Errorf("circuit is %s with a third of errors", b.CircuitState())
+	}
+}
+
+func TestCircuitHalfOpenProbe(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	s.CircuitBreakerThreshold = 0.5
+	s.CircuitBreakerTimeout = 10 * time.Millisecond
+	b := s.Backends()[0]
+	for i := 0; i < CircuitBreakerMinRequests; i++ {
+		s.RecordResult(b, false)
+	}
+	if _, err := s.GetNextPeer(testRequest()); err != ErrNoPeer {
+		t.Fatalf("open circuit: got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if peer := mustNextPeer(t, s, testRequest()); peer != b {
+		t.Fatal("no probe after the timeout")
+	}
+	if b.CircuitState() != CircuitHalfOpen {
+		t.Fatalf("circuit is %s", b.CircuitState())
+	}
+	if _, err := s.GetNextPeer(testRequest()); err != ErrNoPeer {
+		t.Fatal("half-open circuit let a second request through")
+	}
+	s.RecordResult(b, false)
+	if b.CircuitState() != CircuitOpen {
+		t.Fatalf("failed probe left the circuit %s", b.CircuitState())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	mustNextPeer(t, s, testRequest())
+	s.RecordResult(b, true)
+	if b.CircuitState() != CircuitClosed {
+		t.Fatalf("successful probe left the circuit %s", b.CircuitState())
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	b := s.Backends()[0]
+	for i := 0; i < 2*CircuitBreakerMinRequests; i++ {
+		s.RecordResult(b, false)
+	}
+	if b.CircuitState() != CircuitClosed {
+		t.Errorf("disabled circuit breaker is %s", b.CircuitState())
+	}
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"net/http"
+)
+
+// Clone returns a backend configured as b with its status and weights but
+// none of its stats. The clone gets a copy of the ReverseProxy of b with a
+// clone of its *http.Transport, pools whose proxies report to their
+// backend build it anew, see ServerPool.ProxyFactory.
+func (b *Backend) Clone() *Backend {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	u := *b.URL
+	if b.URL.User != nil {
+		user := *b.URL.User
+		u.User = &user
+	}
+	c := &Backend{
+		URL:           &u,
+		Alive:         b.Alive,
+		Zone:          b.Zone,
+		weight:        b.weight,
+		DynamicWeight: b.DynamicWeight,
+
+		SigningKey:               b.SigningKey,
+		SigningAlgorithm:         b.SigningAlgorithm,
+		RequestTimeout:           b.RequestTimeout,
+		MaxConcurrentRequests:    b.MaxConcurrentRequests,
+		HealthCheckTimeout:       b.HealthCheckTimeout,
+		HealthCheckType:          b.HealthCheckType,
+		HealthCheckRetries:       b.HealthCheckRetries,
+		HealthCheckRetryInterval: b.HealthCheckRetryInterval,
+		ExpectedContentType:      b.ExpectedContentType,
+		ResponseHashHeader:       b.ResponseHashHeader,
+		PinnedCertSHA256:         b.PinnedCertSHA256,
+		acceptsGzip:              b.acceptsGzip,
+		DrainTimeout:             b.DrainTimeout,
+		WarmupDuration:           b.WarmupDuration,
+		forcedStatus:             b.forcedStatus,
+	}
+	if b.Tags != nil {
+		c.Tags = make(map[string]string, len(b.Tags))
+		for key, value := range b.Tags {
+			c.Tags[key] = value
+		}
+	}
+	c.HealthCheckCmd = append([]string(nil), b.HealthCheckCmd...)
+	c.HealthCheckSend = append([]byte(nil), b.HealthCheckSend...)
+	c.HealthCheckExpect = append([]byte(nil), b.HealthCheckExpect...)
+	c.SetMaxRPS(b.maxRPS)
+	if b.ReverseProxy != nil {
+		proxy := *b.ReverseProxy
+		if transport, ok := proxy.Transport.(*http.Transport); ok {
+			proxy.Transport = transport.Clone()
+		}
+		c.ReverseProxy = &proxy
+	}
+	return c
+}
+
+// Clone returns a pool with the settings of s and clones of its backends.
+// Its algorithm starts afresh and it shares the context of s, health checks
+// of the clone are started separately.
+func (s *ServerPool) Clone() *ServerPool {
+	s.mux.RLock()
+	c := &ServerPool{
+		ctx:       s.ctx,
+		Algorithm: cloneAlgorithm(s.Algorithm),
+
+		HealthCheckInterval: s.HealthCheckInterval,
+		HealthCheckJitter:   s.HealthCheckJitter,
+		FailureThreshold:    s.FailureThreshold,
+		SuccessThreshold:    s.SuccessThreshold,
+		MinAliveBackends:    s.MinAliveBackends,
+
+		Zone:         s.Zone,
+		ZoneFallback: s.ZoneFallback,
+
+		HealthCheckPath:            s.HealthCheckPath,
+		HealthCheckTimeout:         s.HealthCheckTimeout,
+		HealthCheckUserAgent:       s.HealthCheckUserAgent,
+		AdaptiveHealthCheckTimeout: s.AdaptiveHealthCheckTimeout,
+
+		TransportFactory:       s.TransportFactory,
+		ProxyFactory:           s.ProxyFactory,
+		DialTimeout:            s.DialTimeout,
+		IdleConnTimeout:        s.IdleConnTimeout,
+		KeepAliveInterval:      s.KeepAliveInterval,
+		MaxResponseHeaderBytes: s.MaxResponseHeaderBytes,
+
+		CircuitBreakerThreshold: s.CircuitBreakerThreshold,
+		CircuitBreakerWindow:    s.CircuitBreakerWindow,
+		CircuitBreakerTimeout:   s.CircuitBreakerTimeout,
+
+		OnTransition:    s.OnTransition,
+		OnHealthCheck:   s.OnHealthCheck,
+		OnCircuitChange: s.OnCircuitChange,
+	}
+	if s.ResponseCodeMap != nil {
+		c.ResponseCodeMap = make(map[int]int, len(s.ResponseCodeMap))
+		for from, to := range s.ResponseCodeMap {
+			c.ResponseCodeMap[from] = to
+		}
+	}
+	if s.healthCheckers != nil {
+		c.healthCheckers = make(map[string]HealthChecker, len(s.healthCheckers))
+		for name, checker := range s.healthCheckers {
+			c.healthCheckers[name] = checker
+		}
+	}
+	backends := s.backends
+	s.mux.RUnlock()
+
+	c.backends = make([]*Backend, len(backends))
+	for i, b := range backends {
+		c.backends[i] = b.Clone()
+		if c.ProxyFactory != nil && b.ReverseProxy != nil {
+			c.backends[i].ReverseProxy = c.ProxyFactory(c.backends[i])
+		}
+	}
+	return c
+}
+
+// cloneAlgorithm returns an algorithm configured as a without its state
+func cloneAlgorithm(a Algorithm) Algorithm {
+	switch a := a.(type) {
+	case *WeightedRoundRobin:
+		return &WeightedRoundRobin{}
+	case *Rendezvous:
+		return &Rendezvous{Header: a.Header}
+	case *Maglev:
+		return &Maglev{Header: a.Header, size: a.size}
+	}
+	return a
+}
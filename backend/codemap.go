@@ -0,0 +1,36 @@
+package backend
+
+// SetResponseCodeMap replaces the response code map of the pool, nil or
+// empty passes all codes through
+func (s *ServerPool) SetResponseCodeMap(codes map[int]int) {
+	copied := make(map[int]int, len(codes))
+	for from, to := range codes {
+		copied[from] = to
+	}
+	s.mux.Lock()
+	s.ResponseCodeMap = copied
+	s.mux.Unlock()
+}
+
+// ResponseCodes returns a copy of the response code map of the pool
+func (s *ServerPool) ResponseCodes() map[int]int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	codes := make(map[int]int, len(s.ResponseCodeMap))
+	for from, to := range s.ResponseCodeMap {
+		codes[from] = to
+	}
+	return codes
+}
+
+// MapResponseCode returns the code clients get for a backend response of
+// code, and whether the map changed it
+func (s *ServerPool) MapResponseCode(code int) (int, bool) {
+	s.mux.RLock()
+	to, ok := s.ResponseCodeMap[code]
+	s.mux.RUnlock()
+	if !ok || to == code {
+		return code, false
+	}
+	return to, true
+}
@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"log"
+	"time"
+)
+
+// DefaultDrainTimeout bounds Drain when the backend sets no DrainTimeout
+const DefaultDrainTimeout = 30 * time.Second
+
+// Drain states of a backend
+const (
+	DrainIdle     = "idle"
+	DrainDraining = "draining"
+	DrainDrained  = "drained"
+)
+
+// drainPoll is how often Drain checks whether requests are still in flight
+const drainPoll = 50 * time.Millisecond
+
+// Drain stops sending new requests to the backend and waits for the requests
+// in flight to complete. After DrainTimeout the remaining requests are
+// cancelled and Drain returns. Calls while draining wait for the first one.
+func (b *Backend) Drain() {
+	b.mux.Lock()
+	if b.drainState != "" {
+		drained := b.drained
+		b.mux.Unlock()
+		<-drained
+		return
+	}
+	b.drainState = DrainDraining
+	if b.drained == nil {
+		b.drained = make(chan struct{})
+	}
+	timeout := b.DrainTimeout
+	b.mux.Unlock()
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for b.ActiveConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+	if n := b.ActiveConnections(); n > 0 {
+		log.Printf("Drain of %s timed out after %s, closing %d in-flight connections\n", b.URL, timeout, n)
+	}
+
+	b.mux.Lock()
+	b.drainState = DrainDrained
+	close(b.drained)
+	b.mux.Unlock()
+}
+
+// DrainState returns DrainIdle, DrainDraining or DrainDrained
+func (b *Backend) DrainState() string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.drainState == "" {
+		return DrainIdle
+	}
+	return b.drainState
+}
+
+// Draining reports whether the backend is draining or drained
+func (b *Backend) Draining() bool {
+	return b.DrainState() != DrainIdle
+}
+
+// Drained returns a channel closed once Drain completes, requests still in
+// flight at that point should be abandoned
+func (b *Backend) Drained() <-chan struct{} {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.drained == nil {
+		b.drained = make(chan struct{})
+	}
+	return b.drained
+}
@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// checkGRPC calls the gRPC health service of b for the whole server, over
+// TLS for https backends and in cleartext otherwise. b is alive when it
+// answers SERVING.
+func checkGRPC(ctx context.Context, b *Backend) bool {
+	creds := insecure.NewCredentials()
+	if b.URL.Scheme == "https" {
+		config := &tls.Config{ServerName: b.URL.Hostname()}
+		if b.PinnedCertSHA256 != "" {
+			config.VerifyPeerCertificate = verifyPin(b.PinnedCertSHA256)
+		}
+		creds = credentials.NewTLS(config)
+	}
+	// passthrough dials the address as is, like the other health checks
+	conn, err := grpc.NewClient("passthrough:///"+b.Addr(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUserAgent(DefaultHealthCheckUserAgent),
+	)
+	if err != nil {
+		log.Println("Invalid gRPC health check, err: ", err)
+		return false
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		log.Println("gRPC health check failed, err: ", err)
+		return false
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		log.Printf("Site unhealthy, gRPC health status: %s\n", resp.Status)
+		return false
+	}
+	return true
+}
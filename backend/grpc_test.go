@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startGRPC serves srv on a local port and returns a backend checked by the
+// gRPC health check
+func startGRPC(t *testing.T, srv *grpc.Server) *Backend {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	b := newTestBackend(t, "http://"+l.Addr().String())
+	b.HealthCheckType = HealthCheckGRPC
+	return b
+}
+
+// checkGRPCWithin runs the gRPC health check of b with a timeout
+func checkGRPCWithin(b *Backend, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return checkGRPC(ctx, b)
+}
+
+func TestGRPCHealthCheckServing(t *testing.T) {
+	srv := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthServer)
+	b := startGRPC(t, srv)
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if !checkGRPCWithin(b, time.Second) {
+		t.Error("SERVING server found down")
+	}
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	if checkGRPCWithin(b, time.Second) {
+		t.Error("NOT_SERVING server found alive")
+	}
+}
+
+func TestGRPCHealthCheckThroughPool(t *testing.T) {
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	b := startGRPC(t, srv)
+	s := newTestPool(t)
+	s.AddBackend(b)
+	b.SetAlive(false)
+	if alive, _ := s.CheckBackend(b); !alive {
+		t.Error("SERVING server found down by the pool")
+	}
+}
+
+func TestGRPCHealthCheckWithoutHealthService(t *testing.T) {
+	// the server answers Unimplemented in a trailers-only response
+	b := startGRPC(t, grpc.NewServer())
+	if checkGRPCWithin(b, time.Second) {
+		t.Error("server without a health service found alive")
+	}
+}
+
+// blockingHealth holds health checks until the connection goes away
+type blockingHealth struct {
+	healthpb.UnimplementedHealthServer
+	called chan struct{}
+}
+
+func (h *blockingHealth) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	close(h.called)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGRPCHealthCheckGoAway(t *testing.T) {
+	srv := grpc.NewServer()
+	h := &blockingHealth{called: make(chan struct{})}
+	healthpb.RegisterHealthServer(srv, h)
+	b := startGRPC(t, srv)
+
+	result := make(chan bool, 1)
+	go func() { result <- checkGRPCWithin(b, 5*time.Second) }()
+	<-h.called
+	// Stop sends GOAWAY and closes the connection under the call
+	srv.Stop()
+	select {
+	case alive := <-result:
+		if alive {
+			t.Error("server going away found alive")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("health check still waiting after GOAWAY")
+	}
+}
+
+func TestGRPCHealthCheckUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	b := newTestBackend(t, "http://"+addr)
+	start := time.Now()
+	if checkGRPCWithin(b, 5*time.Second) {
+		t.Error("closed port found alive")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("check of a closed port took %s", took)
+	}
+}
+
+func TestGRPCHealthCheckPlaintextToTLS(t *testing.T) {
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	b := startGRPC(t, srv)
+	// a cleartext server does not complete the TLS handshake
+	u := *b.URL
+	u.Scheme = "https"
+	b.URL = &u
+	if checkGRPCWithin(b, time.Second) {
+		t.Error("TLS health check of a cleartext server succeeded")
+	}
+}
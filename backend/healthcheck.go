@@ -0,0 +1,326 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHealthCheckTimeout bounds a health check when the pool sets none
+	DefaultHealthCheckTimeout = 2 * time.Second
+	// DefaultHealthCheckUserAgent identifies HTTP health check requests
+	DefaultHealthCheckUserAgent = "Go-LB-HealthCheck/1.0"
+	// DefaultHealthCheckRetries and DefaultHealthCheckRetryInterval apply to
+	// backends setting no retries
+	DefaultHealthCheckRetries       = 1
+	DefaultHealthCheckRetryInterval = 100 * time.Millisecond
+
+	// MinHealthCheckTimeout and MaxHealthCheckTimeout bound the adaptive
+	// timeout of health checks
+	MinHealthCheckTimeout = 500 * time.Millisecond
+	MaxHealthCheckTimeout = 10 * time.Second
+)
+
+// HealthCheck pings the backends and updates the status
+func (s *ServerPool) HealthCheck() {
+	for _, b := range s.list() {
+		s.CheckBackend(b)
+	}
+}
+
+// CheckBackend pings a single backend, retrying failed checks, and updates
+// its status, it returns the new status and how long the checks took
+func (s *ServerPool) CheckBackend(b *Backend) (alive bool, took time.Duration) {
+	retries, interval := b.HealthCheckRetries, b.HealthCheckRetryInterval
+	if retries <= 0 {
+		retries = DefaultHealthCheckRetries
+	}
+	if interval <= 0 {
+		interval = DefaultHealthCheckRetryInterval
+	}
+	removed := b.Removed()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if alive = s.isBackendAlive(b); alive || attempt == retries {
+			break
+		}
+		log.Printf("%s health check %d of %d failed, retrying in %s\n", b.URL, attempt, retries, interval)
+		select {
+		case <-time.After(interval):
+		case <-removed:
+		}
+	}
+	took = time.Since(start)
+	select {
+	case <-removed:
+		// a backend removed by Reset keeps its last status
+		return b.IsAlive(), took
+	default:
+	}
+	if s.AdaptiveHealthCheckTimeout {
+		s.adaptTimeout(b, alive)
+	}
+	if s.OnHealthCheck != nil {
+		s.OnHealthCheck(b, alive, took)
+	}
+	s.setStatus(b, alive, CauseHealthCheck)
+	log.Printf("%s []%s\n", b.URL, statusName(alive))
+	return alive, took
+}
+
+// healthCheckTimeout returns the timeout of the next health check of b
+func (s *ServerPool) healthCheckTimeout(b *Backend) time.Duration {
+	b.mux.RLock()
+	timeout := b.HealthCheckTimeout
+	b.mux.RUnlock()
+	if timeout > 0 {
+		return timeout
+	}
+	if s.AdaptiveHealthCheckTimeout {
+		return MinHealthCheckTimeout
+	}
+	if s.HealthCheckTimeout > 0 {
+		return s.HealthCheckTimeout
+	}
+	return DefaultHealthCheckTimeout
+}
+
+// adaptTimeout doubles the health check timeout of b after a failure, up
+// to MaxHealthCheckTimeout, and resets it after a success
+func (s *ServerPool) adaptTimeout(b *Backend, alive bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if alive {
+		b.HealthCheckTimeout = MinHealthCheckTimeout
+		return
+	}
+	timeout := b.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = MinHealthCheckTimeout
+	}
+	timeout *= 2
+	if timeout > MaxHealthCheckTimeout {
+		timeout = MaxHealthCheckTimeout
+	}
+	b.HealthCheckTimeout = timeout
+}
+
+// Health check types of backends
+const (
+	// HealthCheckTCP establishes a TCP connection, exchanging the probe of
+	// the backend if it has one
+	HealthCheckTCP = "tcp"
+	// HealthCheckHTTP and HealthCheckHTTPS GET the health check path of the
+	// pool, "/" if it has none, the backend is alive when it answers below 400
+	HealthCheckHTTP  = "http"
+	HealthCheckHTTPS = "https"
+	// HealthCheckGRPC asks the standard gRPC health service whether the
+	// server is serving
+	HealthCheckGRPC = "grpc"
+	// HealthCheckExec runs the health check command of the backend
+	HealthCheckExec = "exec"
+)
+
+// HealthCheckTypes lists the health check types built into every pool
+var HealthCheckTypes = []string{HealthCheckTCP, HealthCheckHTTP, HealthCheckHTTPS, HealthCheckGRPC, HealthCheckExec}
+
+// HealthChecker checks whether a backend is alive, ctx is done once the
+// health check timed out or the backend was removed
+type HealthChecker interface {
+	Check(ctx context.Context, b *Backend) bool
+}
+
+// HealthCheckerFunc adapts a function to a HealthChecker
+type HealthCheckerFunc func(ctx context.Context, b *Backend) bool
+
+// Check calls f(ctx, b)
+func (f HealthCheckerFunc) Check(ctx context.Context, b *Backend) bool {
+	return f(ctx, b)
+}
+
+// RegisterHealthChecker makes c check the backends of the pool with the
+// health check type name, replacing the built-in checker of that name
+func (s *ServerPool) RegisterHealthChecker(name string, c HealthChecker) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.healthCheckers == nil {
+		s.healthCheckers = make(map[string]HealthChecker)
+	}
+	s.healthCheckers[name] = c
+}
+
+// healthChecker returns the checker of b. Backends without a health check
+// type run their health check command if they have one, otherwise they get
+// a GET of the health check path of the pool if it has one, or a TCP check.
+func (s *ServerPool) healthChecker(b *Backend) HealthChecker {
+	name := b.HealthCheckType
+	if name == "" {
+		switch {
+		case len(b.HealthCheckCmd) > 0:
+			name = HealthCheckExec
+		case s.HealthCheckPath != "":
+			// the scheme of the backend URL
+			return httpChecker{pool: s}
+		default:
+			name = HealthCheckTCP
+		}
+	}
+	s.mux.RLock()
+	c, ok := s.healthCheckers[name]
+	s.mux.RUnlock()
+	if ok {
+		return c
+	}
+	switch name {
+	case HealthCheckTCP:
+		return HealthCheckerFunc(checkTCP)
+	case HealthCheckHTTP, HealthCheckHTTPS:
+		return httpChecker{pool: s, scheme: name}
+	case HealthCheckGRPC:
+		return HealthCheckerFunc(checkGRPC)
+	case HealthCheckExec:
+		return HealthCheckerFunc(runHealthCheckCmd)
+	}
+	return nil
+}
+
+// isBackendAlive checks whether a backend is alive with the checker of its
+// health check type
+func (s *ServerPool) isBackendAlive(b *Backend) bool {
+	checker := s.healthChecker(b)
+	if checker == nil {
+		log.Printf("%s: unknown health check type %q\n", b.URL, b.HealthCheckType)
+		return false
+	}
+	ctx, cancel := healthCheckContext(b, s.healthCheckTimeout(b))
+	defer cancel()
+	return checker.Check(ctx, b)
+}
+
+// checkTCP establishes a TCP connection to b and exchanges its probe
+func checkTCP(ctx context.Context, b *Backend) bool {
+	// the timeout covers the dial and the probe
+	deadline, _ := ctx.Deadline()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", b.Addr())
+	if err != nil {
+		log.Println("Site unreachable, err: ", err)
+		return false
+	}
+	defer conn.Close()
+	if len(b.HealthCheckSend) == 0 && len(b.HealthCheckExpect) == 0 {
+		return true
+	}
+	conn.SetDeadline(deadline)
+	return probe(conn, b.HealthCheckSend, b.HealthCheckExpect)
+}
+
+// probe writes send to conn and checks that the reply starts with expect
+func probe(conn net.Conn, send, expect []byte) bool {
+	if len(send) > 0 {
+		if _, err := conn.Write(send); err != nil {
+			log.Println("Health check probe failed, err: ", err)
+			return false
+		}
+	}
+	if len(expect) == 0 {
+		return true
+	}
+	reply := make([]byte, len(expect))
+	if n, err := io.ReadFull(conn, reply); err != nil {
+		log.Printf("Health check probe failed after %q, err: %s\n", reply[:n], err)
+		return false
+	}
+	if !bytes.Equal(reply, expect) {
+		log.Printf("Site unhealthy, reply %q does not start with %q\n", reply, expect)
+		return false
+	}
+	return true
+}
+
+// healthCheckContext returns the context of a health check of b, done after
+// timeout or when b is removed from its pool
+func healthCheckContext(b *Backend, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	removed := b.Removed()
+	go func() {
+		select {
+		case <-removed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// httpChecker issues an HTTP GET of the health check path of pool, with
+// scheme if set and the scheme of the backend URL otherwise
+type httpChecker struct {
+	pool   *ServerPool
+	scheme string
+}
+
+func (c httpChecker) Check(ctx context.Context, b *Backend) bool {
+	s := c.pool
+	u := *b.URL
+	if c.scheme != "" {
+		u.Scheme = c.scheme
+	}
+	u.Path = s.HealthCheckPath
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.Println("Invalid health check request, err: ", err)
+		return false
+	}
+	userAgent := s.HealthCheckUserAgent
+	if userAgent == "" {
+		userAgent = DefaultHealthCheckUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	// the transport of the requests to b, with its dial timeout, TLS
+	// settings and pin, so that a backend only passes over a path that its
+	// requests could take
+	client := &http.Client{Transport: s.Transport(b)}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Site unreachable, err: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	b.SetAcceptsGzip(strings.Contains(resp.Header.Get("Accept-Encoding"), "gzip"))
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("Site unhealthy, status: %d\n", resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// runHealthCheckCmd runs the health check command of the backend with
+// BACKEND_URL in its environment
+func runHealthCheckCmd(ctx context.Context, b *Backend) bool {
+	if len(b.HealthCheckCmd) == 0 {
+		log.Printf("%s: exec health check without a health check command\n", b.URL)
+		return false
+	}
+	cmd := exec.CommandContext(ctx, b.HealthCheckCmd[0], b.HealthCheckCmd[1:]...)
+	cmd.Env = append(os.Environ(), "BACKEND_URL="+b.URL.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Health check command failed, err: %s, output: %q\n", err, out)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,269 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen serves every connection of a local TCP listener with serve
+func listen(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTCPProbe(t *testing.T) {
+	addr := listen(t, func(conn net.Conn) {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return
+		}
+		if line == "PING\n" {
+			conn.Write([]byte("+PONG\r\n"))
+		} else {
+			conn.Write([]byte("-ERR\r\n"))
+		}
+	})
+	s := newTestPool(t, "tcp://"+addr)
+	s.HealthCheckTimeout = time.Second
+	b := s.Backends()[0]
+	b.HealthCheckType = HealthCheckTCP
+
+	b.HealthCheckSend, b.HealthCheckExpect = []byte("PING\n"), []byte("+PONG")
+	if !s.isBackendAlive(b) {
+		t.Error("backend answering the probe is down")
+	}
+	b.HealthCheckSend = []byte("QUIT\n")
+	if s.isBackendAlive(b) {
+		t.Error("backend answering an error to the probe is alive")
+	}
+}
+
+func TestTCPProbeTimesOut(t *testing.T) {
+	addr := listen(t, func(conn net.Conn) { time.Sleep(time.Second) })
+	s := newTestPool(t, "tcp://"+addr)
+	s.HealthCheckTimeout = 50 * time.Millisecond
+	b := s.Backends()[0]
+	b.HealthCheckExpect = []byte("+PONG")
+	start := time.Now()
+	if s.isBackendAlive(b) {
+		t.Error("silent backend is alive")
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("probe took %s", took)
+	}
+}
+
+func TestHTTPSHealthCheck(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	s := newTestPool(t, srv.URL)
+	s.HealthCheckTimeout = time.Second
+	b := s.Backends()[0]
+	b.HealthCheckType = HealthCheckHTTP
+	// the TLS server does not speak plain HTTP
+	if s.isBackendAlive(b) {
+		t.Error("plain HTTP health check of a TLS server succeeded")
+	}
+}
+
+func TestHTTPHealthCheckNotesGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != DefaultHealthCheckUserAgent {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Header().Set("Accept-Encoding", "gzip")
+	}))
+	defer srv.Close()
+	s := newTestPool(t, srv.URL)
+	b := s.Backends()[0]
+	b.HealthCheckType = HealthCheckHTTP
+	if !s.isBackendAlive(b) {
+		t.Fatal("backend is down")
+	}
+	if !b.AcceptsGzip() {
+		t.Error("backend accepting gzip not noted")
+	}
+}
+
+func TestExecHealthCheck(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	b := s.Backends()[0]
+	b.HealthCheckCmd = []string{"sh", "-c", `test "$BACKEND_URL" = http://a:1`}
+	if !s.isBackendAlive(b) {
+		t.Error("successful command marked the backend down")
+	}
+	b.HealthCheckCmd = []string{"false"}
+	if s.isBackendAlive(b) {
+		t.Error("failing command marked the backend alive")
+	}
+	b.HealthCheckType, b.HealthCheckCmd = HealthCheckExec, nil
+	if s.isBackendAlive(b) {
+		t.Error("exec health check without a command succeeded")
+	}
+}
+
+func TestUnknownHealthCheckType(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	b := s.Backends()[0]
+	b.HealthCheckType = "nope"
+	if s.isBackendAlive(b) {
+		t.Error("unknown health check type succeeded")
+	}
+}
+
+func TestAdaptiveHealthCheckTimeout(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	s.AdaptiveHealthCheckTimeout = true
+	b := s.Backends()[0]
+	if got := s.healthCheckTimeout(b); got != MinHealthCheckTimeout {
+		t.Fatalf("first timeout is %s", got)
+	}
+	for want := 2 * MinHealthCheckTimeout; want < MaxHealthCheckTimeout; want *= 2 {
+		s.adaptTimeout(b, false)
+		if got := s.healthCheckTimeout(b); got != want {
+			t.Fatalf("timeout after a failure is %s, want %s", got, want)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		s.adaptTimeout(b, false)
+	}
+	if got := s.healthCheckTimeout(b); got != MaxHealthCheckTimeout {
+		t.Errorf("timeout grew to %s", got)
+	}
+	s.adaptTimeout(b, true)
+	if got := s.healthCheckTimeout(b); got != MinHealthCheckTimeout {
+		t.Errorf("timeout after a success is %s", got)
+	}
+}
+
+func TestPoolOptions(t *testing.T) {
+	alg := &WeightedRoundRobin{}
+	s := NewServerPool(context.Background(),
+		WithAlgorithm(alg),
+		WithHealthCheckInterval(time.Second, time.Millisecond),
+		WithHealthCheckTimeout(3*time.Second),
+		WithFailureThreshold(2),
+		WithSuccessThreshold(3),
+		WithMinAliveBackends(4),
+	)
+	if s.Algorithm != alg || s.HealthCheckTimeout != 3*time.Second ||
+		s.FailureThreshold != 2 || s.SuccessThreshold != 3 || s.MinAliveBackends != 4 {
+		t.Errorf("options not applied: %+v", s)
+	}
+	if d := s.nextHealthCheck(); d < time.Second || d >= time.Second+time.Millisecond {
+		t.Errorf("next health check in %s", d)
+	}
+	if s.done() != nil {
+		t.Error("pool of a background context is done")
+	}
+	if d := NewServerPool(context.Background()).nextHealthCheck(); d != DefaultHealthCheckInterval {
+		t.Errorf("default interval is %s", d)
+	}
+}
+
+func TestStartHealthChecks(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	s.HealthCheckInterval = time.Millisecond
+	checked := make(chan *Backend, 16)
+	s.RegisterHealthChecker("notify", HealthCheckerFunc(func(_ context.Context, b *Backend) bool {
+		select {
+		case checked <- b:
+		default:
+		}
+		return true
+	}))
+	for _, b := range s.Backends() {
+		b.HealthCheckType = "notify"
+	}
+	s.StartHealthChecks()
+	defer s.Reset()
+	seen := map[*Backend]bool{}
+	timeout := time.After(time.Second)
+	for len(seen) < 2 {
+		select {
+		case b := <-checked:
+			seen[b] = true
+		case <-timeout:
+			t.Fatalf("%d backends checked", len(seen))
+		}
+	}
+}
+
+func TestHealthCheckWithoutPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Skipf("port 80 unavailable: %s", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	s := newTestPool(t, "http://127.0.0.1")
+	s.HealthCheckTimeout = time.Second
+	b := s.Backends()[0]
+	for _, typ := range []string{HealthCheckTCP, HealthCheckHTTP} {
+		b.HealthCheckType = typ
+		if !s.isBackendAlive(b) {
+			t.Errorf("%s health check of a backend at its default port failed", typ)
+		}
+	}
+}
+
+func TestHTTPHealthCheckUsesPoolTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	s := newTestPool(t, srv.URL)
+	s.HealthCheckTimeout = time.Second
+	b := s.Backends()[0]
+	b.HealthCheckType = HealthCheckHTTPS
+	// the certificate of the test server is only trusted by its client
+	if s.isBackendAlive(b) {
+		t.Fatal("health check trusted a certificate its requests would not")
+	}
+	s.TransportFactory = func(*Backend) http.RoundTripper { return srv.Client().Transport }
+	if !s.isBackendAlive(b) {
+		t.Fatal("health check did not go through TransportFactory")
+	}
+
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	b.PinnedCertSHA256 = strings.Repeat("0", 64)
+	s.TransportFactory = func(b *Backend) http.RoundTripper {
+		transport := s.DefaultTransportFactory(b).(*http.Transport)
+		transport.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		return transport
+	}
+	if s.isBackendAlive(b) {
+		t.Error("health check passed a backend of another pinned key")
+	}
+	b.PinnedCertSHA256 = hex.EncodeToString(sum[:])
+	if !s.isBackendAlive(b) {
+		t.Error("health check failed a backend of the pinned key")
+	}
+}
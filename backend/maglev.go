@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMaglevTableSize is the lookup table size used when none is given
+const DefaultMaglevTableSize = 65537
+
+// Maglev implements the consistent hashing scheme from Google's Maglev paper.
+// Every slot of a prime sized lookup table is owned by a backend, so a
+// request is routed with a single table lookup. The table is rebuilt when
+// backends are added to or removed from the pool.
+type Maglev struct {
+	Header string
+	size   uint64
+	mux    sync.Mutex
+	table  atomic.Value // *maglevTable
+}
+
+// maglevTable is a lookup table built for one version of the pool
+type maglevTable struct {
+	version  uint64
+	backends []*Backend
+	entry    []int
+}
+
+// NewMaglev returns a Maglev algorithm with a lookup table of the given size
+func NewMaglev(size int, header string) (*Maglev, error) {
+	if size == 0 {
+		size = DefaultMaglevTableSize
+	}
+	if !isPrime(size) {
+		return nil, fmt.Errorf("maglev table size %d is not prime", size)
+	}
+	return &Maglev{Header: header, size: uint64(size)}, nil
+}
+
+// Next returns the backend owning the slot of the request key. When that
+// backend is not usable the following slots are probed for one that is.
+func (m *Maglev) Next(s *ServerPool, r *http.Request, usable Filter) *Backend {
+	t := m.lookupTable(s)
+	if len(t.backends) == 0 {
+		return nil
+	}
+	slot := hash64(hashKey(r, m.Header)) % m.size
+	if b := t.backends[t.entry[slot]]; usable(b) {
+		return b
+	}
+
+	// the owner cannot be used, walk the table until every backend has been seen
+	seen := make([]bool, len(t.backends))
+	left := len(t.backends)
+	for i := uint64(1); i < m.size && left > 0; i++ {
+		idx := t.entry[(slot+i)%m.size]
+		if seen[idx] {
+			continue
+		}
+		seen[idx] = true
+		left--
+		if usable(t.backends[idx]) {
+			return t.backends[idx]
+		}
+	}
+	return nil
+}
+
+// lookupTable returns the table for the current pool, rebuilding it if needed
+func (m *Maglev) lookupTable(s *ServerPool) *maglevTable {
+	version := atomic.LoadUint64(&s.version)
+	if t, ok := m.table.Load().(*maglevTable); ok && t.version == version {
+		return t
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if t, ok := m.table.Load().(*maglevTable); ok && t.version == version {
+		return t
+	}
+	backends, version := s.snapshot()
+	t := &maglevTable{
+		version:  version,
+		backends: backends,
+		entry:    m.populate(backends),
+	}
+	m.table.Store(t)
+	return t
+}
+
+// populate fills the lookup table by letting every backend claim its next
+// preferred slot in turn, as described in section 3.4 of the paper
+func (m *Maglev) populate(backends []*Backend) []int {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	offset := make([]uint64, n)
+	skip := make([]uint64, n)
+	for i, b := range backends {
+		name := b.URL.String()
+		offset[i] = hash64(name) % m.size
+		skip[i] = hash64(name+"#skip")%(m.size-1) + 1
+	}
+
+	entry := make([]int, m.size)
+	for i := range entry {
+		entry[i] = -1
+	}
+	next := make([]uint64, n)
+	filled := uint64(0)
+	for {
+		for i := 0; i < n; i++ {
+			c := (offset[i] + next[i]*skip[i]) % m.size
+			for entry[c] >= 0 {
+				next[i]++
+				c = (offset[i] + next[i]*skip[i]) % m.size
+			}
+			entry[c] = i
+			next[i]++
+			filled++
+			if filled == m.size {
+				return entry
+			}
+		}
+	}
+}
+
+// isPrime reports whether n is a prime number
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// BenchmarkConsistentHashing compares the lookups of Maglev, a single table
+// access, with rendezvous hashing, which scores every backend, as the fleet
+// grows
+func BenchmarkConsistentHashing(b *testing.B) {
+	for _, n := range []int{8, 64, 512} {
+		s := NewServerPool(context.Background())
+		for i := 0; i < n; i++ {
+			if err := s.AddBackend(newTestBackend(b, fmt.Sprintf("http://10.%d.%d.1:8080", i/250, i%250))); err != nil {
+				b.Fatal(err)
+			}
+		}
+		requests := make([]*http.Request, 1024)
+		for i := range requests {
+			requests[i] = clientRequest(fmt.Sprintf("192.168.%d.%d", i/250, i%250))
+		}
+		maglev, err := NewMaglev(DefaultMaglevTableSize, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, alg := range []struct {
+			name string
+			alg  Algorithm
+		}{
+			{"maglev", maglev},
+			{"rendezvous", &Rendezvous{}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", alg.name, n), func(b *testing.B) {
+				s.Algorithm = alg.alg
+				// builds the maglev table outside of the timing
+				s.GetNextPeer(requests[0])
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := s.GetNextPeer(requests[i%len(requests)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
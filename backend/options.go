@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// DefaultHealthCheckInterval is the delay between the periodic health checks
+// of a backend when the pool sets none
+const DefaultHealthCheckInterval = 2 * time.Minute
+
+// Option configures a pool built by NewServerPool
+type Option func(s *ServerPool)
+
+// WithAlgorithm picks backends with a, RoundRobin when not given
+func WithAlgorithm(a Algorithm) Option {
+	return func(s *ServerPool) { s.Algorithm = a }
+}
+
+// WithHealthCheckInterval sets the delay between periodic health checks and
+// the jitter added to it
+func WithHealthCheckInterval(interval, jitter time.Duration) Option {
+	return func(s *ServerPool) { s.HealthCheckInterval, s.HealthCheckJitter = interval, jitter }
+}
+
+// WithHealthCheckTimeout bounds a single health check
+func WithHealthCheckTimeout(timeout time.Duration) Option {
+	return func(s *ServerPool) { s.HealthCheckTimeout = timeout }
+}
+
+// WithFailureThreshold needs n failed health checks in a row to mark a
+// backend down
+func WithFailureThreshold(n int) Option {
+	return func(s *ServerPool) { s.FailureThreshold = n }
+}
+
+// WithSuccessThreshold needs n successful health checks in a row to mark a
+// backend up
+func WithSuccessThreshold(n int) Option {
+	return func(s *ServerPool) { s.SuccessThreshold = n }
+}
+
+// WithMinAliveBackends refuses requests while fewer than n backends are alive
+func WithMinAliveBackends(n int) Option {
+	return func(s *ServerPool) { s.MinAliveBackends = n }
+}
+
+// NewServerPool returns a pool configured by opts. Its periodic health
+// checks stop once ctx is done, a zero pool checks until its backends are
+// removed.
+func NewServerPool(ctx context.Context, opts ...Option) *ServerPool {
+	s := &ServerPool{ctx: ctx}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// done returns the channel closed when the context of the pool is done, nil
+// for a pool without one
+func (s *ServerPool) done() <-chan struct{} {
+	if s.ctx == nil {
+		return nil
+	}
+	return s.ctx.Done()
+}
+
+// StartHealthChecks checks every backend of the pool on its own timer
+func (s *ServerPool) StartHealthChecks() {
+	for _, b := range s.list() {
+		go s.CheckPeriodically(b)
+	}
+}
+
+// CheckPeriodically runs the health checks of b until it is drained or
+// removed from the pool, or the context of the pool is done
+func (s *ServerPool) CheckPeriodically(b *Backend) {
+	t := time.NewTimer(s.nextHealthCheck())
+	defer t.Stop()
+	for {
+		select {
+		case <-b.Removed():
+			return
+		case <-s.done():
+			return
+		case <-t.C:
+			if b.DrainState() == DrainDrained {
+				return
+			}
+			s.CheckBackend(b)
+			t.Reset(s.nextHealthCheck())
+		}
+	}
+}
+
+// nextHealthCheck returns the delay until the next check of a backend, the
+// interval plus a random jitter so that checks do not burst together
+func (s *ServerPool) nextHealthCheck() time.Duration {
+	delay := s.HealthCheckInterval
+	if delay <= 0 {
+		delay = DefaultHealthCheckInterval
+	}
+	if jitter := int64(s.HealthCheckJitter); jitter > 0 {
+		delay += time.Duration(rand.Int63n(jitter))
+	}
+	return delay
+}
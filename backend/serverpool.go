@@ -1,79 +1,356 @@
 package backend
 
 import (
-	"log"
-	"net"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // ServerPool holds information about reachable backends
 type ServerPool struct {
-	backends []*Backend
-	current  uint64
+	// backends is replaced rather than modified, so a slice taken under mux
+	// stays valid after it is released
+	mux       sync.RWMutex
+	backends  []*Backend
+	current   uint64
+	version   uint64
+	Algorithm Algorithm
+
+	// Zone of the load balancer, backends in the same zone are preferred
+	Zone string
+	// ZoneFallback allows backends of other zones when none in Zone is alive
+	ZoneFallback bool
+
+	// ctx ends the periodic health checks of the pool, see NewServerPool
+	ctx context.Context
+
+	// HealthCheckInterval is the delay between the periodic health checks
+	// of each backend plus a random jitter of up to HealthCheckJitter,
+	// DefaultHealthCheckInterval if zero
+	HealthCheckInterval time.Duration
+	HealthCheckJitter   time.Duration
+	// FailureThreshold and SuccessThreshold are the health checks failing
+	// or succeeding in a row that mark a backend down or up, 1 if zero. A
+	// check fails once its HealthCheckRetries attempts failed, so a backend
+	// goes down after FailureThreshold times HealthCheckRetries attempts.
+	FailureThreshold int
+	SuccessThreshold int
+	// MinAliveBackends makes GetNextPeer fail with ErrTooFewAlive while
+	// fewer backends are alive, 0 disables
+	MinAliveBackends int
+
+	// HealthCheckPath switches health checks from a TCP dial to an HTTP GET
+	// of this path, the backend is alive when it answers below 400
+	HealthCheckPath string
+	// HealthCheckTimeout bounds a single check, DefaultHealthCheckTimeout if zero
+	HealthCheckTimeout time.Duration
+	// HealthCheckUserAgent is sent with HTTP health checks
+	HealthCheckUserAgent string
+	// AdaptiveHealthCheckTimeout gives each backend a health check timeout
+	// starting at MinHealthCheckTimeout that doubles with every consecutive
+	// failure, up to MaxHealthCheckTimeout
+	AdaptiveHealthCheckTimeout bool
+	// healthCheckers are the checkers registered by RegisterHealthChecker
+	healthCheckers map[string]HealthChecker
+
+	// ResponseCodeMap rewrites the codes of backend responses to those
+	// clients get, set it before serving or with SetResponseCodeMap
+	ResponseCodeMap map[int]int
+
+	// TransportFactory builds the transport of each backend, the pool uses
+	// DefaultTransportFactory when it is nil
+	TransportFactory func(b *Backend) http.RoundTripper
+	// ProxyFactory builds the proxies of the backends of clones of the pool,
+	// which keep copies of the proxies of the original backends when nil
+	ProxyFactory func(b *Backend) *httputil.ReverseProxy
+	// DialTimeout bounds connecting to a backend, DefaultDialTimeout if zero
+	DialTimeout time.Duration
+	// IdleConnTimeout closes pooled connections to backends idle for longer,
+	// DefaultIdleConnTimeout if zero and no timeout if negative
+	IdleConnTimeout time.Duration
+	// KeepAliveInterval is the interval between TCP keep-alive probes of
+	// backend connections, DefaultKeepAliveInterval if zero and no probes
+	// if negative
+	KeepAliveInterval time.Duration
+	// MaxResponseHeaderBytes bounds the response headers of a backend,
+	// DefaultMaxResponseHeaderBytes if zero
+	MaxResponseHeaderBytes int64
+
+	// CircuitBreakerThreshold is the share of errors in a window of
+	// CircuitBreakerWindow above which requests stop going to a backend for
+	// CircuitBreakerTimeout, 0 disables circuit breakers
+	CircuitBreakerThreshold float64
+	CircuitBreakerWindow    time.Duration
+	CircuitBreakerTimeout   time.Duration
+
+	// OnTransition is called whenever a backend changes its alive status
+	OnTransition func(t Transition)
+	// OnHealthCheck is called after every health check with its outcome
+	OnHealthCheck func(b *Backend, alive bool, took time.Duration)
+	// OnCircuitChange is called whenever a circuit breaker changes state
+	OnCircuitChange func(t CircuitTransition)
 }
 
-// AddBackend to server pool
-func (s *ServerPool) AddBackend(backend *Backend) {
-	s.backends = append(s.backends, backend)
+// ErrDuplicateBackend is returned by AddBackend for a URL already in the pool
+var ErrDuplicateBackend = errors.New("backend already in the pool")
+
+// AddBackend to server pool, the URL of the backend is normalized first so
+// that spellings of the same URL are not added twice
+func (s *ServerPool) AddBackend(backend *Backend) error {
+	normalizeBackendURL(backend.URL)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, b := range s.backends {
+		if b.URL.String() == backend.URL.String() {
+			return ErrDuplicateBackend
+		}
+	}
+	backends := make([]*Backend, len(s.backends), len(s.backends)+1)
+	copy(backends, s.backends)
+	s.backends = append(backends, backend)
+	atomic.AddUint64(&s.version, 1)
+	return nil
 }
 
-// NextIndex atomcatically increase the counter and return an index
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)%uint64(len(s.backends))))
+// normalizeBackendURL lowercases the scheme and host of u, removes the default port
+// of the scheme and trailing slashes of the path
+func normalizeBackendURL(u *url.URL) {
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+}
+
+// RemoveBackend from server pool, it returns false if the backend is not in it
+func (s *ServerPool) RemoveBackend(backend *Backend) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, b := range s.backends {
+		if b == backend {
+			backends := make([]*Backend, 0, len(s.backends)-1)
+			backends = append(backends, s.backends[:i]...)
+			s.backends = append(backends, s.backends[i+1:]...)
+			atomic.AddUint64(&s.version, 1)
+			return true
+		}
+	}
+	return false
 }
 
-func (s *ServerPool) GetNextPeer() *Backend {
-	// loop entire backends to find out an Alive backend
-	next := s.NextIndex()
-	l := len(s.backends) + next
+// Reset removes all backends from the pool and starts the round robin over,
+// the health checks running for them are cancelled. Requests already sent
+// to a removed backend complete.
+func (s *ServerPool) Reset() {
+	s.mux.Lock()
+	backends := s.backends
+	s.backends = nil
+	atomic.StoreUint64(&s.current, 0)
+	atomic.AddUint64(&s.version, 1)
+	s.mux.Unlock()
+	for _, b := range backends {
+		b.remove()
+	}
+}
 
-	for i := next; i < l; i++ {
-		// take an index by modding
-		idx := i % len(s.backends)
-		// Use and store an alive backend
-		if s.backends[idx].IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.backends[idx]
+// Backends returns the backends of the pool
+func (s *ServerPool) Backends() []*Backend {
+	list, _ := s.snapshot()
+	backends := make([]*Backend, len(list))
+	copy(backends, list)
+	return backends
+}
+
+// snapshot returns the current backends, which must not be modified, with
+// the version of the pool they belong to
+func (s *ServerPool) snapshot() ([]*Backend, uint64) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.backends, atomic.LoadUint64(&s.version)
+}
+
+// list returns the current backends, which must not be modified
+func (s *ServerPool) list() []*Backend {
+	backends, _ := s.snapshot()
+	return backends
+}
+
+// GetBackend returns the backend with the given URL, or nil
+func (s *ServerPool) GetBackend(rawURL string) *Backend {
+	if u, err := url.Parse(rawURL); err == nil {
+		normalizeBackendURL(u)
+		rawURL = u.String()
+	}
+	for _, b := range s.list() {
+		if b.URL.String() == rawURL {
+			return b
 		}
 	}
 	return nil
 }
 
-// MarckBackendStatus changes the status of a backend
-func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
-	for _, b := range s.backends {
-		if b.URL.String() == backendUrl.String() {
-			b.SetAlive(alive)
-			break
+// FilterByTag returns the backends carrying the tag key=value
+func (s *ServerPool) FilterByTag(key, value string) []*Backend {
+	var backends []*Backend
+	for _, b := range s.list() {
+		if b.HasTag(key, value) {
+			backends = append(backends, b)
 		}
 	}
+	return backends
 }
 
-// HealthCheck pings the backends and updates the status
-func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
-		status := "up"
-		alive := isBackendAlive(b.URL)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
+// AliveCount returns the number of backends that are alive
+func (s *ServerPool) AliveCount() int {
+	count := 0
+	for _, b := range s.list() {
+		if b.IsAlive() {
+			count++
+		}
+	}
+	return count
+}
+
+// NextIndex atomcatically increase the counter and return an index
+func (s *ServerPool) NextIndex() int {
+	n := len(s.list())
+	if n == 0 {
+		return 0
+	}
+	return int(atomic.AddUint64(&s.current, 1) % uint64(n))
+}
+
+// tagKey is the context key of the tag required by a request
+type tagKey struct{}
+
+// requiredTag is a tag backends must carry to serve a request
+type requiredTag struct {
+	key, value string
+}
+
+// WithTag returns a context restricting GetNextPeer to backends with the
+// tag key=value
+func WithTag(ctx context.Context, key, value string) context.Context {
+	return context.WithValue(ctx, tagKey{}, requiredTag{key, value})
+}
+
+// excludedKey is the context key of the backends a request must avoid
+type excludedKey struct{}
+
+// WithExcluded returns a context keeping GetNextPeer from the backends with
+// the given URLs
+func WithExcluded(ctx context.Context, urls ...string) context.Context {
+	excluded := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		excluded[u] = true
+	}
+	return context.WithValue(ctx, excludedKey{}, excluded)
+}
+
+var (
+	// ErrNoPeer is returned by GetNextPeer when no backend can be used
+	ErrNoPeer = errors.New("no backend available")
+	// ErrRateLimited is returned by GetNextPeer when the usable backends are
+	// all at their rate limit
+	ErrRateLimited = errors.New("all backends rate limited")
+	// ErrAtCapacity is returned by GetNextPeer when the usable backends all
+	// have MaxConcurrentRequests in flight
+	ErrAtCapacity = errors.New("all backends at capacity")
+	// ErrTooFewAlive is returned by GetNextPeer while fewer than
+	// MinAliveBackends are alive
+	ErrTooFewAlive = errors.New("too few backends alive")
+)
+
+// GetNextPeer returns the alive backend chosen by the pool's algorithm for r,
+// draining backends are never chosen. When the context of r carries a tag
+// (see WithTag) only backends with that tag are considered, backends
+// excluded by WithExcluded never are. When the pool has a zone, backends of
+// that zone are preferred and the other zones are only used if ZoneFallback
+// is set. A backend at its capacity, at its rate limit or with an open
+// circuit is passed over for the next choice of the algorithm.
+func (s *ServerPool) GetNextPeer(r *http.Request) (*Backend, error) {
+	if s.MinAliveBackends > 0 && s.AliveCount() < s.MinAliveBackends {
+		return nil, ErrTooFewAlive
+	}
+	algorithm := s.Algorithm
+	if algorithm == nil {
+		algorithm = RoundRobin{}
+	}
+	var skipped map[*Backend]bool
+	rateLimited, atCapacity := false, false
+	pick := func(usable Filter) *Backend {
+		for {
+			peer := algorithm.Next(s, r, func(b *Backend) bool {
+				return !skipped[b] && usable(b)
+			})
+			if peer == nil {
+				return nil
+			}
+			if peer.AtCapacity() {
+				atCapacity = true
+			} else if limiter := peer.RateLimiter(); limiter != nil && !limiter.Allow() {
+				rateLimited = true
+			} else if s.claimCircuit(peer) {
+				return peer
+			}
+			if skipped == nil {
+				skipped = make(map[*Backend]bool)
+			}
+			skipped[peer] = true
+		}
+	}
+
+	alive := func(b *Backend) bool {
+		return b.IsAlive() && !b.Draining() && s.circuitUsable(b)
+	}
+	if tag, ok := r.Context().Value(tagKey{}).(requiredTag); ok {
+		alive = func(b *Backend) bool {
+			return b.HasTag(tag.key, tag.value) && b.IsAlive() && !b.Draining() && s.circuitUsable(b)
+		}
+	}
+	if excluded, ok := r.Context().Value(excludedKey{}).(map[string]bool); ok {
+		usable := alive
+		alive = func(b *Backend) bool {
+			return !excluded[b.URL.String()] && usable(b)
 		}
-		log.Printf("%s []%s\n", b.URL, status)
 	}
+	var peer *Backend
+	if s.Zone == "" {
+		peer = pick(alive)
+	} else {
+		peer = pick(func(b *Backend) bool {
+			return b.Zone == s.Zone && alive(b)
+		})
+		if peer == nil && s.ZoneFallback {
+			peer = pick(alive)
+		}
+	}
+
+	switch {
+	case peer != nil:
+		return peer, nil
+	case atCapacity:
+		return nil, ErrAtCapacity
+	case rateLimited:
+		return nil, ErrRateLimited
+	}
+	return nil, ErrNoPeer
 }
 
-// isBackendAlive checks whether a backend is alive by establishing a TCP connection
-func isBackendAlive(url *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", url.Host, timeout)
-	if err != nil {
-		log.Println("Site unreachable, err: ", err)
-		return false
+// MarckBackendStatus changes the status of a backend
+func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
+	for _, b := range s.list() {
+		if b.URL.String() == backendUrl.String() {
+			s.setStatus(b, alive, CausePassive)
+			break
+		}
 	}
-	defer conn.Close()
-	return true
 }
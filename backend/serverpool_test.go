@@ -0,0 +1,510 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBackend returns an alive backend of rawURL
+func newTestBackend(t testing.TB, rawURL string) *Backend {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Backend{URL: u, Alive: true}
+}
+
+// newTestPool returns a pool of alive backends with the given URLs
+func newTestPool(t testing.TB, urls ...string) *ServerPool {
+	t.Helper()
+	s := NewServerPool(context.Background())
+	for _, u := range urls {
+		if err := s.AddBackend(newTestBackend(t, u)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// testRequest is a request of the client 10.0.0.1
+func testRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	return r
+}
+
+func mustNextPeer(t *testing.T, s *ServerPool, r *http.Request) *Backend {
+	t.Helper()
+	peer, err := s.GetNextPeer(r)
+	if err != nil {
+		t.Fatalf("GetNextPeer: %s", err)
+	}
+	return peer
+}
+
+func TestRoundRobinVisitsBackendsInTurn(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	backends := s.Backends()
+	index := func(b *Backend) int {
+		for i, candidate := range backends {
+			if candidate == b {
+				return i
+			}
+		}
+		t.Fatalf("%s is not in the pool", b.URL)
+		return -1
+	}
+	prev := index(mustNextPeer(t, s, testRequest()))
+	for i := 0; i < 2*len(backends); i++ {
+		next := index(mustNextPeer(t, s, testRequest()))
+		if want := (prev + 1) % len(backends); next != want {
+			t.Fatalf("got backend %d after %d, want %d", next, prev, want)
+		}
+		prev = next
+	}
+}
+
+func TestGetNextPeerSkipsDeadBackends(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	dead := s.Backends()[1]
+	dead.SetAlive(false)
+	for i := 0; i < 6; i++ {
+		if peer := mustNextPeer(t, s, testRequest()); peer == dead {
+			t.Fatalf("request %d went to the dead backend", i)
+		}
+	}
+}
+
+func TestGetNextPeerWithoutAliveBackend(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	for _, b := range s.Backends() {
+		b.SetAlive(false)
+	}
+	if _, err := s.GetNextPeer(testRequest()); !errors.Is(err, ErrNoPeer) {
+		t.Errorf("got %v, want ErrNoPeer", err)
+	}
+	if _, err := NewServerPool(context.Background()).GetNextPeer(testRequest()); !errors.Is(err, ErrNoPeer) {
+		t.Errorf("empty pool: got %v, want ErrNoPeer", err)
+	}
+}
+
+func TestGetNextPeerMinAliveBackends(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	s.MinAliveBackends = 2
+	mustNextPeer(t, s, testRequest())
+	s.Backends()[0].SetAlive(false)
+	if _, err := s.GetNextPeer(testRequest()); !errors.Is(err, ErrTooFewAlive) {
+		t.Errorf("got %v, want ErrTooFewAlive", err)
+	}
+}
+
+func TestGetNextPeerTagsAndExclusions(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	tagged := s.Backends()[1]
+	tagged.Tags = map[string]string{"pool": "internal"}
+
+	r := testRequest()
+	r = r.WithContext(WithTag(r.Context(), "pool", "internal"))
+	for i := 0; i < 4; i++ {
+		if peer := mustNextPeer(t, s, r); peer != tagged {
+			t.Fatalf("tagged request went to %s", peer.URL)
+		}
+	}
+
+	r = testRequest()
+	r = r.WithContext(WithExcluded(r.Context(), tagged.URL.String()))
+	for i := 0; i < 4; i++ {
+		if peer := mustNextPeer(t, s, r); peer == tagged {
+			t.Fatalf("request went to the excluded backend")
+		}
+	}
+}
+
+func TestGetNextPeerPrefersZone(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	local, remote := s.Backends()[0], s.Backends()[1]
+	local.Zone, remote.Zone = "eu", "us"
+	s.Zone = "eu"
+	for i := 0; i < 4; i++ {
+		if peer := mustNextPeer(t, s, testRequest()); peer != local {
+			t.Fatalf("request went to zone %s", peer.Zone)
+		}
+	}
+	local.SetAlive(false)
+	if _, err := s.GetNextPeer(testRequest()); !errors.Is(err, ErrNoPeer) {
+		t.Errorf("without fallback got %v, want ErrNoPeer", err)
+	}
+	s.ZoneFallback = true
+	if peer := mustNextPeer(t, s, testRequest()); peer != remote {
+		t.Errorf("fallback went to %s", peer.URL)
+	}
+}
+
+func TestGetNextPeerAtCapacity(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	b := s.Backends()[0]
+	b.MaxConcurrentRequests = 1
+	b.AddActive(1)
+	if _, err := s.GetNextPeer(testRequest()); !errors.Is(err, ErrAtCapacity) {
+		t.Errorf("got %v, want ErrAtCapacity", err)
+	}
+	b.AddActive(-1)
+	mustNextPeer(t, s, testRequest())
+}
+
+func TestNextIndexWrapsAround(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	s.current = math.MaxUint64 - 4
+	for i := 0; i < 10; i++ {
+		if idx := s.NextIndex(); idx < 0 || idx >= 3 {
+			t.Fatalf("NextIndex returned %d for 3 backends", idx)
+		}
+	}
+	if idx := NewServerPool(context.Background()).NextIndex(); idx != 0 {
+		t.Errorf("NextIndex of an empty pool is %d", idx)
+	}
+}
+
+func TestAddBackendNormalizesAndRejectsDuplicates(t *testing.T) {
+	s := newTestPool(t, "http://Example.com:80/")
+	if got := s.Backends()[0].URL.String(); got != "http://example.com" {
+		t.Errorf("normalized URL is %s", got)
+	}
+	if err := s.AddBackend(newTestBackend(t, "HTTP://example.com")); !errors.Is(err, ErrDuplicateBackend) {
+		t.Errorf("got %v, want ErrDuplicateBackend", err)
+	}
+	if s.GetBackend("http://example.com:80") == nil {
+		t.Error("GetBackend does not find the backend by another spelling")
+	}
+}
+
+func TestResetRemovesBackends(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	b := s.Backends()[0]
+	s.Reset()
+	if len(s.Backends()) != 0 {
+		t.Errorf("pool has %d backends after Reset", len(s.Backends()))
+	}
+	select {
+	case <-b.Removed():
+	default:
+		t.Error("backend removed by Reset is not marked removed")
+	}
+}
+
+func TestRemoveBackend(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	b := s.Backends()[0]
+	if !s.RemoveBackend(b) {
+		t.Fatal("RemoveBackend returned false")
+	}
+	if s.RemoveBackend(b) {
+		t.Error("RemoveBackend removed a backend twice")
+	}
+	if len(s.Backends()) != 1 {
+		t.Errorf("pool has %d backends", len(s.Backends()))
+	}
+}
+
+func TestMarkBackendStatus(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1")
+	var transitions []Transition
+	s.OnTransition = func(t Transition) { transitions = append(transitions, t) }
+	b := s.Backends()[0]
+	s.MarkBackendStatus(b.URL, false)
+	if b.IsAlive() {
+		t.Fatal("backend still alive")
+	}
+	if s.AliveCount() != 1 {
+		t.Errorf("AliveCount is %d", s.AliveCount())
+	}
+	s.MarkBackendStatus(b.URL, true)
+	if !b.IsAlive() {
+		t.Fatal("backend still down")
+	}
+	if len(transitions) != 2 || transitions[0].To != "down" || transitions[1].To != "up" {
+		t.Errorf("transitions are %+v", transitions)
+	}
+}
+
+func TestForceStatusOverridesChecks(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	b := s.Backends()[0]
+	s.ForceStatus(b, false)
+	s.MarkBackendStatus(b.URL, true)
+	if b.IsAlive() || !b.Forced() {
+		t.Fatal("a forced backend changed status")
+	}
+	s.AutoHealth(b)
+	s.MarkBackendStatus(b.URL, true)
+	if !b.IsAlive() || b.Forced() {
+		t.Error("backend not back to its checks")
+	}
+}
+
+func TestCheckBackendMarksStatus(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	s := newTestPool(t, up.URL, down.URL)
+	s.HealthCheckPath = "/healthz"
+	s.HealthCheckTimeout = time.Second
+	var checks int
+	s.OnHealthCheck = func(*Backend, bool, time.Duration) { checks++ }
+	for _, b := range s.Backends() {
+		b.HealthCheckRetries = 1
+	}
+	s.HealthCheck()
+	upBackend, downBackend := s.GetBackend(up.URL), s.GetBackend(down.URL)
+	if !upBackend.IsAlive() {
+		t.Error("answering backend marked down")
+	}
+	if downBackend.IsAlive() {
+		t.Error("closed backend still alive")
+	}
+	if checks != 2 {
+		t.Errorf("OnHealthCheck called %d times", checks)
+	}
+
+	s.HealthCheckPath = "/missing"
+	if alive, _ := s.CheckBackend(upBackend); alive || upBackend.IsAlive() {
+		t.Error("backend answering 404 to its health check is alive")
+	}
+}
+
+func TestCheckBackendTCP(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	s := newTestPool(t, srv.URL)
+	b := s.Backends()[0]
+	b.SetAlive(false)
+	if alive, _ := s.CheckBackend(b); !alive || !b.IsAlive() {
+		t.Error("listening backend found down by a TCP check")
+	}
+}
+
+func TestCheckBackendRetries(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	s := newTestPool(t, down.URL)
+	b := s.Backends()[0]
+	b.HealthCheckRetries = 3
+	b.HealthCheckRetryInterval = time.Millisecond
+	var attempts int
+	s.RegisterHealthChecker("counting", HealthCheckerFunc(func(ctx context.Context, b *Backend) bool {
+		attempts++
+		return false
+	}))
+	b.HealthCheckType = "counting"
+	if alive, _ := s.CheckBackend(b); alive {
+		t.Fatal("failing backend alive")
+	}
+	if attempts != 3 {
+		t.Errorf("checked %d times, want 3", attempts)
+	}
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	s.FailureThreshold, s.SuccessThreshold = 2, 2
+	b := s.Backends()[0]
+	alive := false
+	s.RegisterHealthChecker("switch", HealthCheckerFunc(func(context.Context, *Backend) bool { return alive }))
+	b.HealthCheckType = "switch"
+	b.HealthCheckRetries = 1
+
+	s.CheckBackend(b)
+	if !b.IsAlive() {
+		t.Fatal("one failure marked the backend down")
+	}
+	s.CheckBackend(b)
+	if b.IsAlive() {
+		t.Fatal("two failures did not mark the backend down")
+	}
+	alive = true
+	s.CheckBackend(b)
+	if b.IsAlive() {
+		t.Fatal("one success marked the backend up")
+	}
+	s.CheckBackend(b)
+	if !b.IsAlive() {
+		t.Fatal("two successes did not mark the backend up")
+	}
+}
+
+func TestCheckPeriodicallyStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServerPool(ctx, WithHealthCheckInterval(time.Millisecond, 0))
+	b := newTestBackend(t, "http://a:1")
+	s.AddBackend(b)
+	checked := make(chan struct{}, 1)
+	s.RegisterHealthChecker("notify", HealthCheckerFunc(func(context.Context, *Backend) bool {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		return true
+	}))
+	b.HealthCheckType = "notify"
+	done := make(chan struct{})
+	go func() {
+		s.CheckPeriodically(b)
+		close(done)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("no periodic health check")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("periodic health checks did not stop with the context")
+	}
+}
+
+func TestFilterByTag(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	s.Backends()[0].Tags = map[string]string{"pool": "internal"}
+	s.Backends()[2].Tags = map[string]string{"pool": "internal"}
+	if got := s.FilterByTag("pool", "internal"); len(got) != 2 || got[0] != s.Backends()[0] || got[1] != s.Backends()[2] {
+		t.Errorf("got %d backends", len(got))
+	}
+	if got := s.FilterByTag("pool", "public"); len(got) != 0 {
+		t.Errorf("got %d backends", len(got))
+	}
+}
+
+// benchPool returns a pool of 8 backends, every other one dead
+func benchPool(b *testing.B) *ServerPool {
+	s := NewServerPool(context.Background())
+	for i := 0; i < 8; i++ {
+		peer := newTestBackend(b, fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		peer.SetAlive(i%2 == 0)
+		if err := s.AddBackend(peer); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+func BenchmarkGetNextPeer(b *testing.B) {
+	s := benchPool(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := testRequest()
+		for pb.Next() {
+			if _, err := s.GetNextPeer(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNextIndex(b *testing.B) {
+	s := benchPool(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.NextIndex()
+		}
+	})
+}
+
+func TestGetNextPeerUniform(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	counts := make(map[*Backend]int)
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	// 30 clients of 100 requests each
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				peer, err := s.GetNextPeer(testRequest())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mux.Lock()
+				counts[peer]++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, b := range s.Backends() {
+		if counts[b] != 1000 {
+			t.Errorf("%s got %d of 3000 requests, want 1000", b.URL, counts[b])
+		}
+	}
+}
+
+func TestGetNextPeerUniformAfterRecovery(t *testing.T) {
+	s := newTestPool(t, "http://a:1", "http://b:1", "http://c:1")
+	// the last backend is skipped for a while, which moves the index
+	last := s.Backends()[2]
+	last.SetAlive(false)
+	for i := 0; i < 10; i++ {
+		mustNextPeer(t, s, testRequest())
+	}
+	last.SetAlive(true)
+	counts := make(map[*Backend]int)
+	for i := 0; i < 3000; i++ {
+		counts[mustNextPeer(t, s, testRequest())]++
+	}
+	for _, b := range s.Backends() {
+		if counts[b] != 1000 {
+			t.Errorf("%s got %d of 3000 requests, want 1000", b.URL, counts[b])
+		}
+	}
+}
+
+func TestGetNextPeerSingleBackendConcurrently(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	only := s.Backends()[0]
+	// every client sends its requests at once, with the backend alive then down
+	clients := func(check func(*Backend, error)) {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					check(s.GetNextPeer(testRequest()))
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	clients(func(peer *Backend, err error) {
+		if err != nil || peer != only {
+			t.Errorf("got %v, %v, want the only backend", peer, err)
+		}
+	})
+	only.SetAlive(false)
+	clients(func(peer *Backend, err error) {
+		if err != ErrNoPeer {
+			t.Errorf("got %v, %v, want ErrNoPeer", peer, err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// poolState is the JSON representation of a pool
+type poolState struct {
+	HealthCheckPath string         `json:"health_check_path,omitempty"`
+	Backends        []backendState `json:"backends"`
+}
+
+// backendState is the JSON representation of a backend
+type backendState struct {
+	URL            string            `json:"url"`
+	Alive          bool              `json:"alive"`
+	Weight         int               `json:"weight"`
+	Zone           string            `json:"zone,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	MaxRPS         int               `json:"max_rps,omitempty"`
+	HealthCheckCmd []string          `json:"health_check_cmd,omitempty"`
+	Responses      ResponseCounts    `json:"responses"`
+
+	ConsecutiveFailures  int `json:"consecutive_failures"`
+	ConsecutiveSuccesses int `json:"consecutive_successes"`
+}
+
+// MarshalJSON encodes the backends of the pool with their status and stats
+func (s *ServerPool) MarshalJSON() ([]byte, error) {
+	state := poolState{HealthCheckPath: s.HealthCheckPath}
+	for _, b := range s.list() {
+		b.mux.RLock()
+		bs := backendState{
+			URL:            b.URL.String(),
+			Alive:          b.Alive,
+			Zone:           b.Zone,
+			Tags:           b.Tags,
+			MaxRPS:         b.maxRPS,
+			HealthCheckCmd: b.HealthCheckCmd,
+
+			ConsecutiveFailures:  b.failures,
+			ConsecutiveSuccesses: b.successes,
+		}
+		b.mux.RUnlock()
+		bs.Weight = b.Weight()
+		bs.Responses = b.ResponseCounts()
+		state.Backends = append(state.Backends, bs)
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON restores the status and stats of the backends of the pool
+// from data encoded by MarshalJSON. Backends of data that are not in the pool
+// are ignored, the configuration decides which backends are served.
+func (s *ServerPool) UnmarshalJSON(data []byte) error {
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for _, bs := range state.Backends {
+		b := s.GetBackend(bs.URL)
+		if b == nil {
+			continue
+		}
+		b.mux.Lock()
+		b.Alive = bs.Alive
+		b.failures = bs.ConsecutiveFailures
+		b.successes = bs.ConsecutiveSuccesses
+		b.mux.Unlock()
+		atomic.StoreUint64(&b.Responses2xx, bs.Responses.Responses2xx)
+		atomic.StoreUint64(&b.Responses3xx, bs.Responses.Responses3xx)
+		atomic.StoreUint64(&b.Responses4xx, bs.Responses.Responses4xx)
+		atomic.StoreUint64(&b.Responses5xx, bs.Responses.Responses5xx)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"time"
+)
+
+// Causes of a backend status change
+const (
+	CauseHealthCheck = "healthcheck"
+	CausePassive     = "passive"
+	CauseAdmin       = "admin-api"
+)
+
+// Transition describes a change of the alive status of a backend
+type Transition struct {
+	Time                 time.Time `json:"time"`
+	Backend              string    `json:"backend"`
+	From                 string    `json:"from"`
+	To                   string    `json:"to"`
+	Cause                string    `json:"cause"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+}
+
+// statusName returns the name used in logs for an alive status
+func statusName(alive bool) string {
+	if alive {
+		return "up"
+	}
+	return "down"
+}
+
+// record counts consecutive successes and failures of the backend and sets
+// its alive status once threshold of them agree, it returns the previous
+// and the new status
+func (b *Backend) record(alive bool, threshold int) (old, now bool, failures, successes int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	old = b.Alive
+	if alive {
+		b.successes++
+		b.failures = 0
+	} else {
+		b.failures++
+		b.successes = 0
+	}
+	if (alive && b.successes >= threshold) || (!alive && b.failures >= threshold) {
+		b.setAlive(alive)
+	}
+	return old, b.Alive, b.failures, b.successes
+}
+
+// setStatus updates the alive status of b and reports a change to
+// OnTransition. Only the admin API changes a forced status.
+func (s *ServerPool) setStatus(b *Backend, alive bool, cause string) {
+	if cause != CauseAdmin && b.Forced() {
+		return
+	}
+	threshold := 1
+	if cause == CauseHealthCheck {
+		threshold = s.FailureThreshold
+		if alive {
+			threshold = s.SuccessThreshold
+		}
+	}
+	old, alive, failures, successes := b.record(alive, threshold)
+	if old == alive || s.OnTransition == nil {
+		return
+	}
+	s.OnTransition(Transition{
+		Time:                 time.Now(),
+		Backend:              b.URL.String(),
+		From:                 statusName(old),
+		To:                   statusName(alive),
+		Cause:                cause,
+		ConsecutiveFailures:  failures,
+		ConsecutiveSuccesses: successes,
+	})
+}
+
+// ForceStatus sets the alive status of b and keeps health checks and
+// passive checks from changing it until AutoHealth is called
+func (s *ServerPool) ForceStatus(b *Backend, alive bool) {
+	b.mux.Lock()
+	b.forcedStatus = true
+	b.mux.Unlock()
+	s.setStatus(b, alive, CauseAdmin)
+}
+
+// AutoHealth hands the alive status of b back to the health checks
+func (s *ServerPool) AutoHealth(b *Backend) {
+	b.mux.Lock()
+	b.forcedStatus = false
+	b.mux.Unlock()
+}
+
+// Forced reports whether the alive status of b was forced by ForceStatus
+func (b *Backend) Forced() (forced bool) {
+	b.mux.RLock()
+	forced = b.forcedStatus
+	b.mux.RUnlock()
+	return
+}
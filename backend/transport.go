@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDialTimeout bounds the connection to a backend when the pool sets none
+const DefaultDialTimeout = 30 * time.Second
+
+// DefaultIdleConnTimeout closes connections to backends idle for longer
+// when the pool sets no timeout, as http.DefaultTransport does
+const DefaultIdleConnTimeout = 90 * time.Second
+
+// DefaultKeepAliveInterval is the interval between TCP keep-alive probes of
+// backend connections when the pool sets none
+const DefaultKeepAliveInterval = 30 * time.Second
+
+// DefaultMaxResponseHeaderBytes bounds the response headers of a backend
+// when the pool sets no limit
+const DefaultMaxResponseHeaderBytes = 1 << 20
+
+// Transport returns the transport used to proxy requests to b, built by the
+// pool's TransportFactory or DefaultTransportFactory
+func (s *ServerPool) Transport(b *Backend) http.RoundTripper {
+	if s.TransportFactory != nil {
+		return s.TransportFactory(b)
+	}
+	return s.DefaultTransportFactory(b)
+}
+
+// DefaultTransportFactory returns a transport like http.DefaultTransport
+// using the dial settings of the pool
+func (s *ServerPool) DefaultTransportFactory(b *Backend) http.RoundTripper {
+	dialTimeout := s.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	keepAlive := s.KeepAliveInterval
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAliveInterval
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &CountingConn{Conn: conn}, nil
+	}
+	transport.IdleConnTimeout = s.IdleConnTimeout
+	if transport.IdleConnTimeout == 0 {
+		transport.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	transport.MaxResponseHeaderBytes = s.MaxResponseHeaderBytes
+	if transport.MaxResponseHeaderBytes <= 0 {
+		transport.MaxResponseHeaderBytes = DefaultMaxResponseHeaderBytes
+	}
+	if b.PinnedCertSHA256 != "" {
+		transport.TLSClientConfig = &tls.Config{VerifyPeerCertificate: verifyPin(b.PinnedCertSHA256)}
+	}
+	return transport
+}
+
+// PinMismatchError is returned by the TLS handshake with a backend whose
+// public key does not match its PinnedCertSHA256
+type PinMismatchError struct {
+	Pinned, Got string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("certificate public key sha256 %s does not match pin %s", e.Got, e.Pinned)
+}
+
+// verifyPin returns a VerifyPeerCertificate callback checking that the
+// leaf certificate has the public key with the SHA-256 pinned. It runs
+// after the usual verification of the chain.
+func verifyPin(pinned string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return &PinMismatchError{Pinned: pinned}
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		if got := hex.EncodeToString(sum[:]); got != pinned {
+			return &PinMismatchError{Pinned: pinned, Got: got}
+		}
+		return nil
+	}
+}
+
+// IsResponseHeaderTooLarge reports whether err is the error of a transport
+// that got response headers larger than its MaxResponseHeaderBytes.
+// net/http has no sentinel for it, only the message.
+func IsResponseHeaderTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// CountingConn counts the bytes read from a backend connection
+type CountingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the connection
+func (c *CountingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPin(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	cert := srv.Certificate()
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(sum[:])
+
+	if err := verifyPin(pin)([][]byte{cert.Raw}, nil); err != nil {
+		t.Errorf("pinned certificate rejected: %s", err)
+	}
+	var mismatch *PinMismatchError
+	err := verifyPin(strings.Repeat("0", 64))([][]byte{cert.Raw}, nil)
+	if !errors.As(err, &mismatch) || mismatch.Got != pin {
+		t.Errorf("other certificate: got %v", err)
+	}
+	if err := verifyPin(pin)(nil, nil); !errors.As(err, &mismatch) {
+		t.Errorf("no certificate: got %v", err)
+	}
+}
+
+func TestDefaultTransportCountsBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+	s := newTestPool(t, srv.URL)
+	b := s.Backends()[0]
+	var conn *CountingConn
+	transport := s.Transport(b).(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err == nil {
+			conn = c.(*CountingConn)
+		}
+		return c, err
+	}
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, srv.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if conn == nil || conn.BytesRead() < 1000 {
+		t.Errorf("connection counted %d bytes", conn.BytesRead())
+	}
+}
+
+func TestResponseHeaderTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Large", strings.Repeat("x", 4096))
+	}))
+	defer srv.Close()
+	s := newTestPool(t, srv.URL)
+	s.MaxResponseHeaderBytes = 1024
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err := s.Transport(s.Backends()[0]).RoundTrip(req)
+	if !IsResponseHeaderTooLarge(err) {
+		t.Errorf("got %v", err)
+	}
+	if IsResponseHeaderTooLarge(nil) || IsResponseHeaderTooLarge(io.EOF) {
+		t.Error("other errors taken for headers too large")
+	}
+}
+
+func TestTransportFactory(t *testing.T) {
+	s := newTestPool(t, "http://a:1")
+	s.TransportFactory = func(*Backend) http.RoundTripper { return http.DefaultTransport }
+	if s.Transport(s.Backends()[0]) != http.DefaultTransport {
+		t.Error("TransportFactory not used")
+	}
+	b := s.Backends()[0]
+	b.PinnedCertSHA256 = strings.Repeat("0", 64)
+	transport := s.DefaultTransportFactory(b).(*http.Transport)
+	if transport.TLSClientConfig == nil || transport.TLSClientConfig.VerifyPeerCertificate == nil {
+		t.Error("pinned backend without a pin check")
+	}
+}
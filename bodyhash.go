@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// maxPartialBackends bounds the backends a request may break its response
+// to before it is no longer retried
+const maxPartialBackends = 8
+
+// bodyHashMiddleware hashes the buffered bodies of POST and PUT requests with
+// SHA-256, logged with the request. A hashed body is buffered, so that its
+// retries can be sent to the backends that did not see it, see
+// withPartialBackend. It must run after bodyBufferingMiddleware.
+func bodyHashMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodPost && r.Method != http.MethodPut) || r.GetBody == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := r.GetBody()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := sha256.New()
+		io.Copy(h, body)
+		body.Close()
+		hash := hex.EncodeToString(h.Sum(nil))
+		if entry := GetRequestLogFromContext(r); entry != nil {
+			entry.BodyHash = hash
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), BodyHash, hash)))
+	})
+}
+
+// GetBodyHashFromContext returns the hex SHA-256 of the request body, empty
+// for requests bodyHashMiddleware did not hash
+func GetBodyHashFromContext(r *http.Request) string {
+	if hash, ok := r.Context().Value(BodyHash).(string); ok {
+		return hash
+	}
+	return ""
+}
+
+// withPartialBackend returns a context recording that the backend broke its
+// response to the request, whose retries must not reach it again as it may
+// have acted on the body. ok is false once maxPartialBackends are recorded.
+func withPartialBackend(ctx context.Context, backend string) (_ context.Context, ok bool) {
+	partial, _ := ctx.Value(PartialBackends).([]string)
+	if len(partial) >= maxPartialBackends {
+		return ctx, false
+	}
+	// the attempts of the request share the context, never its slice
+	partial = append(partial[:len(partial):len(partial)], backend)
+	return context.WithValue(ctx, PartialBackends, partial), true
+}
+
+// GetPartialBackendsFromContext returns the URLs of the backends that broke
+// their response to earlier attempts of the request
+func GetPartialBackendsFromContext(r *http.Request) []string {
+	partial, _ := r.Context().Value(PartialBackends).([]string)
+	return partial
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// partialBackend reads a request and breaks the connection within the
+// response headers, returning its URL
+func partialBackend(t *testing.T, hits *int32) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				atomic.AddInt32(hits, 1)
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n"))
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+// post sends a POST of body through the body buffering and hashing
+// middlewares and the load balancer
+func post(body, idempotencyKey string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if idempotencyKey != "" {
+		r.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	}
+	w := httptest.NewRecorder()
+	bodyBufferingMiddleware(bodyHashMiddleware(http.HandlerFunc(lb))).ServeHTTP(w, r)
+	return w
+}
+
+func TestPartialResponseRetriedOnOtherBackend(t *testing.T) {
+	var hits int32
+	setupPool(t, partialBackend(t, &hits), namedBackend(t, "ok").URL)
+	for i := 0; i < 4; i++ {
+		before := atomic.LoadInt32(&hits)
+		w := post(`{"order":1}`, fmt.Sprint("key-", i))
+		if w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Fatalf("request %d: status %d, body %q", i, w.Code, w.Body.String())
+		}
+		if got := atomic.LoadInt32(&hits) - before; got > 1 {
+			t.Fatalf("request %d sent %d times to the backend breaking its response", i, got)
+		}
+	}
+	// the exclusion ends with the request, not with its body
+	if hits := atomic.LoadInt32(&hits); hits < 2 {
+		t.Errorf("the backend breaking its response saw %d of the requests with the same body", hits)
+	}
+}
+
+func TestPartialResponseNotSentAgain(t *testing.T) {
+	var hits int32
+	setupPool(t, partialBackend(t, &hits))
+	if w := post("body", "key"); w.Code == http.StatusOK {
+		t.Errorf("got status %d", w.Code)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("request sent %d times to the backend breaking its response", hits)
+	}
+}
+
+func TestPartialResponseNotRetriedWithoutIdempotencyKey(t *testing.T) {
+	var partialHits int32
+	other := namedBackend(t, "ok")
+	setupPool(t, partialBackend(t, &partialHits), other.URL)
+	for i := 0; i < 2; i++ {
+		before := atomic.LoadInt32(&partialHits)
+		w := post("body", "")
+		if atomic.LoadInt32(&partialHits) == before {
+			continue
+		}
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("status %d after the response broke, want %d", w.Code, http.StatusBadGateway)
+		}
+		return
+	}
+	t.Fatal("no request reached the backend breaking its response")
+}
+
+func TestWithPartialBackendIsBounded(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < maxPartialBackends; i++ {
+		var ok bool
+		if ctx, ok = withPartialBackend(ctx, fmt.Sprint("http://b", i)); !ok {
+			t.Fatalf("backend %d not recorded", i)
+		}
+	}
+	if _, ok := withPartialBackend(ctx, "http://more"); ok {
+		t.Errorf("more than %d backends recorded", maxPartialBackends)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	if got := GetPartialBackendsFromContext(r); len(got) != maxPartialBackends {
+		t.Errorf("got %d backends", len(got))
+	}
+}
+
+func TestWithPartialBackendDoesNotShare(t *testing.T) {
+	base, _ := withPartialBackend(context.Background(), "http://a")
+	first, _ := withPartialBackend(base, "http://b")
+	withPartialBackend(base, "http://c")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if got := GetPartialBackendsFromContext(r.WithContext(first)); strings.Join(got, ",") != "http://a,http://b" {
+		t.Errorf("got %v", got)
+	}
+	if got := GetPartialBackendsFromContext(r); got != nil {
+		t.Errorf("request without broken responses got %v", got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// certCacheTTL is how long a loaded certificate is served before the
+	// files are read again
+	certCacheTTL = time.Hour
+	// certWatchInterval is the interval between checks of the certificate
+	// files for changes
+	certWatchInterval = 10 * time.Second
+)
+
+// certLoader serves the certificate of -tls-cert and -tls-key to TLS
+// handshakes and picks up renewed files without a restart
+type certLoader struct {
+	certFile, keyFile string
+
+	mux      sync.Mutex
+	cert     *tls.Certificate
+	loadedAt time.Time
+	// modTime is the latest modification time of the files when loaded
+	modTime time.Time
+	// reloaded wakes up staple when a new certificate was loaded
+	reloaded chan struct{}
+}
+
+// newCertLoader returns a loader of the key pair, failing if it cannot be loaded
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile, reloaded: make(chan struct{}, 1)}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the key pair from disk
+func (l *certLoader) load() error {
+	modTime := l.filesModTime()
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.mux.Lock()
+	changed := l.cert != nil && !bytes.Equal(l.cert.Certificate[0], cert.Certificate[0])
+	if l.cert != nil && !changed {
+		// the same certificate read again keeps its staple
+		cert.OCSPStaple = l.cert.OCSPStaple
+	}
+	l.cert, l.loadedAt, l.modTime = &cert, time.Now(), modTime
+	l.mux.Unlock()
+	if changed {
+		select {
+		case l.reloaded <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// filesModTime returns the latest modification time of the key pair files
+func (l *certLoader) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{l.certFile, l.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate returns the cached certificate, read again from disk once
+// it is older than certCacheTTL. The previous certificate is kept when the
+// files cannot be loaded, e.g. while they are being replaced.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mux.Lock()
+	cert, expired := l.cert, time.Since(l.loadedAt) >= certCacheTTL
+	l.mux.Unlock()
+	if !expired {
+		return cert, nil
+	}
+	if err := l.load(); err != nil {
+		log.Println("Reloading TLS certificate failed, err: ", err)
+		l.mux.Lock()
+		l.loadedAt = time.Now()
+		l.mux.Unlock()
+		return cert, nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.cert, nil
+}
+
+// watch reloads the key pair every interval when its files changed
+func (l *certLoader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTime := l.filesModTime()
+		l.mux.Lock()
+		changed := modTime.After(l.modTime)
+		l.mux.Unlock()
+		if !changed {
+			continue
+		}
+		if err := l.load(); err != nil {
+			log.Println("Reloading TLS certificate failed, err: ", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate %s\n", l.certFile)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// coalesceMaxBody bounds the responses shared with coalesced requests,
+// waiters of a larger response send their own request
+const coalesceMaxBody = 1 << 20
+
+// defaultCoalesceHeaders are the request headers telling coalesced requests
+// apart, so that responses are only shared among clients that would get the
+// same one
+const defaultCoalesceHeaders = "Accept,Accept-Encoding,Accept-Language,Authorization,Cookie"
+
+// coalescer lets identical GET requests arriving while one of them is in
+// flight wait for its response instead of reaching a backend themselves
+type coalescer struct {
+	headers  []string
+	mux      sync.Mutex
+	inflight map[string]*sharedResponse
+}
+
+// sharedResponse is the response of an in-flight request, complete once done
+// is closed. ok is false when it cannot be shared.
+type sharedResponse struct {
+	done   chan struct{}
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// newCoalescer returns a coalescer keying requests on the headers
+func newCoalescer(headers []string) *coalescer {
+	return &coalescer{headers: headers, inflight: make(map[string]*sharedResponse)}
+}
+
+// key returns the key of r, requests with the same key get the same
+// response. It is empty for requests that must not be coalesced.
+func (c *coalescer) key(r *http.Request) string {
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		return ""
+	}
+	var key strings.Builder
+	key.WriteString(r.Host)
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range c.headers {
+		key.WriteString("\n")
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// coalesceMiddleware sends the first of identical GET requests on and gives
+// its response to the ones arriving until it completes
+func coalesceMiddleware(c *coalescer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := c.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c.mux.Lock()
+		shared, waiting := c.inflight[key]
+		if !waiting {
+			shared = &sharedResponse{done: make(chan struct{})}
+			c.inflight[key] = shared
+		}
+		c.mux.Unlock()
+
+		if waiting {
+			select {
+			case <-shared.done:
+			case <-r.Context().Done():
+				return
+			}
+			if !shared.ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for name, values := range shared.header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(shared.status)
+			w.Write(shared.body)
+			return
+		}
+
+		recorder := &sharingWriter{ResponseWriter: w, shared: shared}
+		// completed stays false when next panics, as the proxy does with
+		// http.ErrAbortHandler to abort a response cut short by the backend
+		completed := false
+		defer func() {
+			c.mux.Lock()
+			delete(c.inflight, key)
+			c.mux.Unlock()
+			// a response setting cookies belongs to its client only
+			shared.ok = completed && !recorder.over && shared.status != 0 &&
+				r.Context().Err() == nil && len(shared.header.Values("Set-Cookie")) == 0
+			close(shared.done)
+		}()
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
+
+// sharingWriter writes a response to its client and keeps a copy of it for
+// the coalesced requests
+type sharingWriter struct {
+	http.ResponseWriter
+	shared *sharedResponse
+	// over is set once the body exceeded coalesceMaxBody
+	over bool
+}
+
+func (w *sharingWriter) WriteHeader(status int) {
+	if w.shared.status == 0 {
+		w.shared.status = status
+		w.shared.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sharingWriter) Write(b []byte) (int, error) {
+	if w.shared.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.over {
+		if len(w.shared.body)+len(b) > coalesceMaxBody {
+			w.over, w.shared.body = true, nil
+		} else {
+			w.shared.body = append(w.shared.body, b...)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends buffered data to the client
+func (w *sharingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (w *sharingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
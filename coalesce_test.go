@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// coalesceRequests sends n identical requests to handler while the first
+// is held until release is closed, and returns the recorders in order
+func coalesceRequests(t *testing.T, handler http.Handler, n int, release chan struct{}) []*httptest.ResponseRecorder {
+	t.Helper()
+	recorders := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			defer func() {
+				if err := recover(); err != nil && err != http.ErrAbortHandler {
+					panic(err)
+				}
+			}()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/page", nil))
+		}(recorders[i])
+		if i == 0 {
+			// the others wait for the first one
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return recorders
+}
+
+func TestCoalesceSharesResponse(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := coalesceMiddleware(newCoalescer(nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		io.WriteString(w, "page")
+	}))
+	for i, w := range coalesceRequests(t, handler, 4, release) {
+		if w.Code != http.StatusOK || w.Body.String() != "page" {
+			t.Errorf("request %d: status %d, body %q", i, w.Code, w.Body)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestCoalesceDoesNotShareAbortedResponse(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := coalesceMiddleware(newCoalescer(nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+			// the backend broke the connection after the headers
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, "trunc")
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, "complete page")
+	}))
+	recorders := coalesceRequests(t, handler, 3, release)
+	for i, w := range recorders[1:] {
+		if w.Body.String() != "complete page" {
+			t.Errorf("waiter %d got %q", i, w.Body)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want the waiters to send their own requests", calls)
+	}
+}
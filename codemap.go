@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// codeMapFlag parses -response-code-map entries such as "404=200,500=503"
+type codeMapFlag struct {
+	codes *map[int]int
+}
+
+func (f codeMapFlag) String() string {
+	if f.codes == nil {
+		return ""
+	}
+	var entries []string
+	for from, to := range *f.codes {
+		entries = append(entries, fmt.Sprintf("%d=%d", from, to))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (f codeMapFlag) Set(v string) error {
+	if *f.codes == nil {
+		*f.codes = make(map[int]int)
+	}
+	for _, entry := range splitList(v) {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("response code mapping %q must be of the form <from>=<to>", entry)
+		}
+		from, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return fmt.Errorf("response code mapping %q: malformed code %q", entry, kv[0])
+		}
+		to, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return fmt.Errorf("response code mapping %q: malformed code %q", entry, kv[1])
+		}
+		(*f.codes)[from] = to
+	}
+	return nil
+}
+
+// validateCodeMap checks that a response code map holds HTTP status codes
+func validateCodeMap(codes map[int]int) error {
+	for from, to := range codes {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			return fmt.Errorf("response code mapping %d=%d: codes must be between 100 and 599", from, to)
+		}
+	}
+	return nil
+}
+
+// mapResponseCode rewrites the status of resp by the response code map of
+// the pool. An error turned into a success loses its body, which tells of
+// what went wrong.
+func mapResponseCode(resp *http.Response) {
+	code, ok := serverPool.MapResponseCode(resp.StatusCode)
+	if !ok {
+		return
+	}
+	debugf("%s(%s) Response code %d rewritten to %d\n", resp.Request.RemoteAddr, resp.Request.URL.Path, resp.StatusCode, code)
+	if resp.StatusCode >= http.StatusBadRequest && code < http.StatusBadRequest {
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+		resp.ContentLength = 0
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", "0")
+		resp.Header.Del("Content-Type")
+		resp.Header.Del("Content-Encoding")
+	}
+	resp.StatusCode = code
+	resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
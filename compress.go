@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"loadbalancer/backend"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxInflatedBody bounds a gzip request body once decompressed
+const maxInflatedBody = 32 << 20
+
+var errInflatedBodyTooLarge = errors.New("decompressed body too large")
+
+// compressUpstream adapts the encoding of a buffered request body to the
+// backend: gzip bodies are decompressed for backends that do not accept
+// gzip and plain bodies are compressed for backends that do. Bodies too
+// large to be buffered are sent as they are.
+func compressUpstream(b *backend.Backend, r *http.Request) {
+	if r.GetBody == nil || r.ContentLength == 0 {
+		return
+	}
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	accepts := b.AcceptsGzip()
+	var body []byte
+	var err error
+	switch {
+	case encoding == "gzip" && !accepts:
+		body, err = gunzip(r.Body)
+		if err == nil {
+			r.Header.Del("Content-Encoding")
+		}
+	case encoding == "" && accepts:
+		body, err = gzipBody(r.Body)
+		if err == nil {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("%s(%s) Re-encoding request body failed: %s\n", r.RemoteAddr, r.URL.Path, err)
+		r.Body, _ = r.GetBody()
+		return
+	}
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// gunzip decompresses a gzip body of up to maxInflatedBody bytes
+func gunzip(body io.ReadCloser) ([]byte, error) {
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(zr, maxInflatedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxInflatedBody {
+		return nil, errInflatedBodyTooLarge
+	}
+	return buf, nil
+}
+
+// gzipBody compresses a body
+func gzipBody(body io.ReadCloser) ([]byte, error) {
+	defer body.Close()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressResponse decompresses gzip responses of backends for clients
+// that did not ask for gzip
+func decompressResponse(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || acceptsGzip(resp.Request.Header) {
+		return nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = &gzipBodyReader{Reader: zr, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// gzipBodyReader reads a decompressed response body
+type gzipBodyReader struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r *gzipBodyReader) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
+// acceptsGzip reports whether the Accept-Encoding of a request allows gzip
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			rejected := false
+			for _, param := range parts[1:] {
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+					weight, err := strconv.ParseFloat(q[2:], 64)
+					rejected = err == nil && weight == 0
+				}
+			}
+			return !rejected
+		}
+	}
+	return false
+}
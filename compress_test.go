@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// gzipOnlyBackend answers every request with a gzipped body, whatever the
+// Accept-Encoding of the request
+func gzipOnlyBackend(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(body))
+	zw.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDecompressesForClientsWithoutGzip(t *testing.T) {
+	const body = "hello, uncompressed world"
+	setupPool(t, gzipOnlyBackend(t, body).URL)
+	for _, acceptEncoding := range []string{"", "identity", "br, gzip;q=0"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		lb(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Accept-Encoding %q: status %d", acceptEncoding, w.Code)
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q", acceptEncoding, enc)
+		}
+		if length := w.Header().Get("Content-Length"); length != "" && length != strconv.Itoa(len(body)) {
+			t.Errorf("Accept-Encoding %q: Content-Length %s", acceptEncoding, length)
+		}
+		if got := w.Body.String(); got != body {
+			t.Errorf("Accept-Encoding %q: body %q", acceptEncoding, got)
+		}
+	}
+}
+
+func TestPassesGzipToClientsAcceptingIt(t *testing.T) {
+	const body = "hello, compressed world"
+	setupPool(t, gzipOnlyBackend(t, body).URL)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	lb(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); string(got) != body {
+		t.Errorf("body %q", got)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for value, want := range map[string]bool{
+		"":                false,
+		"gzip":            true,
+		"GZIP":            true,
+		"deflate, gzip":   true,
+		"gzip;q=0":        false,
+		"gzip; q=0.5":     true,
+		"*":               true,
+		"identity, *;q=0": false,
+		"br, deflate":     false,
+	} {
+		header := http.Header{}
+		if value != "" {
+			header.Set("Accept-Encoding", value)
+		}
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %t", value, got)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loadbalancer/backend"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Duration wraps time.Duration so that it is shown as "2m0s" in JSON
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string such as "10s"
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// tcpKeepAliveFlag parses -backend-tcp-keepalive into the keep-alive
+// interval of backend connections, where 0 disables the probes rather than
+// picking the default
+type tcpKeepAliveFlag struct {
+	interval *Duration
+}
+
+func (f tcpKeepAliveFlag) String() string {
+	if f.interval == nil {
+		return ""
+	}
+	if *f.interval < 0 {
+		return "0s"
+	}
+	return time.Duration(*f.interval).String()
+}
+
+func (f tcpKeepAliveFlag) Set(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		d = -1
+	}
+	*f.interval = Duration(d)
+	return nil
+}
+
+// Config holds the resolved configuration of the load balancer
+type Config struct {
+	Port                       int                `json:"port"`
+	TLSCert                    string             `json:"tls_cert,omitempty"`
+	TLSKey                     string             `json:"tls_key,omitempty"`
+	TLSOCSPStapling            bool               `json:"tls_ocsp_stapling"`
+	ServerReadTimeout          Duration           `json:"server_read_timeout"`
+	ServerReadHeaderTimeout    Duration           `json:"server_read_header_timeout"`
+	ServerWriteTimeout         Duration           `json:"server_write_timeout"`
+	MaxRequestHeaderBytes      int                `json:"max_request_header_bytes"`
+	TCPMode                    bool               `json:"tcp_mode"`
+	TCPDialTimeout             Duration           `json:"tcp_dial_timeout"`
+	Backends                   []BackendConfig    `json:"backends"`
+	SRVBackends                []string           `json:"srv_backends,omitempty"`
+	SRVRefreshInterval         Duration           `json:"srv_refresh_interval"`
+	Algorithm                  string             `json:"algorithm"`
+	HashHeader                 string             `json:"hash_header,omitempty"`
+	MaglevTableSize            int                `json:"maglev_table_size,omitempty"`
+	BackendDialTimeout         Duration           `json:"backend_dial_timeout"`
+	BackendIdleConnTimeout     Duration           `json:"backend_idle_conn_timeout"`
+	BackendKeepAliveInterval   Duration           `json:"backend_keep_alive_interval"`
+	MaxResponseHeaderBytes     int64              `json:"max_response_header_bytes"`
+	BackendUpgradeToTLS        bool               `json:"backend_upgrade_to_tls,omitempty"`
+	DrainTimeout               Duration           `json:"drain_timeout"`
+	WarmupDuration             Duration           `json:"warmup_duration,omitempty"`
+	HealthCheckInterval        Duration           `json:"health_check_interval"`
+	HealthCheckJitter          Duration           `json:"health_check_jitter"`
+	HealthCheckTimeout         Duration           `json:"health_check_timeout"`
+	HealthCheckAdaptiveTimeout bool               `json:"health_check_adaptive_timeout"`
+	HealthCheckPath            string             `json:"health_check_path,omitempty"`
+	HealthCheckUserAgent       string             `json:"health_check_user_agent"`
+	HealthCheckRetries         int                `json:"health_check_retries"`
+	FailureThreshold           int                `json:"failure_threshold"`
+	SuccessThreshold           int                `json:"success_threshold"`
+	HealthCheckRetryInterval   Duration           `json:"health_check_retry_interval"`
+	RequestTimeout             Duration           `json:"request_timeout"`
+	ResponseBodyTimeout        Duration           `json:"response_body_timeout"`
+	CircuitBreakerThreshold    float64            `json:"circuit_breaker_threshold"`
+	CircuitBreakerWindow       Duration           `json:"circuit_breaker_window"`
+	CircuitBreakerTimeout      Duration           `json:"circuit_breaker_timeout"`
+	MaxRetries                 int                `json:"max_retries"`
+	RetryDelay                 Duration           `json:"retry_delay"`
+	MaxAttempts                int                `json:"max_attempts"`
+	MaxRetryDelay              Duration           `json:"max_retry_delay"`
+	RespectUpstreamAttempts    bool               `json:"respect_upstream_attempts"`
+	FollowRedirects            int                `json:"follow_redirects"`
+	CompressUpstream           bool               `json:"compress_upstream"`
+	FlushInterval              Duration           `json:"flush_interval"`
+	BufferResponses            bool               `json:"buffer_responses"`
+	AutoWeight                 bool               `json:"auto_weight"`
+	AutoWeightDamp             float64            `json:"auto_weight_damp"`
+	H2Push                     bool               `json:"h2_push"`
+	ContentDigest              bool               `json:"content_digest"`
+	ResponseCodeMap            map[int]int        `json:"response_code_map,omitempty"`
+	Debug                      bool               `json:"debug"`
+	MaxBufferBody              int64              `json:"max_buffer_body"`
+	ProxyBufferSize            int                `json:"proxy_buffer_size"`
+	MaxResponseBody            int64              `json:"max_response_body,omitempty"`
+	MinAliveBackends           int                `json:"min_alive_backends"`
+	Zone                       string             `json:"zone,omitempty"`
+	ZoneFallback               bool               `json:"zone_fallback"`
+	Routes                     []Route            `json:"routes,omitempty"`
+	Ports                      map[int]PortConfig `json:"ports,omitempty"`
+	TracePropagation           string             `json:"trace_propagation"`
+	AccessLog                  bool               `json:"access_log"`
+	AccessLogSampleRate        float64            `json:"access_log_sample_rate"`
+	SlowRequestThreshold       Duration           `json:"slow_request_threshold"`
+	RateLimitCount             int                `json:"rate_limit_count"`
+	RateLimitWindow            Duration           `json:"rate_limit_window"`
+	RateLimitAlgorithm         string             `json:"rate_limit_algorithm"`
+	MaxConnsPerIP              int                `json:"max_conns_per_ip,omitempty"`
+	BackendMaxConcurrent       int                `json:"backend_max_concurrent,omitempty"`
+	QueueSize                  int                `json:"queue_size,omitempty"`
+	QueueTimeout               Duration           `json:"queue_timeout"`
+	ShedHeapPercent            float64            `json:"shed_heap_percent"`
+	ShedLoadAvg                float64            `json:"shed_load_avg,omitempty"`
+	ClientBandwidthLimit       int                `json:"client_bandwidth_limit,omitempty"`
+	ShadowBackends             []string           `json:"shadow_backends,omitempty"`
+	ShadowSampleRate           float64            `json:"shadow_sample_rate"`
+	CoalesceRequests           bool               `json:"coalesce_requests"`
+	CoalesceHeaders            []string           `json:"coalesce_headers,omitempty"`
+	AllowConnect               bool               `json:"allow_connect"`
+	ErrorContentType           string             `json:"error_content_type"`
+	ErrorBodyTemplate          string             `json:"error_body_template,omitempty"`
+	AlertWebhook               string             `json:"alert_webhook,omitempty"`
+	StateFile                  string             `json:"state_file,omitempty"`
+	AuditLogFile               string             `json:"audit_log_file,omitempty"`
+	MetricsPort                int                `json:"metrics_port,omitempty"`
+	StatsdAddr                 string             `json:"statsd_addr,omitempty"`
+	AdminPort                  int                `json:"admin_port,omitempty"`
+	AdminAPIKey                string             `json:"-"`
+	DryRun                     bool               `json:"-"`
+}
+
+// defaultConfig returns the configuration used when no flag overrides it
+func defaultConfig() Config {
+	return Config{
+		Port:                     3030,
+		ServerReadTimeout:        Duration(30 * time.Second),
+		ServerReadHeaderTimeout:  Duration(5 * time.Second),
+		ServerWriteTimeout:       Duration(30 * time.Second),
+		MaxRequestHeaderBytes:    http.DefaultMaxHeaderBytes,
+		TCPDialTimeout:           Duration(5 * time.Second),
+		SRVRefreshInterval:       Duration(30 * time.Second),
+		Algorithm:                "round-robin",
+		MaglevTableSize:          backend.DefaultMaglevTableSize,
+		BackendDialTimeout:       Duration(backend.DefaultDialTimeout),
+		BackendIdleConnTimeout:   Duration(backend.DefaultIdleConnTimeout),
+		BackendKeepAliveInterval: Duration(backend.DefaultKeepAliveInterval),
+		MaxResponseHeaderBytes:   backend.DefaultMaxResponseHeaderBytes,
+		DrainTimeout:             Duration(backend.DefaultDrainTimeout),
+		HealthCheckInterval:      Duration(2 * time.Minute),
+		HealthCheckRetries:       backend.DefaultHealthCheckRetries,
+		FailureThreshold:         1,
+		SuccessThreshold:         1,
+		HealthCheckRetryInterval: Duration(backend.DefaultHealthCheckRetryInterval),
+		HealthCheckTimeout:       Duration(backend.DefaultHealthCheckTimeout),
+		HealthCheckUserAgent:     backend.DefaultHealthCheckUserAgent,
+		CircuitBreakerThreshold:  0.5,
+		CircuitBreakerWindow:     Duration(backend.DefaultCircuitBreakerWindow),
+		CircuitBreakerTimeout:    Duration(backend.DefaultCircuitBreakerTimeout),
+		QueueTimeout:             Duration(10 * time.Second),
+		AutoWeightDamp:           backend.DefaultAutoWeightDamp,
+		MaxRetries:               3,
+		RetryDelay:               Duration(10 * time.Millisecond),
+		MaxAttempts:              3,
+		MaxRetryDelay:            Duration(5 * time.Second),
+		FlushInterval:            Duration(-1),
+		MaxBufferBody:            64 << 10,
+		ProxyBufferSize:          32 << 10,
+		ZoneFallback:             true,
+		TracePropagation:         "both",
+		ErrorContentType:         "text/plain; charset=utf-8",
+		AccessLogSampleRate:      1,
+		RateLimitWindow:          Duration(time.Second),
+		RateLimitAlgorithm:       "token-bucket",
+		ShedHeapPercent:          90,
+		ShadowSampleRate:         1,
+	}
+}
+
+// Validate returns every problem of the configuration, so that all of them
+// can be reported at once instead of applying part of it
+func (c *Config) Validate() []error {
+	var errs []error
+	for _, bc := range c.Backends {
+		u, err := url.Parse(bc.URL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backend %s: %s", bc.URL, err))
+		} else if u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("backend %s: URL must have a scheme and a host", bc.URL))
+		}
+		if bc.Weight < 1 {
+			errs = append(errs, fmt.Errorf("backend %s: weight must be a positive integer", bc.URL))
+		}
+	}
+	if _, err := backend.NewAlgorithm(c.Algorithm, backend.AlgorithmOptions{
+		HashHeader:      c.HashHeader,
+		MaglevTableSize: c.MaglevTableSize,
+	}); err != nil {
+		errs = append(errs, err)
+	}
+	for _, route := range c.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("route %s: prefix must start with /", route.Prefix))
+		}
+	}
+	for port, p := range c.Ports {
+		switch {
+		case c.TCPMode:
+			errs = append(errs, fmt.Errorf("listener %d: TCP mode serves a single port", port))
+		case port != p.Port:
+			errs = append(errs, fmt.Errorf("listener %d: port %d does not match", port, p.Port))
+		case port == c.Port || port == c.MetricsPort || port == c.AdminPort:
+			errs = append(errs, fmt.Errorf("listener %d: port already in use", port))
+		}
+		for _, route := range p.Routes {
+			if !strings.HasPrefix(route.Prefix, "/") {
+				errs = append(errs, fmt.Errorf("listener %d: route %s: prefix must start with /", port, route.Prefix))
+			}
+		}
+		for _, name := range p.Middleware {
+			if !middlewareNames[name] {
+				errs = append(errs, fmt.Errorf("listener %d: unknown middleware %q", port, name))
+			}
+		}
+	}
+	if _, ok := tracePropagationModes[c.TracePropagation]; !ok {
+		errs = append(errs, fmt.Errorf("unknown trace propagation %q", c.TracePropagation))
+	}
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		errs = append(errs, errors.New("access log sample rate must be between 0 and 1"))
+	}
+	if c.CircuitBreakerThreshold < 0 || c.CircuitBreakerThreshold > 1 {
+		errs = append(errs, errors.New("circuit breaker threshold must be between 0 and 1"))
+	}
+	if c.ShedHeapPercent < 0 || c.ShedHeapPercent > 100 {
+		errs = append(errs, errors.New("shed heap percent must be between 0 and 100"))
+	}
+	if c.ShadowSampleRate < 0 || c.ShadowSampleRate > 1 {
+		errs = append(errs, errors.New("shadow sample rate must be between 0 and 1"))
+	}
+	if c.RateLimitCount > 0 {
+		switch c.RateLimitAlgorithm {
+		case "token-bucket", "sliding-window":
+		default:
+			errs = append(errs, fmt.Errorf("unknown rate limit algorithm %q", c.RateLimitAlgorithm))
+		}
+		if c.RateLimitWindow <= 0 {
+			errs = append(errs, errors.New("rate limit window must be positive"))
+		}
+	}
+	if c.ErrorBodyTemplate != "" {
+		if _, err := template.New("error").Parse(c.ErrorBodyTemplate); err != nil {
+			errs = append(errs, fmt.Errorf("error body template: %s", err))
+		}
+	}
+	if c.ServerReadTimeout < 0 || c.ServerReadHeaderTimeout < 0 || c.ServerWriteTimeout < 0 {
+		errs = append(errs, errors.New("server timeouts must not be negative"))
+	}
+	if c.ResponseBodyTimeout < 0 {
+		errs = append(errs, errors.New("response body timeout must not be negative"))
+	}
+	if c.BackendMaxConcurrent < 0 || c.QueueSize < 0 {
+		errs = append(errs, errors.New("backend max concurrent and queue size must not be negative"))
+	}
+	if c.QueueSize > 0 && c.BackendMaxConcurrent == 0 {
+		errs = append(errs, errors.New("queue size needs backend max concurrent"))
+	}
+	if c.AutoWeight && c.Algorithm != "weighted-round-robin" {
+		errs = append(errs, errors.New("auto weight needs the weighted-round-robin algorithm"))
+	}
+	if c.AutoWeightDamp < 0 || c.AutoWeightDamp >= 1 {
+		errs = append(errs, fmt.Errorf("auto weight damp %v must be at least 0 and below 1", c.AutoWeightDamp))
+	}
+	if err := validateCodeMap(c.ResponseCodeMap); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ProxyBufferSize < 1 {
+		errs = append(errs, errors.New("proxy buffer size must be positive"))
+	}
+	if c.MaxRequestHeaderBytes < 1 {
+		errs = append(errs, errors.New("max request header bytes must be positive"))
+	}
+	if c.HealthCheckRetries < 1 {
+		errs = append(errs, errors.New("health check retries must be positive"))
+	}
+	if c.FailureThreshold < 1 || c.SuccessThreshold < 1 {
+		errs = append(errs, errors.New("health check thresholds must be positive"))
+	}
+	if c.MaxResponseHeaderBytes < 1 {
+		errs = append(errs, errors.New("max response header bytes must be positive"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls cert and tls key must be given together"))
+	}
+	if c.FollowRedirects < 0 {
+		errs = append(errs, errors.New("follow redirects must not be negative"))
+	}
+	ports := map[string]int{"port": c.Port, "metrics port": c.MetricsPort, "admin port": c.AdminPort}
+	for port := range c.Ports {
+		ports[fmt.Sprintf("listener %d", port)] = port
+	}
+	for name, port := range ports {
+		if port < 0 || port > 65535 {
+			errs = append(errs, fmt.Errorf("%s %d out of range", name, port))
+		}
+	}
+	return errs
+}
+
+// BackendConfig describes one backend given with -backends
+type BackendConfig struct {
+	URL    string `json:"url"`
+	Zone   string `json:"zone,omitempty"`
+	Weight int    `json:"weight"`
+	MaxRPS int    `json:"max_rps,omitempty"`
+	// RequestTimeout overrides -request-timeout for this backend
+	RequestTimeout Duration `json:"request_timeout,omitempty"`
+
+	HealthCheckType string   `json:"health_check_type,omitempty"`
+	HealthCheckCmd  []string `json:"health_check_cmd,omitempty"`
+	// HealthCheckSend and HealthCheckExpect are the probe of TCP health checks
+	HealthCheckSend   string `json:"health_check_send,omitempty"`
+	HealthCheckExpect string `json:"health_check_expect,omitempty"`
+	// ExpectedContentType starts the Content-Type of valid responses
+	ExpectedContentType string `json:"expected_content_type,omitempty"`
+	// ResponseHashHeader carries the SHA-256 of the response bodies
+	ResponseHashHeader string `json:"response_hash_header,omitempty"`
+	// SigningKey signs requests to the backend, kept out of the JSON output
+	SigningKey       string `json:"-"`
+	SigningAlgorithm string `json:"signing_algorithm,omitempty"`
+	// PinnedCertSHA256 is the hex SHA-256 of the public key of the backend
+	PinnedCertSHA256 string `json:"pinned_cert_sha256,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// envBackendPrefix starts the environment variables holding a backend
+const envBackendPrefix = "LB_BACKEND_"
+
+// envBackends returns the backend entries of the LB_BACKEND_<suffix>
+// environment variables ordered by suffix, numerically when both are numbers
+func envBackends() []string {
+	type envBackend struct{ suffix, spec string }
+	var found []envBackend
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)
+		if len(name) != 2 || !strings.HasPrefix(name[0], envBackendPrefix) || strings.TrimSpace(name[1]) == "" {
+			continue
+		}
+		found = append(found, envBackend{strings.TrimPrefix(name[0], envBackendPrefix), strings.TrimSpace(name[1])})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, errA := strconv.Atoi(found[i].suffix)
+		b, errB := strconv.Atoi(found[j].suffix)
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return found[i].suffix < found[j].suffix
+	})
+	specs := make([]string, len(found))
+	for i, b := range found {
+		specs[i] = b.spec
+	}
+	return specs
+}
+
+// parseBackendSpec parses a -backends entry. An entry is a URL optionally
+// followed by ";key=value" attributes, e.g. "http://10.0.0.1:80;zone=a".
+func parseBackendSpec(spec string) (*url.URL, BackendConfig, error) {
+	parts := strings.Split(spec, ";")
+	u, err := url.Parse(parts[0])
+	if err != nil {
+		return nil, BackendConfig{}, err
+	}
+	bc := BackendConfig{URL: u.String(), Weight: 1}
+	for _, attr := range parts[1:] {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, bc, fmt.Errorf("backend %s: malformed attribute %q", parts[0], attr)
+		}
+		switch kv[0] {
+		case "zone":
+			bc.Zone = kv[1]
+		case "weight":
+			bc.Weight, err = strconv.Atoi(kv[1])
+			if err != nil || bc.Weight < 1 {
+				return nil, bc, fmt.Errorf("backend %s: weight must be a positive integer", parts[0])
+			}
+		case "max-rps":
+			bc.MaxRPS, err = strconv.Atoi(kv[1])
+			if err != nil || bc.MaxRPS < 0 {
+				return nil, bc, fmt.Errorf("backend %s: max-rps must be a positive integer", parts[0])
+			}
+		case "timeout":
+			timeout, err := time.ParseDuration(kv[1])
+			if err != nil || timeout <= 0 {
+				return nil, bc, fmt.Errorf("backend %s: timeout must be a positive duration", parts[0])
+			}
+			bc.RequestTimeout = Duration(timeout)
+		case "sign-key":
+			bc.SigningKey = kv[1]
+		case "sign-alg":
+			if _, ok := signingAlgorithms[kv[1]]; !ok {
+				return nil, bc, fmt.Errorf("backend %s: unknown signing algorithm %q", parts[0], kv[1])
+			}
+			bc.SigningAlgorithm = kv[1]
+		case "content-type":
+			bc.ExpectedContentType = kv[1]
+		case "hash-header":
+			bc.ResponseHashHeader = http.CanonicalHeaderKey(kv[1])
+		case "pin-sha256":
+			pin, err := hex.DecodeString(kv[1])
+			if err != nil || len(pin) != sha256.Size {
+				return nil, bc, fmt.Errorf("backend %s: pin-sha256 must be a hex SHA-256", parts[0])
+			}
+			bc.PinnedCertSHA256 = hex.EncodeToString(pin)
+		case "health-send", "health-expect":
+			// Go escapes such as \r\n, \x00 or \x2c for a comma
+			probe, err := strconv.Unquote(`"` + kv[1] + `"`)
+			if err != nil {
+				return nil, bc, fmt.Errorf("backend %s: malformed %s %q", parts[0], kv[0], kv[1])
+			}
+			if kv[0] == "health-send" {
+				bc.HealthCheckSend = probe
+			} else {
+				bc.HealthCheckExpect = probe
+			}
+		case "health-type":
+			for _, typ := range backend.HealthCheckTypes {
+				if kv[1] == typ {
+					bc.HealthCheckType = typ
+				}
+			}
+			if bc.HealthCheckType == "" {
+				return nil, bc, fmt.Errorf("backend %s: health-type must be one of %s", parts[0], strings.Join(backend.HealthCheckTypes, ", "))
+			}
+		case "health-cmd":
+			bc.HealthCheckCmd = strings.Fields(kv[1])
+			if len(bc.HealthCheckCmd) == 0 {
+				return nil, bc, fmt.Errorf("backend %s: health-cmd must not be empty", parts[0])
+			}
+		default:
+			if key := strings.TrimPrefix(kv[0], "tag."); key != kv[0] && key != "" {
+				if bc.Tags == nil {
+					bc.Tags = make(map[string]string)
+				}
+				bc.Tags[key] = kv[1]
+				continue
+			}
+			return nil, bc, fmt.Errorf("backend %s: unknown attribute %q", parts[0], kv[0])
+		}
+	}
+	if bc.SigningKey != "" && bc.SigningAlgorithm == "" {
+		bc.SigningAlgorithm = "hmac-sha256"
+	}
+	if bc.SigningAlgorithm != "" && bc.SigningKey == "" {
+		return nil, bc, fmt.Errorf("backend %s: sign-alg needs a sign-key", parts[0])
+	}
+	if bc.HealthCheckType == backend.HealthCheckExec && len(bc.HealthCheckCmd) == 0 {
+		return nil, bc, fmt.Errorf("backend %s: health-type=exec needs a health-cmd", parts[0])
+	}
+	return u, bc, nil
+}
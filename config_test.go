@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestValidateHealthCheckRetriesAndThreshold(t *testing.T) {
+	for _, tt := range []struct {
+		retries, threshold int
+		valid              bool
+	}{
+		{1, 1, true},
+		{3, 1, true},
+		{1, 3, true},
+		{3, 3, true},
+		{0, 1, false},
+		{1, 0, false},
+	} {
+		c := defaultConfig()
+		c.HealthCheckRetries, c.FailureThreshold = tt.retries, tt.threshold
+		errs := c.Validate()
+		if valid := len(errs) == 0; valid != tt.valid {
+			t.Errorf("retries %d, threshold %d: errors %v", tt.retries, tt.threshold, errs)
+		}
+	}
+}
+
+func TestDryRunAcceptsRetriesWithThreshold(t *testing.T) {
+	if out, err := runMain(t, nil, "-dry-run", "-backends=http://10.0.0.1:3031", "-healthcheck-retries=3", "-healthcheck-failure-threshold=2"); err != nil {
+		t.Errorf("dry run rejected retries with a failure threshold: %s\n%s", err, out)
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	c := defaultConfig()
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Errorf("default configuration is invalid: %v", errs)
+	}
+}
+
+func TestTCPKeepAliveFlag(t *testing.T) {
+	var interval Duration
+	f := tcpKeepAliveFlag{&interval}
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"15s", 15 * time.Second},
+		{"0s", -1},
+		{"0", -1},
+	} {
+		if err := f.Set(tt.value); err != nil {
+			t.Fatalf("%s: %s", tt.value, err)
+		}
+		if time.Duration(interval) != tt.want {
+			t.Errorf("%s: interval %s, want %s", tt.value, time.Duration(interval), tt.want)
+		}
+	}
+	if f.String() != "0s" {
+		t.Errorf("disabled probes shown as %q", f.String())
+	}
+	if err := f.Set("often"); err == nil {
+		t.Error("malformed interval accepted")
+	}
+}
+
+func TestDryRunDisablesTCPKeepAlive(t *testing.T) {
+	out, err := runMain(t, nil, "-dry-run", "-backends=http://10.0.0.1:3031", "-backend-tcp-keepalive=0")
+	if err != nil {
+		t.Fatalf("dry run failed: %s", err)
+	}
+	var got Config
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("output is not JSON: %s\n%s", err, out)
+	}
+	if got.BackendKeepAliveInterval >= 0 {
+		t.Errorf("keep-alive interval is %s, want probes disabled", time.Duration(got.BackendKeepAliveInterval))
+	}
+}
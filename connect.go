@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connectDialTimeout bounds the dial of a CONNECT target
+const connectDialTimeout = 10 * time.Second
+
+// tunnel serves a CONNECT request by dialing the target host itself, not a
+// backend of the pool, and copying bytes both ways until one side closes
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s CONNECT %s\n", clientIP(r), r.Host)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "tunneling not supported")
+		return
+	}
+	target, err := net.DialTimeout("tcp", r.Host, connectDialTimeout)
+	if err != nil {
+		log.Printf("%s CONNECT %s failed: %s\n", clientIP(r), r.Host, err)
+		writeError(w, r, http.StatusBadGateway, "target unreachable")
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("%s CONNECT %s hijack failed: %s\n", clientIP(r), r.Host, err)
+		target.Close()
+		return
+	}
+	// written on the raw connection, net/http would add a transfer coding
+	// that a 2xx answer to CONNECT must not have
+	buf.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err := buf.Flush(); err != nil {
+		client.Close()
+		target.Close()
+		return
+	}
+
+	// bytes the client sent after its request headers belong to the target
+	if n := buf.Reader.Buffered(); n > 0 {
+		head, _ := buf.Reader.Peek(n)
+		if _, err := target.Write(head); err != nil {
+			client.Close()
+			target.Close()
+			return
+		}
+	}
+	go pipe(target, client)
+	go pipe(client, target)
+}
+
+// pipe copies src to dst and closes both once src is drained
+func pipe(dst, src net.Conn) {
+	defer dst.Close()
+	defer src.Close()
+	io.Copy(dst, src)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// topConnectionIPs is the number of client IPs reported by
+// lb_connections_per_ip_current
+const topConnectionIPs = 10
+
+// connCounter counts the open connections of each client IP. Counters are
+// removed once they reach zero, a removed counter is set to -1 so that it is
+// not taken again before it is gone from the map.
+type connCounter struct {
+	conns sync.Map // client IP to *int64
+}
+
+// acquire counts a new connection of ip and returns the connections of ip
+func (c *connCounter) acquire(ip string) int64 {
+	for {
+		v, _ := c.conns.LoadOrStore(ip, new(int64))
+		counter := v.(*int64)
+		for {
+			n := atomic.LoadInt64(counter)
+			if n < 0 {
+				break
+			}
+			if atomic.CompareAndSwapInt64(counter, n, n+1) {
+				return n + 1
+			}
+		}
+		// the counter is being removed, wait for it to be gone
+		runtime.Gosched()
+	}
+}
+
+// release counts a closed connection of ip
+func (c *connCounter) release(ip string) {
+	v, ok := c.conns.Load(ip)
+	if !ok {
+		return
+	}
+	counter := v.(*int64)
+	if atomic.AddInt64(counter, -1) == 0 && atomic.CompareAndSwapInt64(counter, 0, -1) {
+		c.conns.Delete(ip)
+	}
+}
+
+// clientConns is the number of open connections of a client IP
+type clientConns struct {
+	ip    string
+	conns int64
+}
+
+// report sends the busiest client IPs to the metrics sinks
+func (c *connCounter) report() {
+	var busiest []clientConns
+	c.conns.Range(func(k, v interface{}) bool {
+		if n := atomic.LoadInt64(v.(*int64)); n > 0 {
+			busiest = append(busiest, clientConns{k.(string), n})
+		}
+		return true
+	})
+	sort.Slice(busiest, func(i, j int) bool {
+		return busiest[i].conns > busiest[j].conns
+	})
+	if len(busiest) > topConnectionIPs {
+		busiest = busiest[:topConnectionIPs]
+	}
+	metrics.BusiestClients(busiest)
+}
+
+// run reports the busiest client IPs every interval
+func (c *connCounter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.report()
+	}
+}
+
+// overLimitKey is the context key set on connections above -max-conns-per-ip
+type overLimitKey struct{}
+
+// connIP returns the IP address of the remote end of conn
+func connIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// limitConns makes server count the connections of each client IP, the
+// requests of a connection above limit are answered by connLimitMiddleware
+func limitConns(server *http.Server, counter *connCounter, limit int) {
+	server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if counter.acquire(connIP(conn)) > int64(limit) {
+			return context.WithValue(ctx, overLimitKey{}, true)
+		}
+		return ctx
+	}
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			counter.release(connIP(conn))
+		}
+	}
+}
+
+// connLimitMiddleware replies 429 and closes connections above the limit
+func connLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if over, _ := r.Context().Value(overLimitKey{}).(bool); over {
+			log.Printf("%s(%s) Too many connections\n", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("Connection", "close")
+			writeError(w, r, http.StatusTooManyRequests, "too many connections")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"loadbalancer/backend"
+)
+
+// maxVerifiedBody bounds the response bodies read ahead to check their hash
+const maxVerifiedBody = 32 << 20
+
+// responseHashError is returned when the body of a backend response does
+// not have the SHA-256 of its ResponseHashHeader
+type responseHashError struct {
+	header, expected, got string
+	// tooLarge is set when the body exceeds maxVerifiedBody
+	tooLarge bool
+}
+
+func (e *responseHashError) Error() string {
+	if e.tooLarge {
+		return fmt.Sprintf("response body exceeds the %d bytes verified against %s", maxVerifiedBody, e.header)
+	}
+	return fmt.Sprintf("response body sha256 %s does not match %s %q", e.got, e.header, e.expected)
+}
+
+// verifyResponseHash reads the body of resp ahead and checks that it has
+// the SHA-256 announced in the ResponseHashHeader of b, in hex or base64,
+// possibly prefixed by sha-256= as in Digest and Content-Digest. The header
+// is removed from verified responses and replaced by a Content-Digest with
+// -content-digest.
+func verifyResponseHash(b *backend.Backend, resp *http.Response) error {
+	if b.ResponseHashHeader == "" || resp.Request.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	expected := resp.Header.Get(b.ResponseHashHeader)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxVerifiedBody+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > maxVerifiedBody {
+		return &responseHashError{header: b.ResponseHashHeader, expected: expected, tooLarge: true}
+	}
+	sum := sha256.Sum256(body)
+	if want, ok := parseHash(expected); !ok || !bytes.Equal(want, sum[:]) {
+		return &responseHashError{header: b.ResponseHashHeader, expected: expected, got: hex.EncodeToString(sum[:])}
+	}
+
+	resp.Header.Del(b.ResponseHashHeader)
+	if config.ContentDigest {
+		resp.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	return nil
+}
+
+// parseHash decodes a SHA-256 written in hex or base64
+func parseHash(value string) ([]byte, bool) {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexByte(value, '='); i > 0 && strings.EqualFold(value[:i], "sha-256") {
+		value = value[i+1:]
+	}
+	value = strings.Trim(value, ":")
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == sha256.Size {
+		return sum, true
+	}
+	if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == sha256.Size {
+		return sum, true
+	}
+	return nil, false
+}
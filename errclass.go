@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"loadbalancer/backend"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass tells what went wrong when a request to a backend failed
+type ErrorClass string
+
+const (
+	// ErrorDial means the backend could not be reached, nothing was sent
+	ErrorDial ErrorClass = "dial"
+	// ErrorTimeout means the backend was too slow to answer
+	ErrorTimeout ErrorClass = "timeout"
+	// ErrorReset means the backend closed the connection mid-request
+	ErrorReset ErrorClass = "reset"
+	// ErrorMidResponse means the backend broke the connection while sending
+	// the response, the request was processed
+	ErrorMidResponse ErrorClass = "mid-response-reset"
+	// ErrorTLS means the TLS handshake failed, usually a configuration issue
+	ErrorTLS ErrorClass = "tls"
+	// ErrorHeaderTooLarge means the response headers exceeded the limit
+	ErrorHeaderTooLarge ErrorClass = "header-too-large"
+	// ErrorResponseTooLarge means the response body exceeded the limit
+	ErrorResponseTooLarge ErrorClass = "response-too-large"
+	// ErrorContentType means the response was not of the expected type
+	ErrorContentType ErrorClass = "content-type"
+	// ErrorCertPinMismatch means the backend presented a public key other
+	// than its pinned one
+	ErrorCertPinMismatch ErrorClass = "cert-pin-mismatch"
+	// ErrorBodyTimeout means the backend stalled while sending the response
+	// body
+	ErrorBodyTimeout ErrorClass = "body-timeout"
+	// ErrorResponseHash means the response body did not have the hash
+	// announced by the backend
+	ErrorResponseHash ErrorClass = "response-hash"
+	// ErrorOther is any other error
+	ErrorOther ErrorClass = "other"
+)
+
+// classifyError returns the class of an error of the transport
+func classifyError(err error) ErrorClass {
+	if backend.IsResponseHeaderTooLarge(err) {
+		return ErrorHeaderTooLarge
+	}
+	var tooLarge *responseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return ErrorResponseTooLarge
+	}
+	var typeErr *contentTypeError
+	if errors.As(err, &typeErr) {
+		return ErrorContentType
+	}
+	var bodyTimeout *bodyTimeoutError
+	if errors.As(err, &bodyTimeout) {
+		return ErrorBodyTimeout
+	}
+	var hashErr *responseHashError
+	if errors.As(err, &hashErr) {
+		return ErrorResponseHash
+	}
+	var pinErr *backend.PinMismatchError
+	if errors.As(err, &pinErr) {
+		return ErrorCertPinMismatch
+	}
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ") ||
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		return ErrorTLS
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrorDial
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorMidResponse
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) {
+		return ErrorReset
+	}
+	return ErrorOther
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// defaultErrorTemplates are the error bodies used when -error-body-template
+// is not given, by content type
+var defaultErrorTemplates = map[string]string{
+	"text/plain":       "{{.Message}}\n",
+	"application/json": `{"error":"{{.Message}}","backend":"{{.Backend}}"}` + "\n",
+}
+
+// errorTemplate renders the bodies of the errors sent to clients
+var errorTemplate *template.Template
+
+// errorData holds the variables of the error body template
+type errorData struct {
+	Message    string
+	StatusCode int
+	Backend    string
+	RequestID  string
+}
+
+// parseErrorTemplate parses the error body template of the configuration
+func parseErrorTemplate() error {
+	text := config.ErrorBodyTemplate
+	if text == "" {
+		mediaType := strings.TrimSpace(strings.Split(config.ErrorContentType, ";")[0])
+		var ok bool
+		if text, ok = defaultErrorTemplates[mediaType]; !ok {
+			text = defaultErrorTemplates["text/plain"]
+		}
+	}
+	tmpl, err := template.New("error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("parsing -error-body-template: %s", err)
+	}
+	errorTemplate = tmpl
+	return nil
+}
+
+// writeError replies to the client with an error rendered from the template
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if errorTemplate == nil {
+		if entry := GetRequestLogFromContext(r); entry != nil {
+			entry.respond(status, false)
+		}
+		http.Error(w, message, status)
+		return
+	}
+	data := errorData{
+		Message:    message,
+		StatusCode: status,
+		RequestID:  r.Header.Get("X-Request-ID"),
+	}
+	if entry := GetRequestLogFromContext(r); entry != nil {
+		data.Backend = entry.Backend
+		if data.RequestID == "" {
+			data.RequestID = entry.ID
+		}
+		entry.respond(status, false)
+	}
+	var body bytes.Buffer
+	if err := errorTemplate.Execute(&body, data); err != nil {
+		log.Println("Rendering error body failed, err: ", err)
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", config.ErrorContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"loadbalancer/backend"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the optional middleware a port may enable
+const (
+	middlewareShadow    = "shadow"
+	middlewareRateLimit = "rate-limit"
+	middlewareBandwidth = "bandwidth-limit"
+	middlewareConnLimit = "conn-limit"
+	middlewareLoadShed  = "load-shed"
+	middlewareCoalesce  = "coalesce"
+)
+
+// middlewareNames are the middleware names known to PortConfig
+var middlewareNames = map[string]bool{
+	middlewareShadow:    true,
+	middlewareRateLimit: true,
+	middlewareBandwidth: true,
+	middlewareConnLimit: true,
+	middlewareLoadShed:  true,
+	middlewareCoalesce:  true,
+}
+
+// PortConfig describes a port served by the load balancer with its own
+// routes. All ports share the backends of serverPool and their health checks.
+type PortConfig struct {
+	Port   int     `json:"port"`
+	Routes []Route `json:"routes,omitempty"`
+	// Middleware names the optional middleware of the port, all the
+	// configured ones are used when it is nil
+	Middleware []string `json:"middleware"`
+}
+
+// enabled reports whether the port uses the middleware name
+func (p PortConfig) enabled(name string) bool {
+	if p.Middleware == nil {
+		return true
+	}
+	for _, m := range p.Middleware {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// portsFlag collects the ports given with -listen
+type portsFlag struct {
+	ports *map[int]PortConfig
+}
+
+func (f portsFlag) String() string {
+	if f.ports == nil {
+		return ""
+	}
+	var s []string
+	for _, p := range sortedPorts(*f.ports) {
+		spec := strconv.Itoa(p.Port)
+		if len(p.Routes) > 0 {
+			spec += ";routes=" + routeFlag{&p.Routes}.String()
+		}
+		if p.Middleware != nil {
+			spec += ";middleware=" + strings.Join(p.Middleware, ",")
+		}
+		s = append(s, spec)
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parses a port such as "8080;routes=/api/=pool=internal;middleware=",
+// routes are given as with -route-tag and separated by commas, an empty
+// middleware list disables all optional middleware
+func (f portsFlag) Set(v string) error {
+	parts := strings.Split(v, ";")
+	port, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("listener %q: %s is not a port", v, parts[0])
+	}
+	p := PortConfig{Port: port}
+	// a ";timeout=" belongs to the last route
+	var attrs []string
+	for _, part := range parts[1:] {
+		if len(attrs) > 0 && !strings.HasPrefix(part, "routes=") && !strings.HasPrefix(part, "middleware=") {
+			attrs[len(attrs)-1] += ";" + part
+			continue
+		}
+		attrs = append(attrs, part)
+	}
+	for _, attr := range attrs {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("listener %q: malformed attribute %q", v, attr)
+		}
+		switch kv[0] {
+		case "routes":
+			for _, route := range splitList(kv[1]) {
+				if err := (routeFlag{&p.Routes}).Set(route); err != nil {
+					return fmt.Errorf("listener %q: %s", v, err)
+				}
+			}
+		case "middleware":
+			p.Middleware = append([]string{}, splitList(kv[1])...)
+		default:
+			return fmt.Errorf("listener %q: unknown attribute %q", v, kv[0])
+		}
+	}
+	if *f.ports == nil {
+		*f.ports = make(map[int]PortConfig)
+	}
+	(*f.ports)[port] = p
+	return nil
+}
+
+// sortedPorts returns the ports ordered by number
+func sortedPorts(ports map[int]PortConfig) []PortConfig {
+	sorted := make([]PortConfig, 0, len(ports))
+	for _, p := range ports {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Port < sorted[j].Port })
+	return sorted
+}
+
+// sharedState holds what the servers of all ports share
+type sharedState struct {
+	mirror  *mirror
+	shedder *loadShedder
+	conns   *connCounter
+	// certs serves the certificate of ports using TLS, nil without TLS
+	certs *certLoader
+}
+
+// newHandler returns the handler of port p. Every port gets its own rate
+// limiters, so a client is limited separately on each port.
+func newHandler(p PortConfig, shared sharedState) (http.Handler, error) {
+	var handler http.Handler = http.HandlerFunc(lb)
+	if shared.mirror != nil && p.enabled(middlewareShadow) {
+		handler = shadowMiddleware(shared.mirror, handler)
+	}
+	if config.CoalesceRequests && p.enabled(middlewareCoalesce) {
+		handler = coalesceMiddleware(newCoalescer(config.CoalesceHeaders), handler)
+	}
+	if config.MaxBufferBody > 0 {
+		handler = bodyHashMiddleware(handler)
+		handler = bodyBufferingMiddleware(handler)
+	}
+	handler = deadlineMiddleware(time.Duration(config.RequestTimeout), handler)
+	if len(p.Routes) > 0 {
+		handler = routeMiddleware(p.Routes, handler)
+	}
+	handler = tracePropagationMiddleware(handler)
+	if config.RateLimitCount > 0 && p.enabled(middlewareRateLimit) {
+		limiter, err := newRateLimiter(config.RateLimitAlgorithm, config.RateLimitCount, time.Duration(config.RateLimitWindow))
+		if err != nil {
+			return nil, err
+		}
+		handler = rateLimitMiddleware(limiter, handler)
+	}
+	if config.ClientBandwidthLimit > 0 && p.enabled(middlewareBandwidth) {
+		limiter := newTokenBucketLimiter(config.ClientBandwidthLimit, time.Second)
+		handler = bandwidthMiddleware(limiter, handler)
+	}
+	if shared.conns != nil && p.enabled(middlewareConnLimit) {
+		handler = connLimitMiddleware(handler)
+	}
+	if shared.shedder != nil && p.enabled(middlewareLoadShed) {
+		handler = loadShedMiddleware(shared.shedder, handler)
+	}
+	return accessLogMiddleware(handler), nil
+}
+
+// newServer returns the server of port p
+func newServer(p PortConfig, shared sharedState) (*http.Server, error) {
+	handler, err := newHandler(p, shared)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", p.Port),
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.ServerReadTimeout),
+		ReadHeaderTimeout: time.Duration(config.ServerReadHeaderTimeout),
+		WriteTimeout:      time.Duration(config.ServerWriteTimeout),
+		MaxHeaderBytes:    config.MaxRequestHeaderBytes,
+	}
+	if shared.conns != nil && p.enabled(middlewareConnLimit) {
+		limitConns(server, shared.conns, config.MaxConnsPerIP)
+	}
+	if shared.certs != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: shared.certs.GetCertificate}
+	}
+	logRejectedRequests(server)
+	return server, nil
+}
+
+// trackedConn follows a connection for logRejectedRequests
+type trackedConn struct {
+	state http.ConnState
+	// since is when the server started waiting for request headers and
+	// read the bytes read from the connection before them
+	since time.Time
+	read  int64
+	// served is 1 once the headers of the current request arrived
+	served int32
+}
+
+// logRejectedRequests makes server log the connections it closes before
+// request headers arrived: those not sending them within ReadHeaderTimeout,
+// typically slowloris clients, and those answered 431 for headers larger
+// than MaxHeaderBytes. Connections closed while idle are not logged.
+func logRejectedRequests(server *http.Server) {
+	// keyed by remote address, TLS connections change once handshaken
+	var conns sync.Map
+	handler := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := conns.Load(r.RemoteAddr); ok {
+			atomic.StoreInt32(&c.(*trackedConn).served, 1)
+		}
+		handler.ServeHTTP(w, r)
+	})
+	next := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		addr := conn.RemoteAddr().String()
+		switch state {
+		case http.StateNew:
+			conns.Store(addr, &trackedConn{state: state, since: time.Now()})
+		case http.StateActive, http.StateIdle:
+			if v, ok := conns.Load(addr); ok {
+				c := v.(*trackedConn)
+				if state == http.StateActive && c.state == http.StateIdle {
+					c.since = time.Now()
+				}
+				if state == http.StateIdle {
+					// the server reads the headers of the next request
+					// before it is active again
+					c.read = bytesRead(conn)
+					atomic.StoreInt32(&c.served, 0)
+				}
+				c.state = state
+			}
+		case http.StateClosed:
+			if v, ok := conns.Load(addr); ok {
+				logRejected(server, addr, conn, v.(*trackedConn))
+			}
+			conns.Delete(addr)
+		default:
+			conns.Delete(addr)
+		}
+		if next != nil {
+			next(conn, state)
+		}
+	}
+}
+
+// logRejected logs why server closed conn, if it was waiting for headers
+func logRejected(server *http.Server, addr string, conn net.Conn, c *trackedConn) {
+	if c.state != http.StateNew && (c.state != http.StateActive || atomic.LoadInt32(&c.served) == 1) {
+		return
+	}
+	// http.Server stops reading 4096 bytes beyond MaxHeaderBytes
+	if size := bytesRead(conn) - c.read; c.state == http.StateActive && size > int64(server.MaxHeaderBytes) {
+		log.Printf("%s Answered 431, read about %d bytes of request headers larger than %d\n", addr, size, server.MaxHeaderBytes)
+		return
+	}
+	if server.ReadHeaderTimeout > 0 && time.Since(c.since) >= server.ReadHeaderTimeout {
+		log.Printf("%s Closed connection, request headers not received within %s\n", addr, server.ReadHeaderTimeout)
+	}
+}
+
+// bytesRead returns the bytes read from a connection accepted by serve
+func bytesRead(conn net.Conn) int64 {
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+	if counting, ok := conn.(*backend.CountingConn); ok {
+		return counting.BytesRead()
+	}
+	return 0
+}
+
+// countingListener counts the bytes read from its connections
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &backend.CountingConn{Conn: conn}, nil
+}
+
+// serve accepts connections of server, over TLS when it has a TLS config
+func serve(server *http.Server) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	ln = countingListener{ln}
+	if server.TLSConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
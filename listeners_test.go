@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer the log writes to while the test reads it
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the log to the returned buffer until the test ends
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	prev := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return buf
+}
+
+// startServer serves the load balancer with the current configuration on a
+// local port and returns its address. The handlers, including those of
+// hijacked connections, are done before the configuration is restored.
+func startServer(t *testing.T) string {
+	t.Helper()
+	server, err := newServer(PortConfig{}, sharedState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handlers sync.WaitGroup
+	handler := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handler.ServeHTTP(w, r)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(countingListener{l})
+	t.Cleanup(func() {
+		server.Close()
+		handlers.Wait()
+	})
+	return l.Addr().String()
+}
+
+func TestReadHeaderTimeoutClosesSlowClients(t *testing.T) {
+	setupPool(t, namedBackend(t, "a").URL)
+	config.ServerReadHeaderTimeout = Duration(1500 * time.Millisecond)
+	logs := captureLog(t)
+	addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a slowloris client, sending its headers a byte a second
+	start := time.Now()
+	closed := make(chan time.Duration, 1)
+	go func() {
+		for _, c := range []byte("GET / HTTP/1.1\r\nHost: lb\r\n\r\n") {
+			if _, err := conn.Write([]byte{c}); err != nil {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	go func() {
+		// the server gives up on the request, answering 400 before it
+		// closes the connection
+		reply := make([]byte, 512)
+		n, _ := conn.Read(reply)
+		if n > 0 && !strings.HasPrefix(string(reply[:n]), "HTTP/1.1 400 ") {
+			t.Errorf("server answered %q", reply[:n])
+		}
+		closed <- time.Since(start)
+	}()
+
+	select {
+	case took := <-closed:
+		if took < time.Second {
+			t.Errorf("connection closed after %s, before the timeout", took)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client still connected after 5s")
+	}
+	// logRejectedRequests logs once the server closed the connection
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "request headers not received within 1.5s") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout not logged:\n%s", logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadHeaderTimeoutSparesPromptClients(t *testing.T) {
+	setupPool(t, namedBackend(t, "a").URL)
+	config.ServerReadHeaderTimeout = Duration(time.Second)
+	addr := startServer(t)
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func TestLargeRequestHeadersAnswered431(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer backend.Close()
+	setupPool(t, backend.URL)
+	config.MaxRequestHeaderBytes = 4 << 10
+	logs := captureLog(t)
+	addr := startServer(t)
+
+	for _, tt := range []struct {
+		size int
+		code int
+	}{
+		{1 << 10, http.StatusOK},
+		// http.Server allows 4096 bytes on top of MaxHeaderBytes
+		{16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+		req.Header.Set("X-Custom-Header", strings.Repeat("x", tt.size))
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%d byte header: %s", tt.size, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%d byte header: status %d, want %d", tt.size, resp.StatusCode, tt.code)
+		}
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("backend got %d requests, want only the small one", hits)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "Answered 431") {
+		if time.Now().After(deadline) {
+			t.Fatalf("431 not logged:\n%s", logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loadShedRetryAfter is sent to clients whose request was shed, in seconds
+const loadShedRetryAfter = "5"
+
+// loadShedder watches the resources of the process and tells when the load
+// balancer should turn requests away to protect itself
+type loadShedder struct {
+	// heapPercent is the share of memLimit the heap may use
+	heapPercent float64
+	// memLimit is the memory available to the process, 0 when unknown
+	memLimit uint64
+	// loadAvg is the 1 minute load average above which requests are shed,
+	// 0 disables it
+	loadAvg float64
+	// shedding is 1 while requests are shed
+	shedding int32
+}
+
+// newLoadShedder returns a shedder for the limits, nil when no limit applies
+func newLoadShedder(heapPercent, loadAvg float64) *loadShedder {
+	s := &loadShedder{heapPercent: heapPercent, loadAvg: loadAvg}
+	if heapPercent > 0 {
+		s.memLimit = memoryLimit()
+		if s.memLimit == 0 {
+			log.Println("Memory limit unknown, not shedding load on heap usage")
+		}
+	}
+	if s.memLimit == 0 && loadAvg <= 0 {
+		return nil
+	}
+	return s
+}
+
+// run checks the resources every interval
+func (s *loadShedder) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.check()
+	}
+}
+
+// check starts or stops shedding depending on the current resources
+func (s *loadShedder) check() {
+	var reasons []string
+	if s.memLimit > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if used := float64(ms.HeapAlloc) / float64(s.memLimit) * 100; used > s.heapPercent {
+			reasons = append(reasons, "heap at "+strconv.FormatFloat(used, 'f', 1, 64)+"%")
+		}
+	}
+	if s.loadAvg > 0 {
+		if load, err := loadAverage(); err == nil && load > s.loadAvg {
+			reasons = append(reasons, "load average at "+strconv.FormatFloat(load, 'f', 2, 64))
+		}
+	}
+
+	shedding := int32(0)
+	if len(reasons) > 0 {
+		shedding = 1
+	}
+	if atomic.SwapInt32(&s.shedding, shedding) == shedding {
+		return
+	}
+	if shedding == 1 {
+		log.Printf("Shedding load, %s\n", strings.Join(reasons, ", "))
+	} else {
+		log.Println("Load back to normal, no longer shedding")
+	}
+}
+
+// Shedding reports whether requests should be turned away
+func (s *loadShedder) Shedding() bool {
+	return atomic.LoadInt32(&s.shedding) == 1
+}
+
+// loadShedMiddleware replies 503 while the shedder reports too much load
+func loadShedMiddleware(s *loadShedder, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Shedding() {
+			w.Header().Set("Retry-After", loadShedRetryAfter)
+			writeError(w, r, http.StatusServiceUnavailable, "service unavailable")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// memoryLimit returns the memory limit of the cgroup of the process, or
+// else the memory of the system, 0 when neither is known
+func memoryLimit() uint64 {
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if limit, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			return limit
+		}
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16310588 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// loadAverage returns the 1 minute load average of the system
+func loadAverage() (float64, error) {
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, errors.New("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
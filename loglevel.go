@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+)
+
+// logLevel is INFO, or DEBUG with -debug or after SIGUSR1
+var logLevel = new(slog.LevelVar)
+
+// debugf logs a message at the DEBUG level
+func debugf(format string, v ...interface{}) {
+	if logLevel.Level() <= slog.LevelDebug {
+		log.Printf(format, v...)
+	}
+}
+
+// toggleDebug switches the log level between INFO and DEBUG
+func toggleDebug() {
+	if logLevel.Level() <= slog.LevelDebug {
+		logLevel.Set(slog.LevelInfo)
+		log.Println("debug logging disabled")
+		return
+	}
+	logLevel.Set(slog.LevelDebug)
+	log.Println("debug logging enabled")
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// watchLogLevelSignal does nothing where there is no SIGUSR1
+func watchLogLevelSignal() {}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"loadbalancer/backend"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 )
@@ -16,6 +18,17 @@ import (
 const (
 	Attempts int = iota
 	Retry
+	RetryAfter
+	BodyUnbuffered
+	TraceHeaders
+	RequestLog
+	Timing
+	Priority
+	BackendDeadline
+	Pusher
+	UpstreamAttempts
+	BodyHash
+	PartialBackends
 )
 
 // GetAttemptsFromContext returns the attempts for reqeust
@@ -35,99 +48,519 @@ func GetRetryFromContext(r *http.Request) int {
 	return 0
 }
 
+// GetRetryAfterFromContext returns the last Retry-After sent by a backend
+func GetRetryAfterFromContext(r *http.Request) string {
+	if retryAfter, ok := r.Context().Value(RetryAfter).(string); ok {
+		return retryAfter
+	}
+	return ""
+}
+
+// serviceUnavailable replies 503, passing on the Retry-After of the backends
+func serviceUnavailable(w http.ResponseWriter, r *http.Request) {
+	if retryAfter := GetRetryAfterFromContext(r); retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	writeError(w, r, http.StatusServiceUnavailable, "service not available")
+}
+
 // lb load balances the incoming request
 func lb(w http.ResponseWriter, r *http.Request) {
-	attempts := GetAttemptsFromContext(r)
+	// attempts call lb again, only the first call sums up the request
+	if r.Context().Value(Attempts) == nil {
+		defer logTrace(r)
+		ctx := context.WithValue(r.Context(), Priority, requestPriority(r))
+		if config.RespectUpstreamAttempts {
+			ctx = context.WithValue(ctx, UpstreamAttempts, upstreamAttempts(r))
+		}
+		if config.H2Push {
+			if pusher := pusherOf(w); pusher != nil {
+				ctx = context.WithValue(ctx, Pusher, pusher)
+			}
+		}
+		r = r.WithContext(ctx)
+	}
+
+	if r.Method == http.MethodConnect {
+		if !config.AllowConnect {
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		tunnel(w, r)
+		return
+	}
 
-	if attempts > 3 {
+	// retries also count the attempts of upstream load balancers, which
+	// already retried the request
+	attempts := GetAttemptsFromContext(r)
+	if attempts > config.MaxAttempts || attempts > 1 && attempts+GetUpstreamAttemptsFromContext(r) > config.MaxAttempts {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "service not available", http.StatusServiceUnavailable)
+		serviceUnavailable(w, r)
 		return
 	}
 
-	peer := serverPool.GetNextPeer()
+	// a body a backend broke its response to goes to the other ones
+	if partial := GetPartialBackendsFromContext(r); len(partial) > 0 {
+		r = r.WithContext(backend.WithExcluded(r.Context(), partial...))
+	}
+
+	peer, err := serverPool.GetNextPeer(r)
+	for err == backend.ErrAtCapacity && queue != nil {
+		if err = queue.wait(r.Context(), GetPriorityFromContext(r)); err != nil {
+			break
+		}
+		peer, err = serverPool.GetNextPeer(r)
+	}
+	switch err {
+	case backend.ErrTooFewAlive:
+		log.Printf("%s(%s) Fewer than %d backends alive, rejecting\n", r.RemoteAddr, r.URL.Path, config.MinAliveBackends)
+		writeError(w, r, http.StatusServiceUnavailable, "service not available")
+		return
+	case backend.ErrAtCapacity, errQueueFull, errQueueTimeout:
+		log.Printf("%s(%s) All backends at capacity, %s\n", r.RemoteAddr, r.URL.Path, err)
+		writeError(w, r, http.StatusServiceUnavailable, "service not available")
+		return
+	case context.DeadlineExceeded:
+		writeError(w, r, http.StatusGatewayTimeout, "gateway timeout")
+		return
+	case context.Canceled:
+		return
+	}
+	if err == backend.ErrRateLimited {
+		log.Printf("%s(%s) All backends rate limited\n", r.RemoteAddr, r.URL.Path)
+		writeError(w, r, http.StatusTooManyRequests, "too many requests")
+		return
+	}
 	if peer != nil {
+		if entry := GetRequestLogFromContext(r); entry != nil {
+			entry.begin(peer.URL.String())
+		}
+		if peer.RequestTimeout > 0 {
+			ctx, cancel := backendContext(r.Context(), peer.RequestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
 		peer.ReverseProxy.ServeHTTP(w, r)
 		return
 	}
-	http.Error(w, "Service not available", http.StatusServiceUnavailable)
+	serviceUnavailable(w, r)
 }
 
-func healthCheck() {
-	t := time.NewTicker(time.Minute * 2)
-	for {
-		select {
-		case <-t.C:
-			log.Println("Starting health check...")
-			serverPool.HealthCheck()
-			log.Println("health check completed")
+// addBackend creates the backend described by bc and adds it to the pool,
+// it returns nil if the pool has it already
+func addBackend(serverUrl *url.URL, bc BackendConfig) *backend.Backend {
+	b := newBackend(serverUrl, bc)
+	if err := serverPool.AddBackend(b); err != nil {
+		log.Printf("Skipping server %s: %s\n", serverUrl, err)
+		return nil
+	}
+	if !config.DryRun {
+		log.Printf("Configured server: %s\n", serverUrl)
+	}
+	return b
+}
+
+// newBackend creates the backend described by bc
+func newBackend(serverUrl *url.URL, bc BackendConfig) *backend.Backend {
+	if config.BackendUpgradeToTLS && serverUrl.Scheme == "http" {
+		serverUrl.Scheme = "https"
+		log.Printf("Deprecated: backend %s upgraded to TLS by -backend-upgrade-to-tls, configure it as %s\n", bc.URL, serverUrl)
+	}
+	b := &backend.Backend{
+		URL:   serverUrl,
+		Alive: true,
+		Zone:  bc.Zone,
+		Tags:  bc.Tags,
+
+		HealthCheckType:     bc.HealthCheckType,
+		HealthCheckCmd:      bc.HealthCheckCmd,
+		HealthCheckSend:     []byte(bc.HealthCheckSend),
+		HealthCheckExpect:   []byte(bc.HealthCheckExpect),
+		PinnedCertSHA256:    bc.PinnedCertSHA256,
+		SigningKey:          bc.SigningKey,
+		SigningAlgorithm:    bc.SigningAlgorithm,
+		ExpectedContentType: bc.ExpectedContentType,
+		ResponseHashHeader:  bc.ResponseHashHeader,
+
+		DrainTimeout:             time.Duration(config.DrainTimeout),
+		WarmupDuration:           time.Duration(config.WarmupDuration),
+		RequestTimeout:           time.Duration(bc.RequestTimeout),
+		MaxConcurrentRequests:    config.BackendMaxConcurrent,
+		HealthCheckRetries:       config.HealthCheckRetries,
+		HealthCheckRetryInterval: time.Duration(config.HealthCheckRetryInterval),
+	}
+	if !config.TCPMode {
+		b.ReverseProxy = newProxy(b)
+	}
+	b.SetWeight(bc.Weight)
+	b.SetMaxRPS(bc.MaxRPS)
+	return b
+}
+
+// splitList splits a comma separated flag, leaving out empty entries
+func splitList(list string) []string {
+	var entries []string
+	for _, tok := range strings.Split(list, ",") {
+		if tok = strings.TrimSpace(tok); tok != "" {
+			entries = append(entries, tok)
 		}
 	}
+	return entries
 }
 
-var serverPool backend.ServerPool
+// isFlagSet reports whether the named flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+var serverPool *backend.ServerPool
+
+var config = defaultConfig()
 
 func main() {
-	var serverList string
-	var port int
+	var serverList, tcpServerList, srvList, shadowList, coalesceHeaders string
+	// "generate-alerts" writes alerting rules for the configured backends
+	// instead of serving
+	generateAlerts := len(os.Args) > 1 && os.Args[1] == generateAlertsCommand
+	if generateAlerts {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	var alertsOutput string
 	// get server list from command line
-	flag.StringVar(&serverList, "backends", "", "Load balanced backends, use commas to separate")
-	flag.IntVar(&port, "port", 3030, "Port to serve")
+	flag.StringVar(&serverList, "backends", "", "Load balanced backends, added to those of the LB_BACKEND_<n> environment variables, use commas to separate and ;zone=<zone>, ;weight=<n>, ;max-rps=<n>, ;content-type=<type>, ;pin-sha256=<hex> or ;tag.<key>=<value> to set backend attributes")
+	flag.StringVar(&srvList, "srv-backends", "", "SRV records such as _http._tcp.example.com whose targets are load balanced, use commas to separate")
+	flag.DurationVar((*time.Duration)(&config.SRVRefreshInterval), "srv-refresh-interval", time.Duration(config.SRVRefreshInterval), "Interval between resolutions of the SRV records")
+	flag.StringVar(&tcpServerList, "tcp-backends", "", "Backends of the TCP proxy mode as host:port, use commas to separate and ;health-send=<bytes> or ;health-expect=<bytes> to check them with a probe")
+	flag.DurationVar((*time.Duration)(&config.TCPDialTimeout), "tcp-dial-timeout", time.Duration(config.TCPDialTimeout), "Timeout of dialing a backend in TCP proxy mode")
+	flag.IntVar(&config.Port, "port", config.Port, "Port to serve")
+	flag.DurationVar((*time.Duration)(&config.ServerReadTimeout), "server-read-timeout", time.Duration(config.ServerReadTimeout), "Time a client may take to send a request with its body, 0 for no limit")
+	flag.DurationVar((*time.Duration)(&config.ServerReadHeaderTimeout), "server-read-header-timeout", time.Duration(config.ServerReadHeaderTimeout), "Time a client may take to send the headers of a request, 0 for -server-read-timeout")
+	flag.DurationVar((*time.Duration)(&config.ServerWriteTimeout), "server-write-timeout", time.Duration(config.ServerWriteTimeout), "Time from the end of the request headers to the end of the response, 0 for no limit as long streaming responses such as server-sent events need")
+	flag.IntVar(&config.MaxRequestHeaderBytes, "max-request-header-bytes", config.MaxRequestHeaderBytes, "Largest request headers accepted from a client, larger ones are answered with 431")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "Certificate file of HTTPS clients, reloaded when it changes")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "Private key file of -tls-cert")
+	flag.BoolVar(&config.TLSOCSPStapling, "tls-ocsp-stapling", false, "Staple the OCSP response of the responder named in -tls-cert to TLS handshakes")
+	flag.StringVar(&config.Algorithm, "algorithm", config.Algorithm, "Load balancing algorithm: round-robin, weighted-round-robin, rendezvous, maglev or sticky-url-hash")
+	flag.StringVar(&config.HashHeader, "hash-header", "", "Request header used as key by hashing algorithms, defaults to the client IP")
+	flag.IntVar(&config.MaglevTableSize, "maglev-table-size", config.MaglevTableSize, "Size of the maglev lookup table, must be prime")
+	flag.StringVar(&config.HealthCheckPath, "healthcheck-path", "", "Path checked with an HTTP GET instead of a TCP dial")
+	flag.DurationVar((*time.Duration)(&config.BackendDialTimeout), "backend-dial-timeout", time.Duration(config.BackendDialTimeout), "Timeout of connecting to a backend")
+	flag.DurationVar((*time.Duration)(&config.BackendIdleConnTimeout), "backend-idle-conn-timeout", time.Duration(config.BackendIdleConnTimeout), "Time after which idle connections to backends are closed, set it below the idle timeout of the backends")
+	flag.DurationVar((*time.Duration)(&config.BackendKeepAliveInterval), "backend-keep-alive-interval", time.Duration(config.BackendKeepAliveInterval), "Interval between TCP keep-alive probes of backend connections, negative disables them")
+	flag.Var(tcpKeepAliveFlag{&config.BackendKeepAliveInterval}, "backend-tcp-keepalive", "Interval between TCP keep-alive probes of backend connections, 0 disables them")
+	flag.BoolVar(&config.BackendUpgradeToTLS, "backend-upgrade-to-tls", false, "Connect to http:// backends over TLS, verifying their certificate or pin-sha256, while migrating them to https://")
+	flag.Int64Var(&config.MaxResponseHeaderBytes, "max-response-header-bytes", config.MaxResponseHeaderBytes, "Largest response headers accepted from a backend, larger ones are answered with 502")
+	flag.BoolVar(&config.AutoWeight, "auto-weight", false, "Scale the weights of backends every 10s by the inverse of their P95 latency, with weighted-round-robin")
+	flag.Float64Var(&config.AutoWeightDamp, "auto-weight-damp", config.AutoWeightDamp, "Share of its previous dynamic weight a backend keeps at each -auto-weight adjustment")
+	flag.DurationVar((*time.Duration)(&config.WarmupDuration), "backend-warmup", 0, "Time a recovered backend takes to ramp from 5% to its full weight with weighted-round-robin, 0 disables")
+	flag.Float64Var(&config.CircuitBreakerThreshold, "cb-threshold", config.CircuitBreakerThreshold, "Share of failed requests of a backend in a window above which its circuit opens, 0 disables circuit breakers")
+	flag.DurationVar((*time.Duration)(&config.CircuitBreakerWindow), "cb-window", time.Duration(config.CircuitBreakerWindow), "Window failed requests are counted in by circuit breakers")
+	flag.DurationVar((*time.Duration)(&config.CircuitBreakerTimeout), "cb-timeout", time.Duration(config.CircuitBreakerTimeout), "Time an open circuit waits before letting a probe request through")
+	flag.DurationVar((*time.Duration)(&config.DrainTimeout), "drain-timeout", time.Duration(config.DrainTimeout), "Time given to in-flight requests when a backend is removed")
+	flag.DurationVar((*time.Duration)(&config.HealthCheckTimeout), "healthcheck-timeout", time.Duration(config.HealthCheckTimeout), "Timeout of a single health check")
+	flag.BoolVar(&config.HealthCheckAdaptiveTimeout, "healthcheck-adaptive-timeout", false, "Start health checks with a 500ms timeout doubled on every consecutive failure up to 10s, instead of -healthcheck-timeout")
+	flag.DurationVar((*time.Duration)(&config.HealthCheckJitter), "healthcheck-jitter", 0, "Maximum random delay added to each health check, defaults to 10% of the interval")
+	flag.IntVar(&config.HealthCheckRetries, "healthcheck-retries", config.HealthCheckRetries, "Attempts of each health check, -healthcheck-retry-interval apart, the check fails once all of them failed")
+	flag.IntVar(&config.FailureThreshold, "healthcheck-failure-threshold", config.FailureThreshold, "Periodic health checks failing in a row that mark a backend down, each made of -healthcheck-retries attempts")
+	flag.IntVar(&config.SuccessThreshold, "healthcheck-success-threshold", config.SuccessThreshold, "Periodic health checks succeeding in a row that mark a backend up")
+	flag.DurationVar((*time.Duration)(&config.HealthCheckRetryInterval), "healthcheck-retry-interval", time.Duration(config.HealthCheckRetryInterval), "Delay between the retries of a failed health check")
+	flag.StringVar(&config.HealthCheckUserAgent, "healthcheck-user-agent", config.HealthCheckUserAgent, "User-Agent sent with HTTP health checks")
+	flag.DurationVar((*time.Duration)(&config.MaxRetryDelay), "max-retry-delay", time.Duration(config.MaxRetryDelay), "Longest Retry-After of a backend 503 waited for before trying the next backend")
+	flag.IntVar(&config.FollowRedirects, "follow-redirects", 0, "Redirects to backends of the pool followed by the load balancer before answering, 0 passes them to clients")
+	flag.BoolVar(&config.CompressUpstream, "compress-upstream", false, "Gzip request bodies for backends whose health check answers Accept-Encoding: gzip and decompress them for the others")
+	flag.BoolVar(&config.ContentDigest, "content-digest", false, "Send a Content-Digest header with the responses whose hash was verified")
+	flag.BoolVar(&config.H2Push, "h2-push", false, "Push the resources preloaded by the Link headers of backend responses to HTTP/2 clients")
+	flag.Var(codeMapFlag{&config.ResponseCodeMap}, "response-code-map", "Codes of backend responses rewritten for clients, as <from>=<to> separated by commas, e.g. 500=503")
+	flag.BoolVar(&config.Debug, "debug", false, "Log debug messages, SIGUSR1 toggles them at runtime")
+	flag.BoolVar(&config.BufferResponses, "buffer-responses", false, "Write responses to clients through the server buffer, flushing only when it is full or at the end, instead of -flush-interval")
+	flag.DurationVar((*time.Duration)(&config.FlushInterval), "flush-interval", time.Duration(config.FlushInterval), "Interval between flushes of responses to clients, -1 flushes every write and 0 only at the end")
+	flag.Int64Var(&config.MaxResponseBody, "max-response-body", 0, "Largest response body in bytes passed on from a backend, larger ones are answered with 502 or cut off, 0 for no limit")
+	flag.IntVar(&config.ProxyBufferSize, "proxy-buffer-size", config.ProxyBufferSize, "Size in bytes of the buffers response bodies are copied to clients with, larger ones take fewer system calls for large responses")
+	flag.Int64Var(&config.MaxBufferBody, "max-buffer-body", config.MaxBufferBody, "Largest request body kept in memory to be replayed on retries, 0 disables buffering")
+	flag.IntVar(&config.MinAliveBackends, "min-alive-backends", 0, "Reject all requests with 503 while fewer backends are alive, 0 disables")
+	flag.StringVar(&config.Zone, "lb-zone", "", "Zone of the load balancer, backends in this zone are preferred")
+	flag.BoolVar(&config.ZoneFallback, "zone-fallback", config.ZoneFallback, "Use backends of other zones when none in -lb-zone is alive")
+	flag.Var(portsFlag{&config.Ports}, "listen", "Additional port with its own routes and optional middleware, as 8080;routes=/api/=pool=internal;middleware=load-shed, may be repeated")
+	flag.Var(routeFlag{&config.Routes}, "route-tag", "Send requests below a path prefix to backends with a tag, as /prefix/=key=value, with an optional ;timeout=<duration> overriding -request-timeout, may be repeated")
+	flag.DurationVar((*time.Duration)(&config.RequestTimeout), "request-timeout", 0, "Time a request may take across all its attempts, 0 for no limit")
+	flag.DurationVar((*time.Duration)(&config.ResponseBodyTimeout), "response-body-timeout", 0, "Time a backend may take to send the next part of a response body once its headers arrived, 0 for no limit")
+	flag.StringVar(&config.TracePropagation, "trace-propagation", config.TracePropagation, "Tracing headers forwarded to backends: w3c, b3, both or none")
+	flag.BoolVar(&config.AccessLog, "access-log", false, "Log a line for every request")
+	flag.Float64Var(&config.AccessLogSampleRate, "access-log-sample-rate", config.AccessLogSampleRate, "Share of requests written to the access log, failed and retried requests are always logged")
+	flag.DurationVar((*time.Duration)(&config.SlowRequestThreshold), "slow-request-threshold", 0, "Only write requests taking at least this long to the access log, 0 disables")
+	flag.IntVar(&config.RateLimitCount, "rate-limit-count", 0, "Requests allowed per client IP in -rate-limit-window, 0 disables rate limiting")
+	flag.DurationVar((*time.Duration)(&config.RateLimitWindow), "rate-limit-window", time.Duration(config.RateLimitWindow), "Window of the per client rate limit")
+	flag.StringVar(&config.RateLimitAlgorithm, "rate-limit-algorithm", config.RateLimitAlgorithm, "Rate limit algorithm: token-bucket or sliding-window")
+	flag.StringVar(&shadowList, "shadow-backends", "", "Backends receiving a copy of the requests whose responses are discarded, use commas to separate")
+	flag.BoolVar(&config.RespectUpstreamAttempts, "respect-upstream-attempts", false, "Count the X-LB-Attempts of requests from another load balancer against the max attempts and send the count to backends")
+	flag.BoolVar(&config.CoalesceRequests, "coalesce", false, "Let GET requests identical to one in flight wait for its response instead of reaching a backend")
+	flag.StringVar(&coalesceHeaders, "coalesce-headers", defaultCoalesceHeaders, "Request headers that must be equal for GET requests to be coalesced, use commas to separate")
+	flag.Float64Var(&config.ShadowSampleRate, "shadow-sample-rate", config.ShadowSampleRate, "Fraction of the requests mirrored to the shadow backends")
+	flag.IntVar(&config.MaxConnsPerIP, "max-conns-per-ip", 0, "Open connections allowed per client IP, 0 for no limit")
+	flag.IntVar(&config.BackendMaxConcurrent, "backend-max-concurrent", 0, "Requests in flight to a backend above which it is passed over, 0 for no limit")
+	flag.IntVar(&config.QueueSize, "queue-size", 0, "Requests waiting for a backend below -backend-max-concurrent, served by their X-Priority of high, normal or low, 0 answers 503 right away")
+	flag.DurationVar((*time.Duration)(&config.QueueTimeout), "queue-timeout", time.Duration(config.QueueTimeout), "Time a request may wait in the queue before it is answered 503")
+	flag.Float64Var(&config.ShedHeapPercent, "shed-heap-percent", config.ShedHeapPercent, "Share of the available memory used by the heap above which requests are answered 503, 0 disables")
+	flag.Float64Var(&config.ShedLoadAvg, "shed-load-avg", 0, "1 minute load average above which requests are answered 503, 0 disables")
+	flag.IntVar(&config.ClientBandwidthLimit, "client-bandwidth-limit", 0, "Bytes per second of responses sent to each client IP, 0 for no limit")
+	flag.BoolVar(&config.AllowConnect, "allow-connect", false, "Tunnel CONNECT requests to their target host, beware this lets clients reach any host the load balancer can")
+	flag.StringVar(&config.ErrorContentType, "error-content-type", config.ErrorContentType, "Content-Type of the error responses sent to clients")
+	flag.StringVar(&config.ErrorBodyTemplate, "error-body-template", "", "Go template of error response bodies with .Message, .StatusCode, .Backend and .RequestID")
+	flag.StringVar(&config.AlertWebhook, "alert-webhook", "", "URL receiving a JSON POST when the share of 5xx responses of a backend crosses 5%")
+	flag.StringVar(&config.StateFile, "state-file", "", "File keeping the status of the backends across restarts")
+	flag.StringVar(&config.AuditLogFile, "audit-log-file", "", "File receiving a JSON line for every backend status change")
+	flag.IntVar(&config.MetricsPort, "metrics-port", 0, "Port serving Prometheus metrics on /metrics, 0 disables")
+	flag.StringVar(&config.StatsdAddr, "statsd-addr", "", "DogStatsD address receiving metrics, e.g. localhost:8125")
+	flag.IntVar(&config.AdminPort, "admin-port", 0, "Port serving the admin API, 0 disables")
+	flag.StringVar(&config.AdminAPIKey, "admin-api-key", "", "Key admin API requests must send as Authorization: Bearer <key>")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Print the resolved configuration as JSON and exit")
+	flag.StringVar(&alertsOutput, "alerts-output", "alerts.yml", "File written by the generate-alerts subcommand, - for the standard output")
 	flag.Parse()
+	if !isFlagSet("healthcheck-jitter") {
+		config.HealthCheckJitter = config.HealthCheckInterval / 10
+	}
+
+	if tcpServerList != "" {
+		if serverList != "" {
+			log.Fatal("-backends and -tcp-backends cannot be used together")
+		}
+		config.TCPMode = true
+		serverList = tcpServerList
+	}
+	envList := envBackends()
+	if len(serverList) == 0 && len(envList) == 0 && srvList == "" {
+		log.Fatal("Please provide one or more backends to load balance")
+	}
+	config.SRVBackends = splitList(srvList)
+	if config.TCPMode && len(config.SRVBackends) > 0 {
+		log.Fatal("-srv-backends cannot be used with -tcp-backends")
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Println("Invalid configuration: ", err)
+		}
+		os.Exit(1)
+	}
+	if err := parseErrorTemplate(); err != nil {
+		log.Fatal(err)
+	}
+
+	algorithm, err := backend.NewAlgorithm(config.Algorithm, backend.AlgorithmOptions{
+		HashHeader:      config.HashHeader,
+		MaglevTableSize: config.MaglevTableSize,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverPool = backend.NewServerPool(context.Background(),
+		backend.WithAlgorithm(algorithm),
+		backend.WithHealthCheckInterval(time.Duration(config.HealthCheckInterval), time.Duration(config.HealthCheckJitter)),
+		backend.WithHealthCheckTimeout(time.Duration(config.HealthCheckTimeout)),
+		backend.WithFailureThreshold(config.FailureThreshold),
+		backend.WithSuccessThreshold(config.SuccessThreshold),
+		backend.WithMinAliveBackends(config.MinAliveBackends),
+	)
+	serverPool.ResponseCodeMap = config.ResponseCodeMap
+	proxyBuffers = newBufferPool(config.ProxyBufferSize)
+	if config.Debug {
+		logLevel.Set(slog.LevelDebug)
+	}
+	watchLogLevelSignal()
+	if !config.TCPMode {
+		serverPool.ProxyFactory = newProxy
+	}
+	if !config.TCPMode {
+		// TCP backends may not speak HTTP, keep their health checks a TCP dial
+		serverPool.HealthCheckPath = config.HealthCheckPath
+	}
+	serverPool.HealthCheckUserAgent = config.HealthCheckUserAgent
+	serverPool.AdaptiveHealthCheckTimeout = config.HealthCheckAdaptiveTimeout
+	serverPool.DialTimeout = time.Duration(config.BackendDialTimeout)
+	serverPool.IdleConnTimeout = time.Duration(config.BackendIdleConnTimeout)
+	serverPool.KeepAliveInterval = time.Duration(config.BackendKeepAliveInterval)
+	serverPool.MaxResponseHeaderBytes = config.MaxResponseHeaderBytes
+	if !config.TCPMode {
+		serverPool.CircuitBreakerThreshold = config.CircuitBreakerThreshold
+	}
+	serverPool.CircuitBreakerWindow = time.Duration(config.CircuitBreakerWindow)
+	serverPool.CircuitBreakerTimeout = time.Duration(config.CircuitBreakerTimeout)
+	serverPool.OnCircuitChange = observeCircuit
+	serverPool.Zone = config.Zone
+	serverPool.ZoneFallback = config.ZoneFallback
+	serverPool.OnHealthCheck = observeHealthCheck
+
+	// parse servers, those of the environment first so that they take
+	// precedence over the same URLs in -backends
+	for _, tok := range append(envList, splitList(serverList)...) {
+		if config.TCPMode && !strings.Contains(tok, "://") {
+			tok = "tcp://" + tok
+		}
+		serverUrl, bc, err := parseBackendSpec(tok)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if addBackend(serverUrl, bc) == nil {
+			continue
+		}
+		bc.URL = serverUrl.String()
+		config.Backends = append(config.Backends, bc)
+	}
 
-	if len(serverList) == 0 {
+	var discovery *srvDiscovery
+	if len(config.SRVBackends) > 0 {
+		discovery = &srvDiscovery{names: config.SRVBackends}
+		if err := discovery.refresh(); err != nil {
+			log.Println("Resolving SRV backends failed, err: ", err)
+		}
+	}
+	if len(serverPool.Backends()) == 0 {
 		log.Fatal("Please provide one or more backends to load balance")
 	}
 
-	// parse servers
-	tokens := strings.Split(serverList, ",")
-	for _, tok := range tokens {
-		serverUrl, err := url.Parse(tok)
+	config.ShadowBackends = splitList(shadowList)
+	if config.CoalesceRequests {
+		config.CoalesceHeaders = splitList(coalesceHeaders)
+	}
+
+	if generateAlerts {
+		if err := writeAlertRules(alertsOutput); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// print what would be served and stop before binding any port
+	if config.DryRun {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var shared sharedState
+	if len(config.ShadowBackends) > 0 && !config.TCPMode {
+		shared.mirror, err = newMirror(config.ShadowBackends, config.ShadowSampleRate)
 		if err != nil {
-			log.Fatal()
-		}
-
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
-		// ErrorHandler for proxy
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			// retry
-			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-			retires := GetRetryFromContext(request)
-			if retires < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retires+1)
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-				}
-				return
-			}
-			// change the status of `serverUrl` backend
-			serverPool.MarkBackendStatus(serverUrl, false)
-			//  attempt to connect
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-			lb(writer, request.WithContext(ctx))
-		}
-		// add backend in serverPool
-		serverPool.AddBackend(&backend.Backend{
-			URL:          serverUrl,
-			Alive:        true,
-			ReverseProxy: proxy,
-		})
-		log.Printf("Configured server: %s\n", serverUrl)
+			log.Fatal(err)
+		}
+	}
+	if config.MaxConnsPerIP > 0 {
+		shared.conns = &connCounter{}
+		go shared.conns.run(5 * time.Second)
+	}
+	if config.TLSCert != "" && !config.TCPMode {
+		shared.certs, err = newCertLoader(config.TLSCert, config.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go shared.certs.watch(certWatchInterval)
+		if config.TLSOCSPStapling {
+			go shared.certs.staple()
+		}
+	}
+	if config.QueueSize > 0 && !config.TCPMode {
+		queue = newRequestQueue(config.QueueSize, time.Duration(config.QueueTimeout))
+	}
+	if config.AutoWeight && !config.TCPMode {
+		go serverPool.RunAutoWeight(config.AutoWeightDamp)
 	}
+	if shared.shedder = newLoadShedder(config.ShedHeapPercent, config.ShedLoadAvg); shared.shedder != nil {
+		go shared.shedder.run(5 * time.Second)
+	}
+
+	if config.MetricsPort > 0 {
+		metrics = append(metrics, prometheusSink{})
+	}
+	if config.StatsdAddr != "" {
+		sink, err := newStatsdSink(config.StatsdAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metrics = append(metrics, sink)
+	}
+	if config.StateFile != "" {
+		if err := loadState(config.StateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, b := range serverPool.Backends() {
+		metrics.BackendUp(b.URL.String(), b.IsAlive())
+	}
+
+	var audit *auditLog
+	if config.AuditLogFile != "" {
+		audit, err = openAuditLog(config.AuditLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	serverPool.OnTransition = func(t backend.Transition) {
+		metrics.BackendUp(t.Backend, t.To == "up")
+		if audit != nil {
+			audit.Record(t)
+		}
+		if config.StateFile != "" {
+			go saveState(config.StateFile)
+		}
+	}
+	if config.StateFile != "" {
+		go saveStatePeriodically(config.StateFile)
+	}
+
 	// create http
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(lb),
+	server, err := newServer(PortConfig{Port: config.Port, Routes: config.Routes}, shared)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// start health checking
-	go healthCheck()
+	go serverPool.StartHealthChecks()
+	if discovery != nil {
+		go discovery.run(time.Duration(config.SRVRefreshInterval))
+	}
+
+	if config.AdminPort > 0 {
+		go func() {
+			log.Printf("Admin API served at :%d/admin\n", config.AdminPort)
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.AdminPort), adminAuthMiddleware(adminHandler())))
+		}()
+	}
+
+	if config.MetricsPort > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler())
+		go func() {
+			log.Printf("Metrics served at :%d/metrics\n", config.MetricsPort)
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.MetricsPort), mux))
+		}()
+	}
+
+	if config.TCPMode {
+		log.Printf("TCP Load Balancer started at :%d\n", config.Port)
+		log.Fatal(serveTCP(fmt.Sprintf(":%d", config.Port), shared.conns))
+	}
+
+	for _, p := range sortedPorts(config.Ports) {
+		portServer, err := newServer(p, shared)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("Serving %s\n", portServer.Addr)
+			log.Fatal(serve(portServer))
+		}()
+	}
 
-	log.Printf("Load Balancer started at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
+	log.Printf("Load Balancer started at :%d\n", config.Port)
+	if err := serve(server); err != nil {
 		log.Fatal(err)
 	}
 }
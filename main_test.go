@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadbalancer/backend"
+)
+
+// TestMain runs the load balancer itself when the test binary is started by
+// runMain, so that its command line can be tested without building it
+func TestMain(m *testing.M) {
+	if os.Getenv("LB_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the load balancer with args and returns its standard output
+func runMain(t *testing.T, env []string, args ...string) ([]byte, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "LB_TEST_MAIN=1"), env...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return out, err
+}
+
+func TestDryRunPrintsConfig(t *testing.T) {
+	out, err := runMain(t, nil,
+		"-dry-run",
+		"-backends=http://10.0.0.1:3031;weight=3;zone=eu,http://10.0.0.2:3031",
+		"-algorithm=weighted-round-robin",
+		"-port=8080",
+		"-request-timeout=5s",
+	)
+	if err != nil {
+		t.Fatalf("dry run failed: %s", err)
+	}
+	var got struct {
+		Port           int             `json:"port"`
+		Algorithm      string          `json:"algorithm"`
+		RequestTimeout string          `json:"request_timeout"`
+		Backends       []BackendConfig `json:"backends"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("output is not JSON: %s\n%s", err, out)
+	}
+	if got.Port != 8080 || got.Algorithm != "weighted-round-robin" || got.RequestTimeout != "5s" {
+		t.Errorf("got port %d, algorithm %q, request timeout %q", got.Port, got.Algorithm, got.RequestTimeout)
+	}
+	if len(got.Backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(got.Backends))
+	}
+	if b := got.Backends[0]; b.URL != "http://10.0.0.1:3031" || b.Weight != 3 || b.Zone != "eu" {
+		t.Errorf("first backend is %+v", b)
+	}
+	if b := got.Backends[1]; b.URL != "http://10.0.0.2:3031" || b.Weight != 1 {
+		t.Errorf("second backend is %+v", b)
+	}
+}
+
+func TestDryRunIncludesEnvironmentBackends(t *testing.T) {
+	out, err := runMain(t, []string{"LB_BACKEND_1=http://10.0.0.3:3031"}, "-dry-run")
+	if err != nil {
+		t.Fatalf("dry run failed: %s", err)
+	}
+	var got Config
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("output is not JSON: %s\n%s", err, out)
+	}
+	if len(got.Backends) != 1 || got.Backends[0].URL != "http://10.0.0.3:3031" {
+		t.Errorf("got backends %+v", got.Backends)
+	}
+}
+
+func TestDryRunRejectsInvalidConfig(t *testing.T) {
+	if _, err := runMain(t, nil, "-dry-run", "-backends=http://10.0.0.1:3031", "-algorithm=nope"); err == nil {
+		t.Error("dry run accepted an unknown algorithm")
+	}
+}
+
+// setupPool points the load balancer at a fresh pool of the given backends
+// with the default configuration, restored when the test ends
+func setupPool(t *testing.T, urls ...string) {
+	t.Helper()
+	oldConfig, oldPool, oldBuffers := config, serverPool, proxyBuffers
+	t.Cleanup(func() { config, serverPool, proxyBuffers = oldConfig, oldPool, oldBuffers })
+	config = defaultConfig()
+	config.RetryDelay = Duration(time.Millisecond)
+	serverPool = backend.NewServerPool(context.Background())
+	serverPool.ProxyFactory = newProxy
+	proxyBuffers = newBufferPool(config.ProxyBufferSize)
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addBackend(u, BackendConfig{URL: rawURL, Weight: 1}) == nil {
+			t.Fatalf("backend %s not added", rawURL)
+		}
+	}
+}
+
+// namedBackend answers every request with its name
+func namedBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// resettingBackend closes every connection without answering, and counts
+// the requests it got
+func resettingBackend(t *testing.T, hits *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// closedBackendURL returns the URL of a server that no longer listens
+func closedBackendURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+// get sends a GET of path through the load balancer
+func get(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	lb(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestLBRoundRobin(t *testing.T) {
+	a, b, c := namedBackend(t, "a"), namedBackend(t, "b"), namedBackend(t, "c")
+	setupPool(t, a.URL, b.URL, c.URL)
+	var got []string
+	for i := 0; i < 6; i++ {
+		w := get("/")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+		got = append(got, w.Body.String())
+	}
+	for i := 3; i < len(got); i++ {
+		if got[i] != got[i-3] {
+			t.Fatalf("backends are not visited in turn: %v", got)
+		}
+	}
+	if seen := strings.Join(got[:3], ""); !strings.Contains(seen, "a") || !strings.Contains(seen, "b") || !strings.Contains(seen, "c") {
+		t.Errorf("first round visited %v", got[:3])
+	}
+}
+
+func TestLBFailsOverToLiveBackend(t *testing.T) {
+	dead := closedBackendURL(t)
+	live := namedBackend(t, "live")
+	setupPool(t, dead, live.URL)
+	for i := 0; i < 4; i++ {
+		w := get("/")
+		if w.Code != http.StatusOK || w.Body.String() != "live" {
+			t.Fatalf("request %d: status %d, body %q", i, w.Code, w.Body)
+		}
+	}
+	if serverPool.GetBackend(dead).IsAlive() {
+		t.Error("unreachable backend still alive")
+	}
+}
+
+func TestLBRetriesUpToMaxRetries(t *testing.T) {
+	var hits int32
+	broken := resettingBackend(t, &hits)
+	setupPool(t, broken.URL)
+	config.MaxRetries = 2
+	w := get("/")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1+2 {
+		t.Errorf("backend got %d requests, want 3", hits)
+	}
+	if serverPool.GetBackend(broken.URL).IsAlive() {
+		t.Error("backend failing all retries still alive")
+	}
+}
+
+func TestLBStopsAtMaxAttempts(t *testing.T) {
+	var hits int32
+	var urls []string
+	for i := 0; i < 4; i++ {
+		urls = append(urls, resettingBackend(t, &hits).URL)
+	}
+	setupPool(t, urls...)
+	config.MaxRetries = 0
+	config.MaxAttempts = 2
+	w := get("/")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 2 {
+		t.Errorf("%d backends tried, want 2", hits)
+	}
+	if alive := serverPool.AliveCount(); alive != 2 {
+		t.Errorf("%d backends alive, want the 2 untried ones", alive)
+	}
+}
+
+func TestLBWithoutAliveBackend(t *testing.T) {
+	setupPool(t, namedBackend(t, "a").URL)
+	serverPool.Backends()[0].SetAlive(false)
+	if w := get("/"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+}
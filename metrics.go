@@ -0,0 +1,284 @@
+package main
+
+import (
+	"loadbalancer/backend"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsSink receives the measurements of the load balancer
+type metricsSink interface {
+	RequestDone(backend string, code int, took time.Duration)
+	RequestFailed(backend string)
+	Retried(backend string)
+	BackendUp(backend string, up bool)
+	ActiveConnections(backend string, n int64)
+	BackendResponse(backend string, code int)
+	RequestPhase(backend, phase string, took time.Duration)
+	CircuitState(backend, state string)
+	ShadowFailed(backend string)
+	HealthCheck(backend string, alive bool, took time.Duration)
+	BusiestClients(busiest []clientConns)
+}
+
+// sinks forwards measurements to every enabled sink
+type sinks []metricsSink
+
+// metrics holds the enabled metrics sinks
+var metrics sinks
+
+func (s sinks) RequestDone(backend string, code int, took time.Duration) {
+	for _, sink := range s {
+		sink.RequestDone(backend, code, took)
+	}
+}
+
+func (s sinks) RequestFailed(backend string) {
+	for _, sink := range s {
+		sink.RequestFailed(backend)
+	}
+}
+
+func (s sinks) Retried(backend string) {
+	for _, sink := range s {
+		sink.Retried(backend)
+	}
+}
+
+func (s sinks) BackendUp(backend string, up bool) {
+	for _, sink := range s {
+		sink.BackendUp(backend, up)
+	}
+}
+
+func (s sinks) ActiveConnections(backend string, n int64) {
+	for _, sink := range s {
+		sink.ActiveConnections(backend, n)
+	}
+}
+
+func (s sinks) BackendResponse(backend string, code int) {
+	for _, sink := range s {
+		sink.BackendResponse(backend, code)
+	}
+}
+
+func (s sinks) RequestPhase(backend, phase string, took time.Duration) {
+	for _, sink := range s {
+		sink.RequestPhase(backend, phase, took)
+	}
+}
+
+func (s sinks) CircuitState(backend, state string) {
+	for _, sink := range s {
+		sink.CircuitState(backend, state)
+	}
+}
+
+func (s sinks) ShadowFailed(backend string) {
+	for _, sink := range s {
+		sink.ShadowFailed(backend)
+	}
+}
+
+func (s sinks) HealthCheck(backend string, alive bool, took time.Duration) {
+	for _, sink := range s {
+		sink.HealthCheck(backend, alive, took)
+	}
+}
+
+func (s sinks) BusiestClients(busiest []clientConns) {
+	for _, sink := range s {
+		sink.BusiestClients(busiest)
+	}
+}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_requests_total",
+		Help: "Requests answered by backends by status code.",
+	}, []string{"backend", "code"})
+	requestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_request_errors_total",
+		Help: "Requests that failed to reach a backend.",
+	}, []string{"backend"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_retries_total",
+		Help: "Requests retried after a backend failed.",
+	}, []string{"backend"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_request_duration_seconds",
+		Help:    "Time until backends sent the response headers.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+	backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_up",
+		Help: "Whether a backend is alive (1) or not (0).",
+	}, []string{"backend"})
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_active_connections",
+		Help: "Requests in flight to a backend.",
+	}, []string{"backend"})
+
+	backendResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_backend_responses_total",
+		Help: "Responses of backends by status class.",
+	}, []string{"backend", "class"})
+	connectionsPerIP = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_connections_per_ip_current",
+		Help: "Open connections of the busiest client IPs, ranked by top_n.",
+	}, []string{"top_n", "ip"})
+	requestPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_request_phase_duration_seconds",
+		Help:    "Duration of the phases of requests to backends: dns, tls, ttfb and body.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"backend", "phase"})
+	circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_circuit_breaker_state",
+		Help: "State of the circuit breaker of a backend: closed (0), half-open (1) or open (2).",
+	}, []string{"backend"})
+	shadowErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_shadow_errors_total",
+		Help: "Mirrored requests that failed on a shadow backend.",
+	}, []string{"backend"})
+
+	healthCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_health_check_duration_seconds",
+		Help:    "Duration of backend health checks.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2, 5, 10},
+	}, []string{"backend"})
+	healthCheckTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_health_check_total",
+		Help: "Backend health checks by result.",
+	}, []string{"backend", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestErrorsTotal, retriesTotal,
+		requestDuration, backendUp, activeConnections, backendResponsesTotal, connectionsPerIP, shadowErrorsTotal,
+		requestPhaseDuration, circuitBreakerState,
+		healthCheckDuration, healthCheckTotal)
+}
+
+// prometheusSink records measurements in the Prometheus metrics
+type prometheusSink struct{}
+
+func (prometheusSink) RequestDone(backend string, code int, took time.Duration) {
+	requestsTotal.WithLabelValues(backend, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(backend).Observe(took.Seconds())
+}
+
+func (prometheusSink) RequestFailed(backend string) {
+	requestErrorsTotal.WithLabelValues(backend).Inc()
+}
+
+func (prometheusSink) Retried(backend string) {
+	retriesTotal.WithLabelValues(backend).Inc()
+}
+
+func (prometheusSink) BackendUp(backend string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	backendUp.WithLabelValues(backend).Set(v)
+}
+
+func (prometheusSink) ActiveConnections(backend string, n int64) {
+	activeConnections.WithLabelValues(backend).Set(float64(n))
+}
+
+func (prometheusSink) BackendResponse(backend string, code int) {
+	backendResponsesTotal.WithLabelValues(backend, statusClass(code)).Inc()
+}
+
+func (prometheusSink) RequestPhase(backend, phase string, took time.Duration) {
+	requestPhaseDuration.WithLabelValues(backend, phase).Observe(took.Seconds())
+}
+
+func (prometheusSink) CircuitState(backend, state string) {
+	circuitBreakerState.WithLabelValues(backend).Set(circuitStates[state])
+}
+
+func (prometheusSink) ShadowFailed(backend string) {
+	shadowErrorsTotal.WithLabelValues(backend).Inc()
+}
+
+func (prometheusSink) HealthCheck(backend string, alive bool, took time.Duration) {
+	healthCheckDuration.WithLabelValues(backend).Observe(took.Seconds())
+	healthCheckTotal.WithLabelValues(backend, healthCheckOutcome(alive)).Inc()
+}
+
+func (prometheusSink) BusiestClients(busiest []clientConns) {
+	connectionsPerIP.Reset()
+	for i, c := range busiest {
+		connectionsPerIP.WithLabelValues(strconv.Itoa(i+1), c.ip).Set(float64(c.conns))
+	}
+}
+
+// statusClass returns the class of a status code, such as 5xx
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// healthCheckOutcome returns the result label of a health check
+func healthCheckOutcome(alive bool) string {
+	if alive {
+		return "alive"
+	}
+	return "dead"
+}
+
+// observeHealthCheck records the outcome of a backend health check
+func observeHealthCheck(b *backend.Backend, alive bool, took time.Duration) {
+	metrics.HealthCheck(b.URL.String(), alive, took)
+}
+
+// observeTiming records the phases of a request to b, the connection
+// phases only when a new connection was made
+func observeTiming(b *backend.Backend, timing *RequestTiming) {
+	name := b.URL.String()
+	timing.mux.Lock()
+	defer timing.mux.Unlock()
+	if timing.DNS > 0 {
+		metrics.RequestPhase(name, "dns", timing.DNS)
+	}
+	if timing.TLS > 0 {
+		metrics.RequestPhase(name, "tls", timing.TLS)
+	}
+	metrics.RequestPhase(name, "ttfb", timing.TTFB)
+	metrics.RequestPhase(name, "body", timing.Body)
+}
+
+// circuitStates are the values of lb_circuit_breaker_state
+var circuitStates = map[string]float64{
+	backend.CircuitClosed:   0,
+	backend.CircuitHalfOpen: 1,
+	backend.CircuitOpen:     2,
+}
+
+// observeCircuit logs a change of a circuit breaker and updates its gauge
+func observeCircuit(t backend.CircuitTransition) {
+	log.Printf("event=circuit_breaker backend=%s from=%s to=%s window_requests=%d window_errors=%d\n",
+		t.Backend, t.From, t.To, t.Requests, t.Errors)
+	metrics.CircuitState(t.Backend, t.To)
+}
+
+// observeResponse counts a response of a backend by status class
+func observeResponse(b *backend.Backend, code int) {
+	metrics.BackendResponse(b.URL.String(), code)
+}
+
+// metricsHandler serves the registered metrics in the Prometheus text
+// format, or in the OpenMetrics format when the scraper asks for it
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}))
+}
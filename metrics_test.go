@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"loadbalancer/backend"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsContentNegotiation(t *testing.T) {
+	handler := metricsHandler()
+	for _, tt := range []struct {
+		accept, contentType string
+	}{
+		{"", "text/plain; version=0.0.4"},
+		{"text/plain", "text/plain; version=0.0.4"},
+		{"application/openmetrics-text; version=0.0.1", "application/openmetrics-text; version=0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Accept %q: status %d", tt.accept, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Errorf("Accept %q: Content-Type %q, want %q", tt.accept, got, tt.contentType)
+		}
+		body := w.Body.String()
+		if openMetrics := strings.HasPrefix(tt.contentType, "application/openmetrics-text"); openMetrics != strings.HasSuffix(body, "# EOF\n") {
+			t.Errorf("Accept %q: body does not match the format:\n%s", tt.accept, body)
+		}
+	}
+}
+
+// statsdAgent listens for DogStatsD packets, returning its address and the
+// metric lines received so far, without the client telemetry
+func statsdAgent(t *testing.T) (string, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var mux sync.Mutex
+	var lines []string
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mux.Lock()
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if line != "" && !strings.HasPrefix(line, "datadog.") {
+					lines = append(lines, line)
+				}
+			}
+			mux.Unlock()
+		}
+	}()
+	return conn.LocalAddr().String(), func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func TestStatsdOnlyGetsEveryMetric(t *testing.T) {
+	addr, received := statsdAgent(t)
+	sink, err := newStatsdSink(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.client.Close()
+	oldMetrics := metrics
+	metrics = sinks{sink}
+	defer func() { metrics = oldMetrics }()
+
+	setupPool(t, "http://10.0.0.1:3031")
+	b := serverPool.Backends()[0]
+	name := b.URL.String()
+	healthChecks := testutil.ToFloat64(healthCheckTotal.WithLabelValues(name, "alive"))
+
+	metrics.RequestDone(name, http.StatusOK, time.Millisecond)
+	metrics.RequestFailed(name)
+	metrics.Retried(name)
+	metrics.BackendUp(name, true)
+	metrics.ActiveConnections(name, 2)
+	observeResponse(b, http.StatusBadGateway)
+	observeTiming(b, &RequestTiming{TTFB: time.Millisecond, Body: time.Millisecond})
+	observeCircuit(backend.CircuitTransition{Backend: name, From: backend.CircuitClosed, To: backend.CircuitOpen})
+	observeHealthCheck(b, true, time.Millisecond)
+	metrics.ShadowFailed(name)
+	counter := &connCounter{}
+	counter.acquire("192.0.2.1")
+	counter.report()
+	sink.client.Flush()
+
+	want := []string{
+		"lb.requests:", "lb.request.duration:", "lb.errors:", "lb.retries:",
+		"lb.backend.up:", "lb.backend.active_connections:", "lb.backend.responses:",
+		"lb.request.phase.duration:", "lb.circuit_breaker.state:", "lb.health_check.duration:",
+		"lb.health_check:", "lb.shadow.errors:", "lb.connections_per_ip:",
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var missing []string
+		got := strings.Join(received(), "\n")
+		for _, prefix := range want {
+			if !strings.HasPrefix(got, prefix) && !strings.Contains(got, "\n"+prefix) {
+				missing = append(missing, prefix)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("StatsD got no %v in:\n%s", missing, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(healthCheckTotal.WithLabelValues(name, "alive")); got != healthChecks {
+		t.Error("Prometheus metrics updated with only StatsD enabled")
+	}
+}
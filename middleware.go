@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// bodyBufferingMiddleware keeps request bodies of up to config.MaxBufferBody
+// bytes in memory so that retries can send them again. Retries are disabled
+// for larger bodies since they can only be read once.
+func bodyBufferingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		max := config.MaxBufferBody
+		if r.ContentLength > max {
+			next.ServeHTTP(w, unbuffered(r))
+			return
+		}
+
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			log.Printf("%s(%s) Reading request body failed: %s\n", r.RemoteAddr, r.URL.Path, err)
+			writeError(w, r, http.StatusBadRequest, "bad request")
+			return
+		}
+		if int64(len(buf)) > max {
+			// hand over what was read followed by the rest of the stream
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+			next.ServeHTTP(w, unbuffered(r))
+			return
+		}
+
+		r.Body.Close()
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(buf)), nil
+		}
+		r.Body, _ = r.GetBody()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineMiddleware bounds a request with all its retries and attempts by
+// timeout, unless a route set its own deadline already. Its context is
+// cancelled once the handler returns so that nothing started for the
+// request outlives it.
+func deadlineMiddleware(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if _, ok := r.Context().Deadline(); !ok && timeout > 0 {
+			ctx, cancel = context.WithDeadline(r.Context(), time.Now().Add(timeout))
+		} else {
+			ctx, cancel = context.WithCancel(r.Context())
+		}
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// backendContext returns the context of the attempts at a backend with a
+// request timeout, ending after timeout. The attempts at other backends get
+// the deadline of ctx back with nextBackendContext.
+func backendContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithValue(ctx, BackendDeadline, ctx), timeout)
+}
+
+// nextBackendContext returns ctx ending with the request rather than with
+// the request timeout of the backend it was sent to
+func nextBackendContext(ctx context.Context) context.Context {
+	if parent, ok := ctx.Value(BackendDeadline).(context.Context); ok {
+		return deadlineContext{Context: ctx, deadline: parent}
+	}
+	return ctx
+}
+
+// deadlineContext has the values of its Context and ends with deadline
+type deadlineContext struct {
+	context.Context
+	deadline context.Context
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) { return c.deadline.Deadline() }
+func (c deadlineContext) Done() <-chan struct{}       { return c.deadline.Done() }
+func (c deadlineContext) Err() error                  { return c.deadline.Err() }
+
+// unbuffered marks a request whose body is too large to be sent again
+func unbuffered(r *http.Request) *http.Request {
+	log.Printf("%s(%s) Request body exceeds %d bytes, retries disabled\n", r.RemoteAddr, r.URL.Path, config.MaxBufferBody)
+	ctx := context.WithValue(r.Context(), BodyUnbuffered, true)
+	return r.WithContext(ctx)
+}
+
+// rewindBody restores a buffered request body before the request is sent again
+func rewindBody(r *http.Request) {
+	if r.GetBody == nil {
+		return
+	}
+	if body, err := r.GetBody(); err == nil {
+		r.Body = body
+	}
+}
+
+// traceHeaders lists the distributed tracing headers of each propagation format
+var traceHeaders = map[string][]string{
+	"w3c": {"Traceparent", "Tracestate"},
+	"b3":  {"X-B3-Traceid", "X-B3-Spanid", "X-B3-Parentspanid", "X-B3-Sampled", "X-B3-Flags", "B3"},
+}
+
+// tracePropagationModes maps -trace-propagation values to the formats forwarded
+var tracePropagationModes = map[string][]string{
+	"w3c":  {"w3c"},
+	"b3":   {"b3"},
+	"both": {"w3c", "b3"},
+	"none": nil,
+}
+
+// tracePropagationMiddleware moves the tracing headers of the incoming
+// request into its context, propagateTrace puts back those of the formats
+// selected by -trace-propagation on the outbound request
+func tracePropagationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace := http.Header{}
+		for _, names := range traceHeaders {
+			for _, name := range names {
+				if v, ok := r.Header[name]; ok {
+					trace[name] = v
+					r.Header.Del(name)
+				}
+			}
+		}
+		ctx := context.WithValue(r.Context(), TraceHeaders, trace)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// propagateTrace copies the tracing headers kept by tracePropagationMiddleware
+// into the outbound request r
+func propagateTrace(r *http.Request) {
+	trace, ok := r.Context().Value(TraceHeaders).(http.Header)
+	if !ok {
+		return
+	}
+	for _, format := range tracePropagationModes[config.TracePropagation] {
+		for _, name := range traceHeaders[format] {
+			if v, ok := trace[name]; ok {
+				r.Header[name] = v
+			}
+		}
+	}
+}
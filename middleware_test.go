@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadlineMiddleware(t *testing.T) {
+	var ctx context.Context
+	handler := deadlineMiddleware(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	}))
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if deadline, ok := ctx.Deadline(); !ok || deadline.Before(start.Add(time.Minute)) {
+		t.Errorf("deadline is %s, want a minute from now", deadline)
+	}
+	if ctx.Err() == nil {
+		t.Error("context not cancelled once the handler returned")
+	}
+
+	route, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(route))
+	if deadline, _ := ctx.Deadline(); deadline.Before(start.Add(time.Hour)) {
+		t.Errorf("deadline of the route replaced by %s", deadline)
+	}
+	if ctx.Err() == nil || route.Err() != nil {
+		t.Error("only the context of the request should be cancelled")
+	}
+}
+
+func TestDeadlineMiddlewareWithoutTimeout(t *testing.T) {
+	var ctx context.Context
+	deadlineMiddleware(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("deadline without a timeout")
+	}
+	if ctx.Err() == nil {
+		t.Error("context not cancelled once the handler returned")
+	}
+}
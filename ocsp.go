@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is the delay before fetching a staple again after a
+	// failure
+	ocspRetryInterval = 5 * time.Minute
+	// ocspMinRefresh bounds how often a staple is fetched
+	ocspMinRefresh = time.Minute
+	// ocspDefaultRefresh is used for responses without a next update
+	ocspDefaultRefresh = time.Hour
+	// maxOCSPResponse bounds the responses read from responders
+	maxOCSPResponse = 1 << 20
+)
+
+// staple fetches OCSP responses for the certificate of the loader and
+// attaches those holding it good, refreshing them halfway to their next
+// update. The staple of a revoked certificate is dropped.
+func (l *certLoader) staple() {
+	for {
+		l.mux.Lock()
+		cert := l.cert
+		l.mux.Unlock()
+
+		wait := ocspRetryInterval
+		staple, next, err := fetchOCSPStaple(cert)
+		var revoked *certRevokedError
+		if errors.As(err, &revoked) {
+			// a staple of the time the certificate was good would mislead
+			l.mux.Lock()
+			if bytes.Equal(l.cert.Certificate[0], cert.Certificate[0]) && l.cert.OCSPStaple != nil {
+				unstapled := *l.cert
+				unstapled.OCSPStaple = nil
+				l.cert = &unstapled
+			}
+			l.mux.Unlock()
+		} else if err != nil {
+			log.Println("Fetching OCSP staple failed, err: ", err)
+		} else {
+			l.mux.Lock()
+			// the certificate may have been replaced in the meantime
+			if bytes.Equal(l.cert.Certificate[0], cert.Certificate[0]) {
+				stapled := *l.cert
+				stapled.OCSPStaple = staple
+				l.cert = &stapled
+			}
+			l.mux.Unlock()
+			wait = time.Until(next)
+			if wait < ocspMinRefresh {
+				wait = ocspMinRefresh
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-l.reloaded:
+		}
+	}
+}
+
+// fetchOCSPStaple asks the OCSP responder of cert for its status and returns
+// the response with the time it should be fetched again
+func fetchOCSPStaple(cert *tls.Certificate) ([]byte, time.Time, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, time.Time{}, errors.New("certificate has no OCSP server")
+	}
+	issuer, err := certIssuer(cert, leaf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("OCSP responder %s answered %d", leaf.OCSPServer[0], resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	next, err := ocspNextFetch(raw, leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return raw, next, nil
+}
+
+// certIssuer returns the issuer of leaf from the chain of cert, or else
+// downloads it from the issuing certificate URL of leaf
+func certIssuer(cert *tls.Certificate, leaf *x509.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) > 1 {
+		return x509.ParseCertificate(cert.Certificate[1])
+	}
+	if len(leaf.IssuingCertificateURL) == 0 {
+		return nil, errors.New("certificate chain has no issuer")
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(leaf.IssuingCertificateURL[0])
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	der, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// certRevokedError is returned for a certificate its responder revoked
+type certRevokedError struct {
+	subject   string
+	revokedAt time.Time
+	reason    int
+}
+
+func (e *certRevokedError) Error() string {
+	return fmt.Sprintf("certificate %s revoked at %s, reason %d", e.subject, e.revokedAt.Format(time.RFC3339), e.reason)
+}
+
+// ocspNextFetch checks that raw is a response about leaf signed for its
+// issuer that holds it good, and returns when to fetch it again, halfway
+// between its update times. A revoked certificate is alerted.
+func ocspNextFetch(raw []byte, leaf, issuer *x509.Certificate) (time.Time, error) {
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		err := &certRevokedError{subject: leaf.Subject.String(), revokedAt: resp.RevokedAt, reason: resp.RevocationReason}
+		alertCertRevoked(leaf, err)
+		return time.Time{}, err
+	default:
+		return time.Time{}, errors.New("OCSP responder does not know the certificate")
+	}
+	if resp.NextUpdate.IsZero() {
+		return time.Now().Add(ocspDefaultRefresh), nil
+	}
+	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2), nil
+}
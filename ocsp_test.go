@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspFixture is a leaf certificate of a CA whose responder answers with
+// responses signed by signer
+type ocspFixture struct {
+	ca, leaf *x509.Certificate
+	caKey    crypto.Signer
+	cert     *tls.Certificate
+	// status is the status given to the leaf by the responder
+	status int
+	// signer signs the responses, the CA key if nil
+	signer crypto.Signer
+}
+
+func newOCSPFixture(t *testing.T) *ocspFixture {
+	t.Helper()
+	f := &ocspFixture{status: ocsp.Good}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ca, _ = x509.ParseCertificate(caDER)
+	f.caKey = caKey
+
+	responder := httptest.NewServer(http.HandlerFunc(f.respond(t)))
+	t.Cleanup(responder.Close)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "lb.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, f.ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.leaf, _ = x509.ParseCertificate(leafDER)
+	f.cert = &tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: leafKey}
+	return f
+}
+
+// respond answers OCSP requests about the leaf with a signed response
+func (f *ocspFixture) respond(t *testing.T) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("bad OCSP request: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().Truncate(time.Second)
+		template := ocsp.Response{
+			Status:       f.status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(2 * time.Hour),
+		}
+		if f.status == ocsp.Revoked {
+			template.RevokedAt = now.Add(-time.Minute)
+			template.RevocationReason = ocsp.KeyCompromise
+		}
+		signer := f.signer
+		if signer == nil {
+			signer = f.caKey
+		}
+		raw, err := ocsp.CreateResponse(f.ca, f.ca, template, signer)
+		if err != nil {
+			t.Errorf("signing OCSP response: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(raw)
+	}
+}
+
+func TestOCSPStapleGood(t *testing.T) {
+	f := newOCSPFixture(t)
+	staple, next, err := fetchOCSPStaple(f.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ocsp.ParseResponseForCert(staple, f.leaf, f.ca)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("staple is not a good response: %v", err)
+	}
+	if want := resp.ThisUpdate.Add(time.Hour); !next.Equal(want) {
+		t.Errorf("next fetch at %s, want %s halfway to the next update", next, want)
+	}
+}
+
+func TestOCSPStapleRevoked(t *testing.T) {
+	f := newOCSPFixture(t)
+	f.status = ocsp.Revoked
+	staple, _, err := fetchOCSPStaple(f.cert)
+	var revoked *certRevokedError
+	if !errors.As(err, &revoked) {
+		t.Fatalf("got %v, want a revocation", err)
+	}
+	if staple != nil {
+		t.Error("revoked response stapled")
+	}
+	if revoked.reason != ocsp.KeyCompromise {
+		t.Errorf("reason %d", revoked.reason)
+	}
+}
+
+func TestOCSPStapleUnknown(t *testing.T) {
+	f := newOCSPFixture(t)
+	f.status = ocsp.Unknown
+	if staple, _, err := fetchOCSPStaple(f.cert); err == nil || staple != nil {
+		t.Errorf("response of unknown status stapled: %v", err)
+	}
+}
+
+func TestOCSPStapleBadSignature(t *testing.T) {
+	f := newOCSPFixture(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.signer = other
+	if staple, _, err := fetchOCSPStaple(f.cert); err == nil || staple != nil {
+		t.Errorf("response with a forged signature stapled: %v", err)
+	}
+}
+
+func TestOCSPStapleWithoutResponder(t *testing.T) {
+	f := newOCSPFixture(t)
+	template := *f.leaf
+	template.OCSPServer = nil
+	der, err := x509.CreateCertificate(rand.Reader, &template, f.ca, f.leaf.PublicKey, f.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.cert.Certificate[0] = der
+	if _, _, err := fetchOCSPStaple(f.cert); err == nil {
+		t.Error("certificate without OCSP server stapled")
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"loadbalancer/backend"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdempotencyKeyHeader marks a request as safe to retry whatever its method
+const IdempotencyKeyHeader = "X-Idempotency-Key"
+
+// safeMethods are the safe methods of RFC 7231 section 4.2.1
+var safeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// isRetryable reports whether a failed request may be sent again
+func isRetryable(r *http.Request) bool {
+	if unbuffered, _ := r.Context().Value(BodyUnbuffered).(bool); unbuffered {
+		return false
+	}
+	return safeMethods[r.Method] || r.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// retryAfterError is returned by ModifyResponse when a backend answers 503
+// with a Retry-After header
+type retryAfterError struct {
+	header string
+	delay  time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("service unavailable, retry after %s", e.header)
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// checkRetryAfter turns a 503 with Retry-After into a retryAfterError so that
+// the request is sent to another backend
+func checkRetryAfter(resp *http.Response) error {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	header := resp.Header.Get("Retry-After")
+	delay, ok := parseRetryAfter(header)
+	if !ok {
+		return nil
+	}
+	return &retryAfterError{header: header, delay: delay}
+}
+
+// responseTooLargeError is returned when a backend sends a body larger than
+// config.MaxResponseBody
+type responseTooLargeError struct {
+	// size is the announced Content-Length, -1 when unknown
+	size int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	if e.size < 0 {
+		return fmt.Sprintf("response body exceeds the limit of %d bytes", config.MaxResponseBody)
+	}
+	return fmt.Sprintf("response body of %d bytes exceeds the limit of %d bytes", e.size, config.MaxResponseBody)
+}
+
+// contentTypeError is returned when a backend answers with another content
+// type than its ExpectedContentType
+type contentTypeError struct {
+	expected, actual string
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("content type %q does not match the expected %q", e.actual, e.expected)
+}
+
+// checkContentType fails responses of b whose content type does not start
+// with the one expected, such as an HTML error page of an API. Responses
+// without a body are let through.
+func checkContentType(b *backend.Backend, resp *http.Response) error {
+	if b.ExpectedContentType == "" || resp.Request.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	actual := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(strings.ToLower(actual), strings.ToLower(b.ExpectedContentType)) {
+		return &contentTypeError{expected: b.ExpectedContentType, actual: actual}
+	}
+	return nil
+}
+
+// limitResponseBody fails responses announcing a body larger than
+// config.MaxResponseBody, and bounds the others since Content-Length may be
+// missing or wrong
+func limitResponseBody(b *backend.Backend, resp *http.Response) error {
+	max := config.MaxResponseBody
+	if max <= 0 {
+		return nil
+	}
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		return &responseTooLargeError{size: resp.ContentLength}
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, backend: b, remaining: max}
+	return nil
+}
+
+// limitedBody fails reads once more than remaining bytes were read. The
+// response is already on its way to the client then, its connection is
+// aborted.
+type limitedBody struct {
+	io.ReadCloser
+	backend   *backend.Backend
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		log.Printf("[%s] Response body larger than %d bytes, aborting\n", b.backend.URL, config.MaxResponseBody)
+		b.remaining = 0
+		return 0, &responseTooLargeError{size: -1}
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// bodyTimeoutError is returned by reads of a response body that got no data
+// within config.ResponseBodyTimeout
+type bodyTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *bodyTimeoutError) Error() string {
+	return fmt.Sprintf("no response body data within %s", e.timeout)
+}
+
+// timeoutResponseBody closes the body of responses whose backend stalls for
+// config.ResponseBodyTimeout between two reads
+func timeoutResponseBody(b *backend.Backend, resp *http.Response) {
+	if timeout := time.Duration(config.ResponseBodyTimeout); timeout > 0 {
+		resp.Body = &timeoutReader{ReadCloser: resp.Body, backend: b, timeout: timeout}
+	}
+}
+
+// timeoutReader closes the body, and with it the connection to the backend,
+// when a read takes longer than timeout. Reads made before the response is
+// sent fail it with a 504, later ones abort the connection of the client.
+type timeoutReader struct {
+	io.ReadCloser
+	backend  *backend.Backend
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut int32
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.timeout, r.expire)
+	} else {
+		r.timer.Reset(r.timeout)
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.timer.Stop()
+	if atomic.LoadInt32(&r.timedOut) == 1 {
+		return n, &bodyTimeoutError{timeout: r.timeout}
+	}
+	return n, err
+}
+
+// expire closes the body under a stalled read
+func (r *timeoutReader) expire() {
+	atomic.StoreInt32(&r.timedOut, 1)
+	log.Printf("[%s] No response body data for %s, closing the connection\n", r.backend.URL, r.timeout)
+	r.ReadCloser.Close()
+}
+
+func (r *timeoutReader) Close() error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	return r.ReadCloser.Close()
+}
+
+// instrumentedTransport reports the requests sent to a backend to the metrics sinks
+type instrumentedTransport struct {
+	backend *backend.Backend
+	next    http.RoundTripper
+}
+
+// RoundTrip sends r to the backend, the request stays active until the
+// response body is closed
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	name := t.backend.URL.String()
+	metrics.ActiveConnections(name, t.backend.AddActive(1))
+
+	// abandon the request when the backend is done draining
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-t.backend.Drained():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req := r
+	tctx, trace := withTimingTrace(ctx)
+	r = r.WithContext(tctx)
+	done := func() {
+		cancel()
+		metrics.ActiveConnections(name, t.backend.AddActive(-1))
+		if queue != nil {
+			queue.release()
+		}
+	}
+
+	timing := GetRequestTimingFromContext(r)
+	if timing == nil {
+		timing = &RequestTiming{}
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		done()
+		trace.finish(timing)
+		metrics.RequestFailed(name)
+		return nil, err
+	}
+	metrics.RequestDone(name, resp.StatusCode, time.Since(start))
+	t.backend.ObserveLatency(time.Since(start))
+	resp.Body = &closeNotifyBody{ReadCloser: resp.Body, done: func() {
+		done()
+		trace.finish(timing)
+		observeTiming(t.backend, timing)
+	}}
+	// requests made from the response must not end with its body
+	resp.Request = req
+	return resp, nil
+}
+
+// closeNotifyBody calls done once the body is closed
+type closeNotifyBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *closeNotifyBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// bufferPool hands out the buffers ReverseProxy copies response bodies with
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool returns a pool of buffers of size bytes
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} { return make([]byte, size) }
+	return p
+}
+
+func (p *bufferPool) Get() []byte { return p.pool.Get().([]byte) }
+
+func (p *bufferPool) Put(b []byte) {
+	if len(b) == p.size {
+		p.pool.Put(b)
+	}
+}
+
+// proxyBuffers are shared by the proxies of all backends, set before the
+// backends are added
+var proxyBuffers httputil.BufferPool
+
+// newProxy returns the reverse proxy forwarding requests to b
+func newProxy(b *backend.Backend) *httputil.ReverseProxy {
+	serverUrl := b.URL
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	// ReverseProxy flushes text/event-stream responses immediately whatever
+	// the interval
+	proxy.FlushInterval = time.Duration(config.FlushInterval)
+	if config.BufferResponses {
+		proxy.FlushInterval = 0
+	}
+	proxy.BufferPool = proxyBuffers
+	proxy.Transport = &instrumentedTransport{backend: b, next: serverPool.Transport(b)}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		propagateTrace(r)
+		if config.CompressUpstream {
+			compressUpstream(b, r)
+		}
+		if config.RespectUpstreamAttempts {
+			setAttemptsHeader(r)
+		}
+		signRequest(b, r)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if config.FollowRedirects > 0 {
+			if err := followRedirects(resp); err != nil {
+				return err
+			}
+		}
+		if entry := GetRequestLogFromContext(resp.Request); entry != nil {
+			entry.respond(resp.StatusCode, true)
+		}
+		b.CountResponse(resp.StatusCode)
+		ok := resp.StatusCode < http.StatusInternalServerError
+		observeResponse(b, resp.StatusCode)
+		checkErrorRate(b)
+		if err := checkRetryAfter(resp); err != nil {
+			return err
+		}
+		if err := checkContentType(b, resp); err != nil {
+			return err
+		}
+		timeoutResponseBody(b, resp)
+		if err := verifyResponseHash(b, resp); err != nil {
+			return err
+		}
+		pushPreloads(resp)
+		mapResponseCode(resp)
+		if err := decompressResponse(resp); err != nil {
+			return err
+		}
+		if err := limitResponseBody(b, resp); err != nil {
+			return err
+		}
+		// a rejected response is recorded as a failure by the ErrorHandler,
+		// so that every attempt counts once
+		serverPool.RecordResult(b, ok)
+		return nil
+	}
+	// ErrorHandler for proxy
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		rewindBody(request)
+		entry := GetRequestLogFromContext(request)
+		if entry != nil {
+			entry.end(e)
+		} else {
+			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
+		}
+
+		// the deadline of the request passed or the client went away
+		if err := request.Context().Err(); err != nil {
+			if err == context.DeadlineExceeded {
+				writeError(writer, request, http.StatusGatewayTimeout, "gateway timeout")
+			}
+			return
+		}
+
+		// tryNext sends the request to another backend
+		tryNext := func() {
+			metrics.Retried(serverUrl.String())
+			attempts := GetAttemptsFromContext(request)
+			ctx := context.WithValue(nextBackendContext(request.Context()), Attempts, attempts+1)
+			lb(writer, request.WithContext(ctx))
+		}
+
+		serverPool.RecordResult(b, false)
+
+		// the backend asked to come back later, wait a bit and try the next one
+		var retryAfter *retryAfterError
+		if errors.As(e, &retryAfter) {
+			ctx := context.WithValue(request.Context(), RetryAfter, retryAfter.header)
+			request = request.WithContext(ctx)
+			if !isRetryable(request) {
+				serviceUnavailable(writer, request)
+				return
+			}
+			delay := retryAfter.delay
+			if max := time.Duration(config.MaxRetryDelay); delay > max {
+				delay = max
+			}
+			select {
+			case <-time.After(delay):
+			case <-request.Context().Done():
+				return
+			}
+			tryNext()
+			return
+		}
+
+		class := classifyError(e)
+		switch class {
+		case ErrorHeaderTooLarge:
+			// a backend sending oversized headers would do it again
+			log.Printf("[%s] Response headers larger than %d bytes, not retrying\n", serverUrl.Host, config.MaxResponseHeaderBytes)
+			writeError(writer, request, http.StatusBadGateway, "backend response headers too large")
+			return
+		case ErrorContentType:
+			log.Printf("[%s] %s, not retrying\n", serverUrl.Host, e)
+			writeError(writer, request, http.StatusBadGateway, "backend response of unexpected content type")
+			return
+		case ErrorBodyTimeout:
+			writeError(writer, request, http.StatusGatewayTimeout, "gateway timeout")
+			return
+		case ErrorResponseTooLarge:
+			log.Printf("[%s] %s, not retrying\n", serverUrl.Host, e)
+			writeError(writer, request, http.StatusBadGateway, "backend response too large")
+			return
+		case ErrorMidResponse:
+			// the backend may have acted on the request, sending it again
+			// could repeat it. A retryable request with a hashed body may
+			// still go to the backends that did not see it.
+			var received int64
+			if timing := GetRequestTimingFromContext(request); timing != nil {
+				received = timing.received()
+			}
+			if hash := GetBodyHashFromContext(request); hash != "" && isRetryable(request) {
+				if ctx, ok := withPartialBackend(request.Context(), serverUrl.String()); ok {
+					request = request.WithContext(ctx)
+					log.Printf("[%s] Connection broken mid-response after %d bytes, trying another backend for body_hash=%s\n", serverUrl.Host, received, hash)
+					tryNext()
+					return
+				}
+			}
+			log.Printf("[%s] Connection broken mid-response after %d bytes, not retrying\n", serverUrl.Host, received)
+			writeError(writer, request, http.StatusBadGateway, "backend connection broken mid-response")
+			return
+		case ErrorCertPinMismatch:
+			// another attempt meets the same key, possibly an impostor
+			var pinErr *backend.PinMismatchError
+			errors.As(e, &pinErr)
+			alertCertPinMismatch(b, pinErr)
+			writeError(writer, request, http.StatusBadGateway, "bad gateway")
+			return
+		case ErrorResponseHash:
+			// the body was corrupted or tampered with, never pass it on
+			var hashErr *responseHashError
+			errors.As(e, &hashErr)
+			alertResponseHashMismatch(b, hashErr)
+			writeError(writer, request, http.StatusBadGateway, "bad gateway")
+			return
+		case ErrorDial, ErrorTLS:
+			// nothing reached the backend, so any request may go to another
+			// one. Retrying will not fix a TLS configuration, alert instead.
+			if class == ErrorTLS && b.IsAlive() {
+				alertBackendError(b, ErrorTLS, e)
+			}
+			serverPool.MarkBackendStatus(serverUrl, false)
+			if unbuffered, _ := request.Context().Value(BodyUnbuffered).(bool); unbuffered {
+				writeError(writer, request, http.StatusBadGateway, "bad gateway")
+				return
+			}
+			tryNext()
+			return
+		}
+
+		// timeouts and resets may have reached the backend
+		if !isRetryable(request) {
+			writeError(writer, request, http.StatusBadGateway, "bad gateway")
+			return
+		}
+
+		// a draining backend takes no new requests, try another one
+		if b.Draining() {
+			tryNext()
+			return
+		}
+
+		// retry
+		retires := GetRetryFromContext(request)
+		if retires < config.MaxRetries {
+			metrics.Retried(serverUrl.String())
+			select {
+			case <-time.After(time.Duration(config.RetryDelay)):
+				if entry != nil {
+					entry.begin(serverUrl.String())
+				}
+				ctx := context.WithValue(request.Context(), Retry, retires+1)
+				proxy.ServeHTTP(writer, request.WithContext(ctx))
+			case <-request.Context().Done():
+			}
+			return
+		}
+		// change the status of `serverUrl` backend
+		serverPool.MarkBackendStatus(serverUrl, false)
+		//  attempt to connect
+		tryNext()
+	}
+	return proxy
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"loadbalancer/backend"
+)
+
+func TestRejectedResponseRecordedOnce(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html>")
+	}))
+	defer srv.Close()
+	setupPool(t, srv.URL)
+	peer := serverPool.Backends()[0]
+	peer.ExpectedContentType = "application/json"
+	serverPool.CircuitBreakerThreshold = 0.5
+	var opened []backend.CircuitTransition
+	serverPool.OnCircuitChange = func(t backend.CircuitTransition) { opened = append(opened, t) }
+
+	for i := 0; i < backend.CircuitBreakerMinRequests-1; i++ {
+		if w := get("/"); w.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: status %d, want 502", i, w.Code)
+		}
+	}
+	if peer.CircuitState() != backend.CircuitClosed {
+		t.Fatalf("circuit opened after %d rejected responses", backend.CircuitBreakerMinRequests-1)
+	}
+	get("/")
+	if len(opened) != 1 || opened[0].Requests != backend.CircuitBreakerMinRequests || opened[0].Errors != backend.CircuitBreakerMinRequests {
+		t.Errorf("transitions are %+v, want one after %d failed requests", opened, backend.CircuitBreakerMinRequests)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// pushHeaders are the request headers copied to the requests of pushed
+// resources, so that backends answer them as they would the client
+var pushHeaders = []string{"Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "User-Agent"}
+
+// pusherOf returns the http.Pusher under w, nil unless the client speaks
+// HTTP/2
+func pusherOf(w http.ResponseWriter) http.Pusher {
+	for {
+		if p, ok := w.(http.Pusher); ok {
+			return p
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// pushPreloads pushes the resources of a backend response preloaded by its
+// Link headers to HTTP/2 clients, unless marked nopush
+func pushPreloads(resp *http.Response) {
+	pusher, ok := resp.Request.Context().Value(Pusher).(http.Pusher)
+	if !ok {
+		return
+	}
+	var opts *http.PushOptions
+	for _, target := range preloads(resp.Header.Values("Link")) {
+		if opts == nil {
+			opts = &http.PushOptions{Header: make(http.Header)}
+			for _, name := range pushHeaders {
+				if values := resp.Request.Header.Values(name); len(values) > 0 {
+					opts.Header[name] = values
+				}
+			}
+		}
+		if err := pusher.Push(target, opts); err != nil {
+			// pushes are disabled by the client or nested in a push
+			if err != http.ErrNotSupported {
+				log.Printf("%s(%s) Push of %s failed: %s\n", resp.Request.RemoteAddr, resp.Request.URL.Path, target, err)
+			}
+			return
+		}
+	}
+}
+
+// preloads returns the paths of the links with rel=preload and without
+// nopush, links to other origins cannot be pushed
+func preloads(links []string) []string {
+	var targets []string
+	for _, header := range links {
+		for header != "" {
+			start := strings.IndexByte(header, '<')
+			end := strings.IndexByte(header, '>')
+			if start < 0 || end < start {
+				break
+			}
+			target := header[start+1 : end]
+			header = header[end+1:]
+			params := header
+			if i := strings.IndexByte(header, ','); i >= 0 {
+				params, header = header[:i], header[i+1:]
+			} else {
+				header = ""
+			}
+			preload, nopush := false, false
+			for _, param := range strings.Split(params, ";") {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				switch strings.ToLower(kv[0]) {
+				case "rel":
+					if len(kv) == 2 {
+						for _, rel := range strings.Fields(strings.Trim(kv[1], `"`)) {
+							preload = preload || strings.EqualFold(rel, "preload")
+						}
+					}
+				case "nopush":
+					nopush = true
+				}
+			}
+			if preload && !nopush && strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
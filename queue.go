@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// priorityHeader carries the priority of a request, it is not forwarded
+const priorityHeader = "X-Priority"
+
+// Priorities of queued requests, lower values are served first
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+)
+
+// priorityNames are the values of priorityHeader by priority
+var priorityNames = []string{"high", "normal", "low"}
+
+// requestPriority returns the priority of r and removes its header
+func requestPriority(r *http.Request) int {
+	value := strings.ToLower(strings.TrimSpace(r.Header.Get(priorityHeader)))
+	r.Header.Del(priorityHeader)
+	for priority, name := range priorityNames {
+		if value == name {
+			return priority
+		}
+	}
+	return priorityNormal
+}
+
+// GetPriorityFromContext returns the priority of the request, normal when
+// it has none
+func GetPriorityFromContext(r *http.Request) int {
+	if priority, ok := r.Context().Value(Priority).(int); ok {
+		return priority
+	}
+	return priorityNormal
+}
+
+var (
+	errQueueFull    = errors.New("request queue full")
+	errQueueTimeout = errors.New("timed out in the request queue")
+)
+
+var queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_queue_depth",
+	Help: "Requests waiting for a backend below its concurrency limit, by priority.",
+}, []string{"priority"})
+
+func init() {
+	prometheus.MustRegister(queueDepth)
+}
+
+// queuedRequest is a request waiting in a requestQueue
+type queuedRequest struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	// index is the position in the heap, -1 once popped
+	index int
+	// preempted is set when a request of higher priority took the place
+	preempted bool
+}
+
+// requestHeap orders queued requests by priority, then by arrival
+type requestHeap []*queuedRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	q := x.(*queuedRequest)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	q.index = -1
+	*h = old[:len(old)-1]
+	return q
+}
+
+// queue holds the requests waiting for a backend, nil without
+// -backend-max-concurrent or -queue-size
+var queue *requestQueue
+
+// requestQueue holds requests while all backends are at capacity and lets
+// them go on, highest priority first, whenever a request to a backend ends
+type requestQueue struct {
+	size    int
+	timeout time.Duration
+
+	mux   sync.Mutex
+	heap  requestHeap
+	seq   uint64
+	depth [3]int
+}
+
+// newRequestQueue returns a queue of at most size requests waiting up to timeout
+func newRequestQueue(size int, timeout time.Duration) *requestQueue {
+	q := &requestQueue{size: size, timeout: timeout}
+	for _, name := range priorityNames {
+		queueDepth.WithLabelValues(name).Set(0)
+	}
+	return q
+}
+
+// wait blocks until a backend may have room for a request of priority. A
+// full queue turns away a request of lower priority than all queued ones,
+// otherwise the last queued request of the lowest priority is preempted.
+func (q *requestQueue) wait(ctx context.Context, priority int) error {
+	q.mux.Lock()
+	if len(q.heap) >= q.size {
+		last := q.lowest()
+		if last == nil || last.priority <= priority {
+			q.mux.Unlock()
+			return errQueueFull
+		}
+		heap.Remove(&q.heap, last.index)
+		q.changeDepth(last.priority, -1)
+		last.preempted = true
+		close(last.ready)
+	}
+	q.seq++
+	req := &queuedRequest{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	heap.Push(&q.heap, req)
+	q.changeDepth(priority, 1)
+	q.mux.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-req.ready:
+		q.mux.Lock()
+		preempted := req.preempted
+		q.mux.Unlock()
+		if preempted {
+			return errQueueFull
+		}
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if req.preempted {
+		return errQueueFull
+	}
+	if req.index >= 0 {
+		heap.Remove(&q.heap, req.index)
+		q.changeDepth(priority, -1)
+		return err
+	}
+	// released meanwhile, hand the turn on
+	q.releaseLocked()
+	return err
+}
+
+// lowest returns the queued request served last, q.mux must be held
+func (q *requestQueue) lowest() *queuedRequest {
+	var last *queuedRequest
+	for _, req := range q.heap {
+		if last == nil || !q.heap.Less(req.index, last.index) {
+			last = req
+		}
+	}
+	return last
+}
+
+// release lets the first queued request go on
+func (q *requestQueue) release() {
+	q.mux.Lock()
+	q.releaseLocked()
+	q.mux.Unlock()
+}
+
+// releaseLocked is release with q.mux held
+func (q *requestQueue) releaseLocked() {
+	if len(q.heap) == 0 {
+		return
+	}
+	req := heap.Pop(&q.heap).(*queuedRequest)
+	q.changeDepth(req.priority, -1)
+	close(req.ready)
+}
+
+// changeDepth updates the depth of priority, q.mux must be held
+func (q *requestQueue) changeDepth(priority, delta int) {
+	q.depth[priority] += delta
+	queueDepth.WithLabelValues(priorityNames[priority]).Set(float64(q.depth[priority]))
+}
+
+// depths returns the number of queued requests by priority name
+func (q *requestQueue) depths() map[string]int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	depths := make(map[string]int, len(priorityNames))
+	for priority, name := range priorityNames {
+		depths[name] = q.depth[priority]
+	}
+	return depths
+}
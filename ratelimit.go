@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter decides whether a client may send another request
+type rateLimiter interface {
+	Allow(client string) bool
+}
+
+// newRateLimiter returns the limiter registered under algorithm allowing
+// count requests per window and per client
+func newRateLimiter(algorithm string, count int, window time.Duration) (rateLimiter, error) {
+	switch algorithm {
+	case "token-bucket":
+		return newTokenBucketLimiter(count, window), nil
+	case "sliding-window":
+		return newSlidingWindowLimiter(count, window), nil
+	}
+	return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+}
+
+// idleClientTimeout is how long the state of a silent client is kept
+const idleClientTimeout = 5 * time.Minute
+
+// tokenBucketLimiter keeps a token bucket per client. Buckets refill at a
+// fixed rate, so a client that stayed quiet may send a burst of requests.
+type tokenBucketLimiter struct {
+	mux     sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	// taken counts the tokens taken from the bucket
+	taken int64
+}
+
+func newTokenBucketLimiter(count int, window time.Duration) *tokenBucketLimiter {
+	l := &tokenBucketLimiter{
+		limit:   rate.Limit(float64(count) / window.Seconds()),
+		burst:   count,
+		clients: make(map[string]*tokenBucket),
+	}
+	go l.evict()
+	return l
+}
+
+// Allow takes a token from the bucket of client
+func (l *tokenBucketLimiter) Allow(client string) bool {
+	b := l.bucket(client)
+	if !b.limiter.Allow() {
+		return false
+	}
+	atomic.AddInt64(&b.taken, 1)
+	return true
+}
+
+// bucket returns the bucket of client, created full if it has none
+func (l *tokenBucketLimiter) bucket(client string) *tokenBucket {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = b
+	}
+	b.lastSeen = time.Now()
+	return b
+}
+
+// evict drops the buckets of clients that have been idle for a while
+func (l *tokenBucketLimiter) evict() {
+	for range time.Tick(time.Minute) {
+		l.mux.Lock()
+		for client, b := range l.clients {
+			if time.Since(b.lastSeen) > idleClientTimeout {
+				delete(l.clients, client)
+			}
+		}
+		l.mux.Unlock()
+	}
+}
+
+// slidingWindowLimiter allows count requests per client in any window. The
+// times of the last count requests of a client are kept in a ring, a new
+// request is allowed when the oldest of them left the window.
+type slidingWindowLimiter struct {
+	mux     sync.Mutex
+	count   int
+	window  time.Duration
+	clients map[string]*timestampRing
+}
+
+// timestampRing holds the times of the latest requests of a client
+type timestampRing struct {
+	times []time.Time
+	next  int
+}
+
+func newSlidingWindowLimiter(count int, window time.Duration) *slidingWindowLimiter {
+	l := &slidingWindowLimiter{
+		count:   count,
+		window:  window,
+		clients: make(map[string]*timestampRing),
+	}
+	go l.evict()
+	return l
+}
+
+// Allow records a request of client when it fits in the window
+func (l *slidingWindowLimiter) Allow(client string) bool {
+	now := time.Now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	ring, ok := l.clients[client]
+	if !ok {
+		ring = &timestampRing{times: make([]time.Time, 0, l.count)}
+		l.clients[client] = ring
+	}
+
+	if len(ring.times) < l.count {
+		ring.times = append(ring.times, now)
+		return true
+	}
+	if now.Sub(ring.times[ring.next]) < l.window {
+		return false
+	}
+	ring.times[ring.next] = now
+	ring.next = (ring.next + 1) % l.count
+	return true
+}
+
+// evict drops the rings of clients without requests in the window
+func (l *slidingWindowLimiter) evict() {
+	for range time.Tick(time.Minute) {
+		l.mux.Lock()
+		for client, ring := range l.clients {
+			newest := ring.times[(ring.next+len(ring.times)-1)%len(ring.times)]
+			if time.Since(newest) > l.window {
+				delete(l.clients, client)
+			}
+		}
+		l.mux.Unlock()
+	}
+}
+
+// clientIP returns the IP address of the client that sent r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitMiddleware replies 429 to clients exceeding the limiter
+func rateLimitMiddleware(limiter rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !limiter.Allow(ip) {
+			log.Printf("%s(%s) Rate limit exceeded\n", r.RemoteAddr, r.URL.Path)
+			writeError(w, r, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bandwidthMiddleware limits each client to the byte rate of the buckets of
+// limiter, a token per byte of response body
+func bandwidthMiddleware(limiter *tokenBucketLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &throttledWriter{
+			ResponseWriter: w,
+			limiter:        limiter,
+			client:         clientIP(r),
+			request:        r,
+		}
+		next.ServeHTTP(tw, r)
+	})
+}
+
+// throttledWriter waits for tokens of the client's bucket before writing
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *tokenBucketLimiter
+	client  string
+	request *http.Request
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.limiter.burst {
+			chunk = chunk[:w.limiter.burst]
+		}
+		b := w.limiter.bucket(w.client)
+		if err := b.limiter.WaitN(w.request.Context(), len(chunk)); err != nil {
+			return written, err
+		}
+		atomic.AddInt64(&b.taken, int64(len(chunk)))
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush lets streamed responses through
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, CONNECT tunnels are not throttled
+func (w *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
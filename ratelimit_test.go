@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// maxInWindow hammers a single client of l for a few windows and returns the
+// most requests certainly allowed in the same window, taking the limiter to
+// decide at some time between the call to Allow and its return
+func maxInWindow(l rateLimiter, window time.Duration) int {
+	type call struct{ start, end time.Time }
+	var allowed []call
+	for end := time.Now().Add(3 * window); time.Now().Before(end); {
+		start := time.Now()
+		if l.Allow("10.0.0.1") {
+			allowed = append(allowed, call{start, time.Now()})
+		}
+	}
+	most := 0
+	for i, first := 0, 0; i < len(allowed); i++ {
+		for allowed[i].end.Sub(allowed[first].start) >= window {
+			first++
+		}
+		if n := i - first + 1; n > most {
+			most = n
+		}
+	}
+	return most
+}
+
+func TestSlidingWindowIsExact(t *testing.T) {
+	const count, window = 10, 50 * time.Millisecond
+	if most := maxInWindow(newSlidingWindowLimiter(count, window), window); most != count {
+		t.Errorf("sliding window allowed %d requests in a window, want %d", most, count)
+	}
+	// a full bucket lets a burst through on top of the refill
+	if most := maxInWindow(newTokenBucketLimiter(count, window), window); most <= count || most > 2*count+1 {
+		t.Errorf("token bucket allowed %d requests in a window, want between %d and %d", most, count+1, 2*count+1)
+	}
+}
+
+// BenchmarkRateLimiter compares the cost of a decision, the memory kept
+// per client and the most requests let through in a window of the two
+// algorithms
+func BenchmarkRateLimiter(b *testing.B) {
+	const count, window, clients = 100, 10 * time.Millisecond, 1024
+	names := make([]string, clients)
+	for i := range names {
+		names[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+	for _, algorithm := range []string{"token-bucket", "sliding-window"} {
+		b.Run(algorithm, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			l, err := newRateLimiter(algorithm, count, window)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, name := range names {
+				for i := 0; i < count; i++ {
+					l.Allow(name)
+				}
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			perClient := float64(after.HeapAlloc-before.HeapAlloc) / clients
+			most := maxInWindow(l, window)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					l.Allow(names[i%clients])
+				}
+			})
+			b.ReportMetric(perClient, "B/client")
+			b.ReportMetric(float64(most), "max/window")
+		})
+	}
+}
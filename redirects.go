@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"loadbalancer/backend"
+)
+
+// followRedirects replaces a redirect of a backend with the response of its
+// target, up to config.FollowRedirects times. Only redirects to backends of
+// the pool are followed, through the transport of the target and signed
+// with its key. Other redirects, and those of requests whose body cannot be
+// sent again, are passed to the client.
+func followRedirects(resp *http.Response) error {
+	for depth := 0; depth < config.FollowRedirects; depth++ {
+		req := redirectRequest(resp)
+		if req == nil {
+			return nil
+		}
+		target := redirectTarget(req.URL)
+		if target == nil {
+			return nil
+		}
+		// the signature was made for the previous request and key
+		req.Header.Del(signatureHeader)
+		req.Header.Del(signatureTimestampHeader)
+		req.Header.Del(contentSHA256Header)
+		signRequest(target, req)
+		transport := serverPool.Transport(target)
+		if target.ReverseProxy != nil && target.ReverseProxy.Transport != nil {
+			transport = target.ReverseProxy.Transport
+		}
+		next, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		*resp = *next
+	}
+	return nil
+}
+
+// redirectRequest returns the request following the redirect resp, or nil
+// if resp is not a redirect that can be followed
+func redirectRequest(resp *http.Response) *http.Request {
+	prev := resp.Request
+	method := prev.Method
+	withBody := true
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != http.MethodGet && method != http.MethodHead {
+			method = http.MethodGet
+		}
+		withBody = false
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	hasBody := prev.Body != nil && prev.Body != http.NoBody
+	if withBody && hasBody && prev.GetBody == nil {
+		return nil
+	}
+
+	req := prev.Clone(prev.Context())
+	req.Method = method
+	req.URL = location
+	req.Host = location.Host
+	if withBody && hasBody {
+		req.Body, _ = prev.GetBody()
+	} else {
+		req.Body, req.GetBody, req.ContentLength = nil, nil, 0
+		req.Header.Del("Content-Length")
+		req.Header.Del("Content-Encoding")
+		req.Header.Del("Content-Type")
+	}
+	return req
+}
+
+// redirectTarget returns the backend of the pool at the scheme and host of
+// u, nil if there is none
+func redirectTarget(u *url.URL) *backend.Backend {
+	for _, b := range serverPool.Backends() {
+		if strings.EqualFold(b.URL.Scheme, u.Scheme) && strings.EqualFold(b.URL.Host, u.Host) {
+			return b
+		}
+	}
+	return nil
+}
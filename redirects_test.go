@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// validSignature reports whether r carries an hmac-sha256 signature made
+// with key
+func validSignature(r *http.Request, key string) bool {
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, r.Method+"\n"+r.URL.RequestURI()+"\n"+r.Header.Get(contentSHA256Header)+"\n"+r.Header.Get(signatureTimestampHeader))
+	return hmac.Equal([]byte(r.Header.Get(signatureHeader)), []byte("hmac-sha256="+hex.EncodeToString(mac.Sum(nil))))
+}
+
+// redirectingBackend redirects /start to /final of the URL returned by
+// peer, and answers /final when it is signed with key
+func redirectingBackend(t *testing.T, key string, peer func() string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/start":
+			http.Redirect(w, r, peer()+"/final", http.StatusFound)
+		case !validSignature(r, key):
+			http.Error(w, "bad signature", http.StatusForbidden)
+		default:
+			io.WriteString(w, "final")
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFollowRedirectsResignsForTheTarget(t *testing.T) {
+	var a, b *httptest.Server
+	a = redirectingBackend(t, "key-a", func() string { return b.URL })
+	b = redirectingBackend(t, "key-b", func() string { return a.URL })
+	setupPool(t, a.URL, b.URL)
+	config.FollowRedirects = 1
+	for rawURL, key := range map[string]string{a.URL: "key-a", b.URL: "key-b"} {
+		peer := serverPool.GetBackend(rawURL)
+		peer.SigningKey, peer.SigningAlgorithm = key, "hmac-sha256"
+	}
+	for i := 0; i < 2; i++ {
+		w := get("/start")
+		if w.Code != http.StatusOK || w.Body.String() != "final" {
+			t.Errorf("request %d: status %d, body %q", i, w.Code, w.Body)
+		}
+	}
+}
+
+func TestFollowRedirectsDropsSignatureForUnsignedTarget(t *testing.T) {
+	var signed int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(signatureHeader) != "" {
+			atomic.AddInt32(&signed, 1)
+		}
+	}))
+	defer target.Close()
+	origin := redirectingBackend(t, "key", func() string { return target.URL })
+	setupPool(t, origin.URL, target.URL)
+	config.FollowRedirects = 1
+	peer := serverPool.GetBackend(origin.URL)
+	peer.SigningKey, peer.SigningAlgorithm = "key", "hmac-sha256"
+	serverPool.GetBackend(target.URL).SetAlive(false)
+
+	if w := get("/start"); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if signed != 0 {
+		t.Error("signature of the origin sent to the target")
+	}
+}
+
+func TestFollowRedirectsStaysInPool(t *testing.T) {
+	var leaked int32
+	outside := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&leaked, 1)
+	}))
+	defer outside.Close()
+	origin := redirectingBackend(t, "key", func() string { return outside.URL })
+	setupPool(t, origin.URL)
+	config.FollowRedirects = 3
+
+	r := httptest.NewRequest(http.MethodGet, "/start", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	w := httptest.NewRecorder()
+	lb(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != outside.URL+"/final" {
+		t.Errorf("status %d, Location %q, want the redirect passed on", w.Code, w.Header().Get("Location"))
+	}
+	if leaked != 0 {
+		t.Error("redirect out of the pool followed with the credentials of the client")
+	}
+}
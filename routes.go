@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"loadbalancer/backend"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Route pins the requests below a path prefix to the backends carrying a tag
+// and overrides the request timeout for them
+type Route struct {
+	Prefix   string   `json:"prefix"`
+	TagKey   string   `json:"tag_key,omitempty"`
+	TagValue string   `json:"tag_value,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+}
+
+// routeFlag collects the routes given with -route-tag
+type routeFlag struct {
+	routes *[]Route
+}
+
+func (f routeFlag) String() string {
+	if f.routes == nil {
+		return ""
+	}
+	var s []string
+	for _, r := range *f.routes {
+		route := r.Prefix
+		if r.TagKey != "" {
+			route += fmt.Sprintf("=%s=%s", r.TagKey, r.TagValue)
+		}
+		if r.Timeout > 0 {
+			route += ";timeout=" + time.Duration(r.Timeout).String()
+		}
+		s = append(s, route)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses a route of the form "/v2/=version=v2", a tag or a timeout may
+// be left out as in "/reports/;timeout=5m" or "/v2/=version=v2;timeout=5s"
+func (f routeFlag) Set(v string) error {
+	var route Route
+	spec := v
+	if i := strings.Index(spec, ";timeout="); i >= 0 {
+		timeout, err := time.ParseDuration(spec[i+len(";timeout="):])
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("route %q: timeout must be a positive duration", v)
+		}
+		route.Timeout = Duration(timeout)
+		spec = spec[:i]
+	}
+	parts := strings.SplitN(spec, "=", 3)
+	switch {
+	case len(parts) == 3 && strings.HasPrefix(parts[0], "/") && parts[1] != "":
+		route.Prefix, route.TagKey, route.TagValue = parts[0], parts[1], parts[2]
+	case len(parts) == 1 && strings.HasPrefix(parts[0], "/") && route.Timeout > 0:
+		route.Prefix = parts[0]
+	default:
+		return fmt.Errorf("route %q is not of the form /prefix/=key=value[;timeout=<duration>]", v)
+	}
+	*f.routes = append(*f.routes, route)
+	return nil
+}
+
+// matchRoute returns the route with the longest prefix matching path
+func matchRoute(routes []Route, path string) (Route, bool) {
+	var best Route
+	found := false
+	for _, route := range routes {
+		if strings.HasPrefix(path, route.Prefix) && (!found || len(route.Prefix) > len(best.Prefix)) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+// routeMiddleware restricts the requests matching a route to the backends
+// with the tag of the route and sets the deadline of the route
+func routeMiddleware(routes []Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := matchRoute(routes, r.URL.Path)
+		if ok && route.TagKey != "" {
+			r = r.WithContext(backend.WithTag(r.Context(), route.TagKey, route.TagValue))
+		}
+		if ok && route.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Duration(route.Timeout))
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"loadbalancer/backend"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// maxShadowRequests bounds the shadow requests in flight, requests
+// arriving while all of them are busy are not mirrored
+const maxShadowRequests = 64
+
+// mirror sends copies of requests to the shadow backends, their responses
+// are discarded and never delay the response of the primary backend. A
+// shadow request is cancelled when the request it copies ends.
+type mirror struct {
+	backends   []*backend.Backend
+	transports map[*backend.Backend]http.RoundTripper
+	current    uint64
+	rate       float64
+	slots      chan struct{}
+}
+
+// newMirror returns a mirror to the shadow backends given as URLs
+func newMirror(rawURLs []string, rate float64) (*mirror, error) {
+	m := &mirror{
+		transports: make(map[*backend.Backend]http.RoundTripper),
+		rate:       rate,
+		slots:      make(chan struct{}, maxShadowRequests),
+	}
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		b := &backend.Backend{URL: u, Alive: true}
+		m.backends = append(m.backends, b)
+		m.transports[b] = serverPool.Transport(b)
+	}
+	return m, nil
+}
+
+// next returns the shadow backend of the next mirrored request
+func (m *mirror) next() *backend.Backend {
+	n := atomic.AddUint64(&m.current, 1)
+	return m.backends[n%uint64(len(m.backends))]
+}
+
+// send mirrors r unless it is not sampled, its body cannot be read again or
+// too many shadow requests are in flight
+func (m *mirror) send(r *http.Request) {
+	if r.Method == http.MethodConnect || !sampled(m.rate) {
+		return
+	}
+	hasBody := r.Body != nil && r.Body != http.NoBody
+	if hasBody && r.GetBody == nil {
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		log.Printf("shadow=true %s(%s) Too many shadow requests, dropped\n", r.RemoteAddr, r.URL.Path)
+		return
+	}
+
+	shadow := r.Clone(r.Context())
+	shadow.RequestURI = ""
+	if hasBody {
+		shadow.Body, _ = r.GetBody()
+	}
+	b := m.next()
+	shadow.URL.Scheme = b.URL.Scheme
+	shadow.URL.Host = b.URL.Host
+	shadow.Host = b.URL.Host
+	go func() {
+		defer func() { <-m.slots }()
+		m.do(b, shadow)
+	}()
+}
+
+// do sends a shadow request and discards the response
+func (m *mirror) do(b *backend.Backend, r *http.Request) {
+	resp, err := m.transports[b].RoundTrip(r)
+	if err != nil && r.Context().Err() != nil {
+		// the request was answered before its shadow
+		return
+	}
+	if err != nil {
+		log.Printf("shadow=true [%s] %s\n", b.URL.Host, err)
+		metrics.ShadowFailed(b.URL.String())
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil && r.Context().Err() == nil {
+		log.Printf("shadow=true [%s] Reading response failed: %s\n", b.URL.Host, err)
+		metrics.ShadowFailed(b.URL.String())
+	}
+}
+
+// shadowMiddleware mirrors requests to the shadow backends before serving
+// them. It must run after bodyBufferingMiddleware so that request bodies
+// can be sent twice.
+func shadowMiddleware(m *mirror, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.send(r)
+		next.ServeHTTP(w, r)
+	})
+}
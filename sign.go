@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"loadbalancer/backend"
+)
+
+// Headers of signed requests to backends
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	contentSHA256Header      = "X-Content-Sha256"
+)
+
+// unsignedPayload stands for the hash of a body streamed to the backend,
+// which cannot be read ahead
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signingAlgorithms are the hashes of the HMAC signatures by name
+var signingAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// signRequest signs r with the key of b. The signature is the hex HMAC of
+// the method, the path and query, the hex SHA-256 of the body and the Unix
+// time, separated by newlines.
+func signRequest(b *backend.Backend, r *http.Request) {
+	newHash, ok := signingAlgorithms[b.SigningAlgorithm]
+	if !ok || b.SigningKey == "" {
+		return
+	}
+	bodyHash := unsignedPayload
+	switch {
+	case r.Body == nil || r.Body == http.NoBody:
+		sum := sha256.Sum256(nil)
+		bodyHash = hex.EncodeToString(sum[:])
+	case r.GetBody != nil:
+		// a buffered body, read from a copy
+		if body, err := r.GetBody(); err == nil {
+			h := sha256.New()
+			_, err = io.Copy(h, body)
+			body.Close()
+			if err == nil {
+				bodyHash = hex.EncodeToString(h.Sum(nil))
+			}
+		}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(newHash, []byte(b.SigningKey))
+	io.WriteString(mac, r.Method+"\n"+r.URL.RequestURI()+"\n"+bodyHash+"\n"+timestamp)
+	r.Header.Set(contentSHA256Header, bodyHash)
+	r.Header.Set(signatureTimestampHeader, timestamp)
+	r.Header.Set(signatureHeader, b.SigningAlgorithm+"="+hex.EncodeToString(mac.Sum(nil)))
+}
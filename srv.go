@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"loadbalancer/backend"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupSRV resolves SRV records
+var lookupSRV = net.LookupSRV
+
+// srvDiscovery keeps the pool in sync with the targets of SRV records
+type srvDiscovery struct {
+	names []string
+	// managed holds the backends added from SRV records by URL
+	managed map[string]*backend.Backend
+	// checking is set once the health checks of the pool run, backends
+	// found from then on start their own
+	checking bool
+}
+
+// resolve returns the weight of every target of the SRV records by URL
+func (d *srvDiscovery) resolve() (map[string]int, error) {
+	targets := make(map[string]int)
+	for _, name := range d.names {
+		_, records, err := lookupSRV("", "", name)
+		if err != nil {
+			return nil, err
+		}
+		scheme := "http"
+		if strings.HasPrefix(name, "_https.") {
+			scheme = "https"
+		}
+		for _, srv := range records {
+			host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			weight := int(srv.Weight)
+			if weight < 1 {
+				weight = 1
+			}
+			targets[fmt.Sprintf("%s://%s", scheme, host)] += weight
+		}
+	}
+	return targets, nil
+}
+
+// refresh resolves the SRV records, adds the new targets to the pool and
+// drains the backends whose record disappeared
+func (d *srvDiscovery) refresh() error {
+	targets, err := d.resolve()
+	if err != nil {
+		return err
+	}
+	if d.managed == nil {
+		d.managed = make(map[string]*backend.Backend)
+	}
+
+	for rawURL, weight := range targets {
+		if b, ok := d.managed[rawURL]; ok {
+			b.SetWeight(weight)
+			continue
+		}
+		if serverPool.GetBackend(rawURL) != nil {
+			// given with -backends as well, leave it alone
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			log.Println("Invalid SRV target, err: ", err)
+			continue
+		}
+		b := addBackend(u, BackendConfig{URL: rawURL, Weight: weight})
+		if b == nil {
+			continue
+		}
+		d.managed[rawURL] = b
+		if d.checking {
+			go serverPool.CheckPeriodically(b)
+		}
+	}
+
+	for rawURL, b := range d.managed {
+		if _, ok := targets[rawURL]; ok {
+			continue
+		}
+		delete(d.managed, rawURL)
+		log.Printf("SRV record of %s is gone, draining\n", rawURL)
+		go func(b *backend.Backend) {
+			b.Drain()
+			if serverPool.RemoveBackend(b) {
+				log.Printf("Removed server: %s\n", b.URL)
+			}
+		}(b)
+	}
+	return nil
+}
+
+// run refreshes the SRV records every interval, a failed resolution keeps
+// the current backends
+func (d *srvDiscovery) run(interval time.Duration) {
+	d.checking = true
+	t := time.NewTicker(interval)
+	for range t.C {
+		if err := d.refresh(); err != nil {
+			log.Println("Resolving SRV backends failed, err: ", err)
+		}
+	}
+}
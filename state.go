@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval is how often the pool state is saved besides status changes
+const stateSaveInterval = time.Minute
+
+// loadState restores the pool state saved in path by a previous run, a
+// missing file is not an error
+func loadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, serverPool)
+}
+
+// stateMux serializes the saves of the pool state
+var stateMux sync.Mutex
+
+// saveState writes the pool state to path, through a temporary file so
+// that a crash never leaves half a state behind
+func saveState(path string) {
+	stateMux.Lock()
+	defer stateMux.Unlock()
+	data, err := json.Marshal(serverPool)
+	if err != nil {
+		log.Println("Encoding pool state failed, err: ", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		log.Println("Saving pool state failed, err: ", err)
+		return
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		log.Println("Saving pool state failed, err: ", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		log.Println("Saving pool state failed, err: ", err)
+	}
+}
+
+// saveStatePeriodically saves the pool state to path every stateSaveInterval
+func saveStatePeriodically(path string) {
+	for range time.Tick(stateSaveInterval) {
+		saveState(path)
+	}
+}
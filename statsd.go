@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+)
+
+// statsdSink pushes measurements to a DogStatsD agent, tagged by backend
+type statsdSink struct {
+	client *statsd.Client
+}
+
+// newStatsdSink returns a sink sending to the agent listening on addr
+func newStatsdSink(addr string) (*statsdSink, error) {
+	client, err := statsd.New(addr, statsd.WithNamespace("lb."))
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{client: client}, nil
+}
+
+// tags returns the tags of a measurement for backend
+func (s *statsdSink) tags(backend string, more ...string) []string {
+	return append([]string{"backend:" + backend}, more...)
+}
+
+func (s *statsdSink) RequestDone(backend string, code int, took time.Duration) {
+	s.client.Incr("requests", s.tags(backend, "code:"+strconv.Itoa(code)), 1)
+	s.client.Histogram("request.duration", took.Seconds(), s.tags(backend), 1)
+}
+
+func (s *statsdSink) RequestFailed(backend string) {
+	s.client.Incr("errors", s.tags(backend), 1)
+}
+
+func (s *statsdSink) Retried(backend string) {
+	s.client.Incr("retries", s.tags(backend), 1)
+}
+
+func (s *statsdSink) BackendUp(backend string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	s.client.Gauge("backend.up", v, s.tags(backend), 1)
+}
+
+func (s *statsdSink) ActiveConnections(backend string, n int64) {
+	s.client.Gauge("backend.active_connections", float64(n), s.tags(backend), 1)
+}
+
+func (s *statsdSink) BackendResponse(backend string, code int) {
+	s.client.Incr("backend.responses", s.tags(backend, "class:"+statusClass(code)), 1)
+}
+
+func (s *statsdSink) RequestPhase(backend, phase string, took time.Duration) {
+	s.client.Histogram("request.phase.duration", took.Seconds(), s.tags(backend, "phase:"+phase), 1)
+}
+
+func (s *statsdSink) CircuitState(backend, state string) {
+	s.client.Gauge("circuit_breaker.state", circuitStates[state], s.tags(backend), 1)
+}
+
+func (s *statsdSink) ShadowFailed(backend string) {
+	s.client.Incr("shadow.errors", s.tags(backend), 1)
+}
+
+func (s *statsdSink) HealthCheck(backend string, alive bool, took time.Duration) {
+	s.client.Histogram("health_check.duration", took.Seconds(), s.tags(backend), 1)
+	s.client.Incr("health_check", s.tags(backend, "result:"+healthCheckOutcome(alive)), 1)
+}
+
+func (s *statsdSink) BusiestClients(busiest []clientConns) {
+	for i, c := range busiest {
+		s.client.Gauge("connections_per_ip", float64(c.conns), []string{"top_n:" + strconv.Itoa(i+1), "ip:" + c.ip}, 1)
+	}
+}
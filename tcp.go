@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveTCP accepts connections on addr and proxies each of them to a
+// backend of the pool. With conns, connections of client IPs above
+// config.MaxConnsPerIP are closed right away.
+func serveTCP(addr string, conns *connCounter) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Println("Accepting TCP connection failed, err: ", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if conns == nil {
+			go proxyTCP(conn)
+			continue
+		}
+		ip := connIP(conn)
+		if conns.acquire(ip) > int64(config.MaxConnsPerIP) {
+			log.Printf("%s Too many connections, closing TCP connection\n", conn.RemoteAddr())
+			conn.Close()
+			conns.release(ip)
+			continue
+		}
+		go func() {
+			proxyTCP(conn)
+			conns.release(ip)
+		}()
+	}
+}
+
+// proxyTCP copies data between client and an alive backend. A backend that
+// cannot be dialed is marked down and the next one is tried.
+func proxyTCP(client net.Conn) {
+	// hashing algorithms key on the client address of the request
+	r := &http.Request{RemoteAddr: client.RemoteAddr().String(), Header: http.Header{}}
+	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
+		peer, err := serverPool.GetNextPeer(r)
+		if err != nil {
+			log.Printf("%s TCP connection rejected: %s\n", r.RemoteAddr, err)
+			client.Close()
+			return
+		}
+		upstream, err := net.DialTimeout("tcp", peer.Addr(), time.Duration(config.TCPDialTimeout))
+		if err != nil {
+			log.Printf("[%s] %s\n", peer.URL.Host, err)
+			serverPool.MarkBackendStatus(peer.URL, false)
+			continue
+		}
+
+		name := peer.URL.String()
+		metrics.ActiveConnections(name, peer.AddActive(1))
+		go pipe(upstream, client)
+		pipe(client, upstream)
+		metrics.ActiveConnections(name, peer.AddActive(-1))
+		return
+	}
+	log.Printf("%s Max attempts reached, closing TCP connection\n", r.RemoteAddr)
+	client.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"loadbalancer/backend"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTiming holds the phases of the last try of a request to a
+// backend. DNS and TLS stay zero when a kept-alive connection was reused.
+type RequestTiming struct {
+	mux sync.Mutex
+	// DNS is the time spent resolving the backend host
+	DNS time.Duration
+	// TLS is the time of the handshake with the backend
+	TLS time.Duration
+	// TTFB is the time until the first byte of the response
+	TTFB time.Duration
+	// Body is the time from the first byte until the body was read
+	Body time.Duration
+	// Received is the number of bytes read from the backend connection,
+	// headers included
+	Received int64
+}
+
+// GetRequestTimingFromContext returns the timing of the request, or nil
+// outside of accessLogMiddleware
+func GetRequestTimingFromContext(r *http.Request) *RequestTiming {
+	if timing, ok := r.Context().Value(Timing).(*RequestTiming); ok {
+		return timing
+	}
+	return nil
+}
+
+// String formats the timings as access log fields
+func (t *RequestTiming) String() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return fmt.Sprintf("dns=%s tls=%s ttfb=%s body=%s", t.DNS, t.TLS, t.TTFB, t.Body)
+}
+
+// timingTrace measures the phases of one try
+type timingTrace struct {
+	mux                       sync.Mutex
+	start, dnsStart, tlsStart time.Time
+	dns, tls, ttfb            time.Duration
+	firstByte                 time.Time
+	// conn counts the bytes read from the connection, from connRead on
+	conn     *backend.CountingConn
+	connRead int64
+}
+
+// withTimingTrace returns ctx tracing the connection and response phases
+// of a request starting now
+func withTimingTrace(ctx context.Context) (context.Context, *timingTrace) {
+	t := &timingTrace{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mux.Lock()
+			t.dnsStart = time.Now()
+			t.mux.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mux.Lock()
+			t.dns = time.Since(t.dnsStart)
+			t.mux.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mux.Lock()
+			t.tlsStart = time.Now()
+			t.mux.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mux.Lock()
+			t.tls = time.Since(t.tlsStart)
+			t.mux.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+				conn = tlsConn.NetConn()
+			}
+			if counting, ok := conn.(*backend.CountingConn); ok {
+				t.mux.Lock()
+				t.conn, t.connRead = counting, counting.BytesRead()
+				t.mux.Unlock()
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mux.Lock()
+			t.firstByte = time.Now()
+			t.ttfb = t.firstByte.Sub(t.start)
+			t.mux.Unlock()
+		},
+	}), t
+}
+
+// finish stores the phases in timing once the body is read or the try
+// failed
+func (t *timingTrace) finish(timing *RequestTiming) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var body time.Duration
+	if !t.firstByte.IsZero() {
+		body = time.Since(t.firstByte)
+	}
+	var received int64
+	if t.conn != nil {
+		received = t.conn.BytesRead() - t.connRead
+	}
+	timing.mux.Lock()
+	timing.DNS, timing.TLS, timing.TTFB, timing.Body = t.dns, t.tls, t.ttfb, body
+	timing.Received = received
+	timing.mux.Unlock()
+}
+
+// received returns the bytes read from the backend in the last try
+func (t *RequestTiming) received() int64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.Received
+}
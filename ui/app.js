@@ -0,0 +1,92 @@
+"use strict";
+
+// refreshInterval is the delay between two loads of the backend list
+const refreshInterval = 5000;
+
+// api calls the admin API, asking once for the API key when it is required
+async function api(method, path) {
+  const headers = {};
+  const key = sessionStorage.getItem("adminKey");
+  if (key) {
+    headers["Authorization"] = "Bearer " + key;
+  }
+  const resp = await fetch(path, { method, headers });
+  if (resp.status === 401) {
+    const entered = prompt("Admin API key");
+    if (entered) {
+      sessionStorage.setItem("adminKey", entered);
+      return api(method, path);
+    }
+  }
+  if (!resp.ok) {
+    throw new Error(method + " " + path + ": " + resp.status + " " + (await resp.text()).trim());
+  }
+  return resp.json();
+}
+
+// cell returns a table cell holding text
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+// row renders a backend of GET /admin/backends
+function row(b) {
+  const tr = document.createElement("tr");
+  tr.appendChild(cell(b.url));
+
+  const status = cell(b.alive ? "up" : "down");
+  const dot = document.createElement("span");
+  dot.className = "dot " + (b.alive ? "up" : "down");
+  status.prepend(dot);
+  if (b.forced) {
+    status.append(" (forced)");
+  }
+  if (b.drain_state && b.drain_state !== "idle") {
+    status.append(" (" + b.drain_state + ")");
+  }
+  tr.appendChild(status);
+
+  tr.appendChild(cell(b.active_connections, "number"));
+  tr.appendChild(cell(b.requests, "number"));
+  tr.appendChild(cell((b.error_rate * 100).toFixed(1) + "%", "number"));
+  tr.appendChild(cell(b.p99_latency, "number"));
+
+  // a forced backend goes back to its health checks, the others are forced dead
+  const button = document.createElement("button");
+  button.textContent = b.forced ? "Enable" : "Disable";
+  const action = b.forced ? "auto-health" : "force-dead";
+  button.onclick = () => {
+    button.disabled = true;
+    api("POST", "/admin/backends/" + encodeURIComponent(b.url) + "/" + action)
+      .then(refresh, showError);
+  };
+  const actions = cell("");
+  actions.appendChild(button);
+  tr.appendChild(actions);
+  return tr;
+}
+
+function showError(err) {
+  const p = document.getElementById("error");
+  p.textContent = err.message;
+  p.hidden = false;
+}
+
+async function refresh() {
+  try {
+    const backends = await api("GET", "/admin/backends");
+    document.getElementById("backends").replaceChildren(...backends.map(row));
+    document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+    document.getElementById("error").hidden = true;
+  } catch (err) {
+    showError(err);
+  }
+}
+
+refresh();
+setInterval(refresh, refreshInterval);